@@ -0,0 +1,147 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains user defined command aliases. An alias expands to a line
+that may hold several commands and pipelines like any other. $1 to $9 are
+replaced by the arguments the alias was called with and $* by all of them.
+Without any $ reference the arguments are appended to the expansion. Logged in users have their aliases
+saved with their account.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxAliases    = 50  // aliases per user
+	maxAliasLen   = 500 // length of an expansion
+	maxAliasDepth = 8   // aliases expanding to aliases
+)
+
+var aliasArgReg = regexp.MustCompile(`\$([1-9*])`)
+
+// quoteWord quotes w so lex returns it unchanged as a single word.
+func quoteWord(w string) string {
+	if w == "" {
+		return "''"
+	}
+	if !strings.ContainsAny(w, " \t\r\n'\"`\\;") {
+		return w
+	}
+	if !strings.ContainsRune(w, '\'') {
+		return "'" + w + "'"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(w) + `"`
+}
+
+// substitute replaces the $ references in expansion with the quoted words of
+// args, or appends them when there are none. A reference inside quotes closes
+// the quote around the inserted word so the word stays intact.
+func substitute(expansion string, args []string) string {
+	quoted := make([]string, len(args))
+	for i, w := range args {
+		quoted[i] = quoteWord(w)
+	}
+	if !aliasArgReg.MatchString(expansion) {
+		if len(quoted) == 0 {
+			return expansion
+		}
+		return expansion + " " + strings.Join(quoted, " ")
+	}
+	var out strings.Builder
+	quote := byte(0)
+	escaped := false
+	for i := 0; i < len(expansion); i++ {
+		ch := expansion[i]
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\' && quote != '\'' && quote != '`':
+			escaped = true
+		case ch == '$' && i+1 < len(expansion) && aliasArgReg.MatchString(expansion[i:i+2]):
+			word := ""
+			if expansion[i+1] == '*' {
+				word = strings.Join(quoted, " ")
+			} else if n := int(expansion[i+1] - '0'); n <= len(quoted) {
+				word = quoted[n-1]
+			}
+			if quote != 0 {
+				word = string(quote) + word + string(quote)
+			}
+			out.WriteString(word)
+			i++
+			continue
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		}
+		out.WriteByte(ch)
+	}
+	return out.String()
+}
+
+// setAlias defines or, with an empty expansion, removes an alias and saves the
+// aliases of logged in users.
+func (c *client) setAlias(name, expansion string) error {
+	name = strings.ToLower(name)
+	if expansion != "" {
+		if !isName(name) {
+			return errors.New("Invalid characters in alias name.")
+		}
+		if _, ok := sysCommands[name]; ok {
+			return errors.New(name + " is a command.")
+		}
+		if _, ok := chatCommands[name]; ok {
+			return errors.New(name + " is a command.")
+		}
+		if len(expansion) > maxAliasLen {
+			return fmt.Errorf("Aliases may be at most %d characters long.", maxAliasLen)
+		}
+		if _, ok := c.aliases[name]; !ok && len(c.aliases) >= maxAliases {
+			return fmt.Errorf("You can have at most %d aliases.", maxAliases)
+		}
+	} else if _, ok := c.aliases[name]; !ok {
+		return errors.New("No such alias: " + name)
+	}
+	// replace rather than modify the map, background jobs may be reading it
+	aliases := make(map[string]string)
+	for k, v := range c.aliases {
+		aliases[k] = v
+	}
+	if expansion == "" {
+		delete(aliases, name)
+	} else {
+		aliases[name] = expansion
+	}
+	c.aliases = aliases
+	if c.user.auth {
+		_, err := changeUser(c.user.ID, func(r *userRecord) error {
+			r.Aliases = aliases
+			return nil
+		})
+		return err
+	}
+	return nil
+}
+
+// aliasNames returns the names of the aliases of c sorted.
+func (c *client) aliasNames() (names []string) {
+	for name := range c.aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
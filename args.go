@@ -0,0 +1,345 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the command line lexer and the declarative argument specs
+used by commands. A command lists its positional arguments and --flags as
+params and its handler receives the parsed, type checked values.
+*/
+
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lex splits a command line into words the way a shell would. Single quotes,
+// double quotes and backticks group words and are removed. A backslash
+// escapes the next character outside single quotes and backticks.
+func lex(s string) (words []string, e error) {
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'' && quote != '`':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated %c quote.", quote)
+	}
+	if escaped {
+		return nil, errors.New("Nothing to escape at end of line.")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return
+}
+
+// paramType is the type of value a param accepts.
+type paramType int
+
+const (
+	strParam paramType = iota
+	intParam
+	boolParam
+	durParam
+)
+
+func (t paramType) String() string {
+	switch t {
+	case intParam:
+		return "number"
+	case boolParam:
+		return "true|false"
+	case durParam:
+		return "duration"
+	}
+	return "text"
+}
+
+// param describes a positional argument or a --flag of a command.
+type param struct {
+	Name     string
+	Desc     string
+	Type     paramType
+	Default  string
+	Optional bool      // positional params only; flags are always optional
+	Rest     bool      // last positional param, takes the remaining words other than flags
+	Flag     bool      // given as --name=value or --name value
+	Short    string    // single letter alias of a flag, given as -x
+	Choices  []string  // if set the value must be one of these
+	Complete completer // tab completion candidates, if any
+	Secret   bool      // a password, token or code; keeps the line out of the saved history
+}
+
+// check validates value against the type and choices of p.
+func (p param) check(value string) error {
+	if len(p.Choices) > 0 {
+		ok := false
+		for _, choice := range p.Choices {
+			if strings.EqualFold(choice, value) {
+				ok = true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s must be one of: %s", p.Name, strings.Join(p.Choices, ", "))
+		}
+	}
+	var err error
+	switch p.Type {
+	case intParam:
+		_, err = strconv.Atoi(value)
+	case boolParam:
+		_, err = strconv.ParseBool(value)
+	case durParam:
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s must be a %s", p.Name, p.Type)
+	}
+	return nil
+}
+
+// synopsis returns the usage form of p, e.g. <name>, [name] or [--name=<number>].
+func (p param) synopsis() string {
+	if p.Flag {
+		name := "--" + p.Name
+		if p.Short != "" {
+			name = "-" + p.Short + "|" + name
+		}
+		if p.Type == boolParam {
+			return "[" + name + "]"
+		}
+		return "[" + name + "=<" + p.Type.String() + ">]"
+	}
+	s := p.Name
+	if len(p.Choices) > 0 {
+		s = strings.Join(p.Choices, "|")
+	}
+	if p.Rest {
+		s += "..."
+	}
+	if p.Optional {
+		return "[" + s + "]"
+	}
+	return "<" + s + ">"
+}
+
+// args holds the parsed arguments of a single command invocation along with
+// its input and output.
+type args struct {
+	Name   string   // the command name as typed
+	Words  []string // the words after the command name
+	values map[string]string
+	given  map[string]bool
+	ctx    context.Context // cancelled along with the job running the command
+	in     *lineBuffer     // output of the previous command in a pipeline, if any
+	out    output
+	user   user   // who the command runs as, see identity
+	server string // the chat server it runs on, if any
+}
+
+// println writes a line of output.
+func (a *args) println(text string) error {
+	if a.out == nil {
+		return nil
+	}
+	return a.out.writeLine(text)
+}
+
+// input returns the lines piped into the command.
+func (a *args) input() ([]string, error) {
+	if a.in == nil {
+		return nil, errors.New(a.Name + " reads the output of another command, e.g. audit | " + a.Name)
+	}
+	return *a.in, nil
+}
+
+// str returns the value of the param called name.
+func (a *args) str(name string) string {
+	return a.values[name]
+}
+
+// lower returns the value of the param called name in lower case.
+func (a *args) lower(name string) string {
+	return strings.ToLower(a.values[name])
+}
+
+// int returns the value of an intParam.
+func (a *args) int(name string) int {
+	n, _ := strconv.Atoi(a.values[name])
+	return n
+}
+
+// bool returns the value of a boolParam.
+func (a *args) bool(name string) bool {
+	b, _ := strconv.ParseBool(a.values[name])
+	return b
+}
+
+// dur returns the value of a durParam.
+func (a *args) dur(name string) time.Duration {
+	d, _ := time.ParseDuration(a.values[name])
+	return d
+}
+
+// has returns true if the param called name was given rather than defaulted.
+func (a *args) has(name string) bool {
+	return a.given[name]
+}
+
+// parseArgs matches words against params.
+func parseArgs(params []param, name string, words []string) (a *args, e error) {
+	a = &args{Name: name, Words: words, values: make(map[string]string), given: make(map[string]bool)}
+	var positional []param
+	flags := make(map[string]param)
+	shorts := make(map[rune]param)
+	for _, p := range params {
+		if p.Flag {
+			flags[p.Name] = p
+			if p.Short != "" {
+				shorts[rune(p.Short[0])] = p
+			}
+		} else {
+			positional = append(positional, p)
+		}
+		if p.Default != "" {
+			a.values[p.Name] = p.Default
+		}
+	}
+	set := func(p param, value string) error {
+		if err := p.check(value); err != nil {
+			return err
+		}
+		a.values[p.Name] = value
+		a.given[p.Name] = true
+		return nil
+	}
+	pos := 0
+	onlyPositional := false
+	// once the Rest param has taken a word, unknown --words are more of it
+	inRest := func() bool {
+		return pos < len(positional) && positional[pos].Rest && a.given[positional[pos].Name]
+	}
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if !onlyPositional && w == "--" {
+			onlyPositional = true
+			continue
+		}
+		if !onlyPositional && strings.HasPrefix(w, "--") {
+			fname, value := w[2:], ""
+			hasValue := false
+			if n := strings.Index(fname, "="); n >= 0 {
+				fname, value, hasValue = fname[:n], fname[n+1:], true
+			}
+			if p, ok := flags[fname]; ok {
+				if !hasValue {
+					if p.Type == boolParam {
+						value = "true"
+					} else if i+1 < len(words) {
+						i++
+						value = words[i]
+					} else {
+						return nil, errors.New("Missing value for --" + fname)
+					}
+				}
+				if e = set(p, value); e != nil {
+					return nil, e
+				}
+				continue
+			}
+			if !inRest() {
+				return nil, errors.New("Unknown flag --" + fname)
+			}
+		} else if !onlyPositional && isShortFlags(w, shorts) {
+			// -abc sets bool flags a and b; c may take the next word
+			for n, r := range w[1:] {
+				p := shorts[r]
+				value := "true"
+				if p.Type != boolParam {
+					if n != len(w)-2 || i+1 >= len(words) {
+						return nil, errors.New("Missing value for -" + string(r))
+					}
+					i++
+					value = words[i]
+				}
+				if e = set(p, value); e != nil {
+					return nil, e
+				}
+			}
+			continue
+		}
+		if pos >= len(positional) {
+			return nil, errors.New("Too many arguments.")
+		}
+		p := positional[pos]
+		if p.Rest {
+			// the rest takes the remaining words, less any known flags
+			if inRest() {
+				w = a.values[p.Name] + " " + w
+			}
+			if e = set(p, w); e != nil {
+				return nil, e
+			}
+			continue
+		}
+		if e = set(p, w); e != nil {
+			return nil, e
+		}
+		pos++
+	}
+	for ; pos < len(positional); pos++ {
+		if !positional[pos].Optional && !a.given[positional[pos].Name] {
+			return nil, errors.New("Missing " + positional[pos].Name + ".")
+		}
+	}
+	return
+}
+
+// isShortFlags returns true if w is a - followed only by known short flags.
+// Anything else, such as -5, is a positional word.
+func isShortFlags(w string, shorts map[rune]param) bool {
+	if len(w) < 2 || w[0] != '-' || w[1] == '-' {
+		return false
+	}
+	for _, r := range w[1:] {
+		if _, ok := shorts[r]; !ok {
+			return false
+		}
+	}
+	return true
+}
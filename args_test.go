@@ -0,0 +1,101 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	for _, c := range []struct {
+		line  string
+		words []string
+		err   bool
+	}{
+		{"", nil, false},
+		{"  say   hello  ", []string{"say", "hello"}, false},
+		{"a\tb\nc", []string{"a", "b", "c"}, false},
+		{`say "hello world"`, []string{"say", "hello world"}, false},
+		{`say 'it''s'`, []string{"say", "its"}, false},
+		{`say "a 'b' c"`, []string{"say", "a 'b' c"}, false},
+		{"say `a \\b`", []string{"say", `a \b`}, false},
+		{`say 'a \b'`, []string{"say", `a \b`}, false},
+		{`say "a \"b\""`, []string{"say", `a "b"`}, false},
+		{`say a\ b`, []string{"say", "a b"}, false},
+		{`say ""`, []string{"say", ""}, false},
+		{`x"y"z`, []string{"xyz"}, false},
+		{`say "open`, nil, true},
+		{"say `open", nil, true},
+		{`say end\`, nil, true},
+	} {
+		words, err := lex(c.line)
+		if (err != nil) != c.err {
+			t.Errorf("lex(%q) error = %v, want error %v", c.line, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(words, c.words) {
+			t.Errorf("lex(%q) = %q, want %q", c.line, words, c.words)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	params := []param{
+		{Name: "action", Choices: []string{"add", "list"}},
+		{Name: "count", Type: intParam, Optional: true, Default: "1"},
+		{Name: "text", Optional: true, Rest: true},
+		{Name: "all", Flag: true, Type: boolParam, Short: "a"},
+		{Name: "match", Flag: true, Short: "m"},
+		{Name: "every", Flag: true, Type: durParam},
+	}
+	for _, c := range []struct {
+		words  []string
+		values map[string]string // only the values checked
+		err    bool
+	}{
+		{[]string{"add"}, map[string]string{"action": "add", "count": "1", "text": ""}, false},
+		{[]string{"ADD", "3", "buy", "milk"}, map[string]string{"action": "ADD", "count": "3", "text": "buy milk"}, false},
+		{[]string{"add", "3", "buy", "--all", "milk"}, map[string]string{"text": "buy milk", "all": "true"}, false},
+		{[]string{"add", "3", "a", "--match", "x", "b"}, map[string]string{"text": "a b", "match": "x"}, false},
+		{[]string{"add", "3", "a", "--match=x"}, map[string]string{"text": "a", "match": "x"}, false},
+		{[]string{"add", "3", "a", "--other", "b"}, map[string]string{"text": "a --other b"}, false},
+		{[]string{"add", "3", "--", "--all", "-a"}, map[string]string{"text": "--all -a", "all": ""}, false},
+		{[]string{"add", "3", "x", "-am", "y"}, map[string]string{"text": "x", "all": "true", "match": "y"}, false},
+		{[]string{"add", "-5"}, map[string]string{"count": "-5"}, false},
+		{[]string{"add", "3", "-5"}, map[string]string{"text": "-5"}, false},
+		{[]string{"--every", "5m", "list"}, map[string]string{"action": "list", "every": "5m"}, false},
+		{[]string{}, nil, true},
+		{[]string{"remove"}, nil, true},
+		{[]string{"add", "three"}, nil, true},
+		{[]string{"add", "--other"}, nil, true},
+		{[]string{"add", "--match"}, nil, true},
+		{[]string{"add", "--every", "soon"}, nil, true},
+		{[]string{"add", "-ma", "x"}, nil, true},
+	} {
+		a, err := parseArgs(params, "test", c.words)
+		if (err != nil) != c.err {
+			t.Errorf("parseArgs(%q) error = %v, want error %v", c.words, err, c.err)
+			continue
+		}
+		for name, want := range c.values {
+			if got := a.str(name); got != want {
+				t.Errorf("parseArgs(%q): %s = %q, want %q", c.words, name, got, want)
+			}
+		}
+	}
+}
+
+func TestParseArgsGiven(t *testing.T) {
+	a, err := parseArgs([]param{{Name: "n", Type: intParam, Optional: true, Default: "5"},
+		{Name: "v", Flag: true, Type: boolParam}}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.has("n") || a.int("n") != 5 || a.bool("v") {
+		t.Errorf("defaults: has n %v, n %d, v %v", a.has("n"), a.int("n"), a.bool("v"))
+	}
+}
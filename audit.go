@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the audit trail, a record of security relevant events such
+as failed logins and lockouts that admins can review with the audit command.
+*/
+
+//
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+var auditDB *db.Col
+
+// auditRecord is a single entry in the audit trail.
+type auditRecord struct {
+	Time    time.Time
+	Event   string
+	Name    string
+	Address string
+	Detail  string
+}
+
+// loadAuditDB opens the audit collection, creating it if needed.
+func loadAuditDB() (e error) {
+	auditDB, e = openCollection("audit", "Name")
+	return
+}
+
+// audit records an event in the audit trail and the server log.
+func audit(event, name, address, detail string) {
+	log.Printf("audit: %s name=%q addr=%s %s", event, name, address, detail)
+	doc, err := encodeDoc(auditRecord{Time: time.Now().UTC(), Event: event, Name: name,
+		Address: address, Detail: detail})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if _, err = auditDB.Insert(doc); err != nil {
+		log.Println(err)
+	}
+}
+
+// recentAudit returns up to n of the newest audit records, oldest first.
+func recentAudit(n int) (list []auditRecord) {
+	dbLock.RLock()
+	auditDB.ForEachDoc(func(id int, b []byte) bool {
+		var r auditRecord
+		if err := decodeJSON("audit", id, b, &r); err != nil {
+			log.Println(err)
+			return true
+		}
+		list = append(list, r)
+		return true
+	})
+	dbLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	if len(list) > n {
+		list = list[len(list)-n:]
+	}
+	return
+}
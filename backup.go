@@ -0,0 +1,462 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains database backup, restore and export. A backup is a gzipped
+tar archive holding one JSON-lines file per collection plus a manifest with
+document counts, indexes and checksums that are verified on restore.
+*/
+
+//
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+// dbLock guards the database as a whole. Normal reads and writes hold it for
+// reading so a snapshot or restore, which holds it for writing, sees no
+// half-finished changes.
+var dbLock sync.RWMutex
+
+// manifest describes the contents of a backup archive.
+type manifest struct {
+	Created     time.Time
+	Collections map[string]manifestCol
+}
+
+// manifestCol describes a single collection within a backup archive.
+type manifestCol struct {
+	Docs    int
+	Indexes [][]string
+	SHA256  string
+}
+
+// record is a single document as written to backup and export files.
+type record struct {
+	Collection string          `json:"collection,omitempty"`
+	ID         int             `json:"id"`
+	Doc        json.RawMessage `json:"doc"`
+}
+
+// backupDir returns the directory backups are written to.
+func backupDir() string {
+	if *backupPath != "" {
+		return *backupPath
+	}
+	return *dbpath + SEP + "backups"
+}
+
+// dumpCol writes every document in col to w as JSON lines and returns the
+// number of documents written.
+func dumpCol(w io.Writer, name string, col *db.Col, tagged bool) (n int, e error) {
+	enc := json.NewEncoder(w)
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		r := record{ID: id, Doc: json.RawMessage(doc)}
+		if tagged {
+			r.Collection = name
+		}
+		if e = enc.Encode(r); e != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	return
+}
+
+// backup writes a consistent snapshot of every collection to a new archive in
+// backupDir and returns its path.
+func backup() (path string, e error) {
+	dir := backupDir()
+	if e = os.MkdirAll(dir, 0700); e != nil {
+		return
+	}
+	path = filepath.Join(dir, "soshell-"+time.Now().UTC().Format("20060102-150405")+".tar.gz")
+	dbLock.Lock()
+	m := manifest{Created: time.Now().UTC(), Collections: make(map[string]manifestCol)}
+	files := make(map[string][]byte)
+	for _, name := range database.AllCols() {
+		var buf bytes.Buffer
+		col := database.Use(name)
+		n, err := dumpCol(&buf, name, col, false)
+		if err != nil {
+			dbLock.Unlock()
+			return "", err
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		m.Collections[name] = manifestCol{Docs: n, Indexes: col.AllIndexes(), SHA256: hex.EncodeToString(sum[:])}
+		files[name+".jsonl"] = buf.Bytes()
+	}
+	dbLock.Unlock()
+	mb, e := json.MarshalIndent(m, "", "\t")
+	if e != nil {
+		return
+	}
+	files["manifest.json"] = mb
+	if e = writeArchive(path, files); e != nil {
+		os.Remove(path)
+		return "", e
+	}
+	log.Println("Database backed up to", path)
+	return
+}
+
+// writeArchive writes files into a new gzipped tar archive at path.
+func writeArchive(path string, files map[string][]byte) (e error) {
+	f, e := os.OpenFile(path+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if e != nil {
+		return
+	}
+	defer os.Remove(path + ".tmp")
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name])), ModTime: time.Now()}
+		if e = tw.WriteHeader(hdr); e != nil {
+			f.Close()
+			return
+		}
+		if _, e = tw.Write(files[name]); e != nil {
+			f.Close()
+			return
+		}
+	}
+	if e = tw.Close(); e == nil {
+		e = gz.Close()
+	}
+	if err := f.Close(); e == nil {
+		e = err
+	}
+	if e == nil {
+		e = os.Rename(path+".tmp", path)
+	}
+	return
+}
+
+// readArchive reads a backup archive and verifies its contents against the
+// manifest, returning the manifest and the verified collection files.
+func readArchive(path string) (m manifest, files map[string][]byte, e error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	gz, e := gzip.NewReader(f)
+	if e != nil {
+		return
+	}
+	tr := tar.NewReader(gz)
+	files = make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return m, nil, err
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return m, nil, err
+		}
+		files[hdr.Name] = b
+	}
+	mb, ok := files["manifest.json"]
+	if !ok {
+		return m, nil, errors.New("Backup has no manifest.")
+	}
+	if e = json.Unmarshal(mb, &m); e != nil {
+		return
+	}
+	for name, info := range m.Collections {
+		b, ok := files[name+".jsonl"]
+		if !ok {
+			return m, nil, fmt.Errorf("Backup is missing collection %s.", name)
+		}
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) != info.SHA256 {
+			return m, nil, fmt.Errorf("Checksum mismatch for collection %s.", name)
+		}
+		if n := bytes.Count(b, []byte("\n")); n != info.Docs {
+			return m, nil, fmt.Errorf("Collection %s has %d documents, expected %d.", name, n, info.Docs)
+		}
+	}
+	return
+}
+
+// buildDB creates a new database at dir from a verified backup.
+func buildDB(dir string, m manifest, files map[string][]byte) (e error) {
+	if pathExists(dir) {
+		return errors.New("Restore target already exists: " + dir)
+	}
+	d, e := db.OpenDB(dir)
+	if e != nil {
+		return
+	}
+	defer d.Close()
+	for name, info := range m.Collections {
+		if e = d.Create(name); e != nil {
+			return
+		}
+		col := d.Use(name)
+		for _, path := range info.Indexes {
+			if e = col.Index(path); e != nil {
+				return
+			}
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(files[name+".jsonl"]))
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var r record
+			var doc map[string]interface{}
+			if e = json.Unmarshal(scanner.Bytes(), &r); e != nil {
+				return
+			}
+			if e = json.Unmarshal(r.Doc, &doc); e != nil {
+				return
+			}
+			if e = col.InsertRecovery(r.ID, doc); e != nil {
+				return
+			}
+		}
+		if e = scanner.Err(); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// restore replaces the database with the contents of the backup at path. The
+// current database is kept alongside as database.old-<time>. When the server
+// is running the swap happens while holding dbLock, and if the restored
+// database doesn't open the old one is put back.
+func restore(path string, running bool) (e error) {
+	m, files, e := readArchive(path)
+	if e != nil {
+		return
+	}
+	live := *dbpath + SEP + "database"
+	staged := live + ".restore"
+	os.RemoveAll(staged)
+	if e = buildDB(staged, m, files); e != nil {
+		os.RemoveAll(staged)
+		return
+	}
+	if running {
+		dbLock.Lock()
+		if e = database.Close(); e != nil {
+			dbLock.Unlock()
+			return
+		}
+	}
+	old := live + ".old-" + time.Now().UTC().Format("20060102-150405")
+	if pathExists(live) {
+		e = os.Rename(live, old)
+	}
+	if e == nil {
+		if e = os.Rename(staged, live); e != nil {
+			os.Rename(old, live)
+		}
+	}
+	if running {
+		err := loadUserDB()
+		if err != nil && e == nil && pathExists(old) {
+			// the restored database doesn't open, put the old one back
+			e = fmt.Errorf("The restored database doesn't open, kept the old one: %v", err)
+			os.RemoveAll(live)
+			if err = os.Rename(old, live); err == nil {
+				err = loadUserDB()
+			}
+		}
+		dbLock.Unlock()
+		if err != nil {
+			log.Println("Can't reopen the database:", err)
+			if e == nil {
+				e = err
+			}
+			return
+		}
+		startServices()
+	}
+	if e == nil {
+		log.Println("Database restored from", path)
+	}
+	return
+}
+
+// export writes every document in the database to w. Format is either
+// "jsonl", one tagged document per line, or "json", an array of the same.
+func export(w io.Writer, format string) (e error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	names := database.AllCols()
+	sort.Strings(names)
+	switch format {
+	case "jsonl":
+		for _, name := range names {
+			if _, e = dumpCol(w, name, database.Use(name), true); e != nil {
+				return
+			}
+		}
+	case "json":
+		var buf bytes.Buffer
+		for _, name := range names {
+			if _, e = dumpCol(&buf, name, database.Use(name), true); e != nil {
+				return
+			}
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if buf.Len() == 0 {
+			lines = nil
+		}
+		if _, e = io.WriteString(w, "["+strings.Join(lines, ",\n")+"]\n"); e != nil {
+			return
+		}
+	default:
+		e = errors.New("Unknown export format: " + format)
+	}
+	return
+}
+
+// rotateBackups removes all but the newest keep backups in backupDir.
+func rotateBackups(keep int) {
+	list, err := filepath.Glob(filepath.Join(backupDir(), "soshell-*.tar.gz"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sort.Strings(list)
+	for len(list) > keep {
+		if err := os.Remove(list[0]); err != nil {
+			log.Println(err)
+		}
+		list = list[1:]
+	}
+}
+
+// backupScheduler takes a backup every interval and rotates old ones.
+func backupScheduler(interval time.Duration, keep int) {
+	for range time.Tick(interval) {
+		if _, err := backup(); err != nil {
+			log.Println("scheduled backup failed:", err)
+			continue
+		}
+		rotateBackups(keep)
+	}
+}
+
+// runSubcommand runs one of the command line maintenance subcommands and
+// returns the process exit status.
+func runSubcommand(args []string) int {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "export format (jsonl or json)")
+	out := fs.String("o", "", "export output file (default stdout)")
+	keep := fs.Int("keep", 0, "number of backups to keep (0 keeps all)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	switch args[0] {
+	case "backup":
+		if err := loadUserDB(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer closeUserDB()
+		path, err := backup()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		if *keep > 0 {
+			rotateBackups(*keep)
+		}
+		fmt.Println(path)
+	case "restore":
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: soshell restore <backup file>")
+			return 2
+		}
+		if err := restore(fs.Arg(0), false); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case "export":
+		if err := loadUserDB(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer closeUserDB()
+		w := io.Writer(os.Stdout)
+		if *out != "" {
+			f, err := os.OpenFile(*out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := export(w, *format); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case "adduser":
+		if fs.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: soshell adduser <name> <email> (the password is read from standard input)")
+			return 2
+		}
+		name, email := fs.Arg(0), fs.Arg(1)
+		if err := checkName(name); err != nil {
+			log.Println(err)
+			return 1
+		}
+		if !isEmail(email) {
+			log.Println("Bad email address.")
+			return 1
+		}
+		pass, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if pass = strings.TrimRight(pass, "\r\n"); pass == "" {
+			log.Println("No password given.")
+			return 1
+		}
+		if err := loadUserDB(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer closeUserDB()
+		if _, err := insertUser(userRecord{Name: name, Pass: pass, Email: email, Created: time.Now().UTC()}); err != nil {
+			log.Println(err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown subcommand:", args[0])
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,436 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the IRC bridges, bots that link a chat server to a channel
+on another IRC network. A bridge is a member of its chat server while it is on
+the channel. Messages are relayed both ways with the sender's name in front,
+and joins and parts are passed on as presence notices. A bridge that loses its
+connection reconnects with a growing delay.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	maxBridgeBackoff = 5 * time.Minute
+	bridgeQueue      = 100                    // lines waiting to be sent to IRC
+	bridgeLineGap    = 500 * time.Millisecond // between lines sent, to stay under flood limits
+	bridgeDialTime   = 30 * time.Second
+)
+
+var bridgesDB *db.Col
+
+// bridgeBackoff is the first wait before reconnecting, doubled each time the
+// bridge fails to get onto its channel.
+var bridgeBackoff = 2 * time.Second
+
+// bridgeRecord is the stored form of a bridge.
+type bridgeRecord struct {
+	Room     string
+	Address  string // host:port of the IRC server
+	Channel  string
+	Nick     string
+	Prefix   string // put in front of the names of IRC users
+	Password string // server password, if needed
+	Plain    bool   // connect without TLS
+	UserID   int
+	Created  time.Time
+}
+
+// bridge is a running bridge.
+type bridge struct {
+	ID int
+	bridgeRecord
+	sid   string        // session ID, new for each start
+	queue chan string   // lines waiting to be sent to the channel
+	stop  chan struct{} // closed when the bridge is removed
+
+	sync.Mutex // guards the fields below
+	conn       net.Conn
+	status     string
+}
+
+// bridges holds the running bridges by ID.
+var bridges = struct {
+	sync.RWMutex
+	m map[int]*bridge
+}{m: make(map[int]*bridge)}
+
+// loadBridgesDB opens the bridges collection, creating it if needed.
+func loadBridgesDB() (e error) {
+	bridgesDB, e = openCollection("bridges", "UserID")
+	return
+}
+
+// startBridges starts the stored bridges, replacing any running ones.
+func startBridges() {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	loaded := make(map[int]*bridge)
+	bridgesDB.ForEachDoc(func(id int, doc []byte) bool {
+		var r bridgeRecord
+		if err := decodeJSON("bridges", id, doc, &r); err != nil {
+			log.Println(err)
+		} else {
+			loaded[id] = startBridge(id, r)
+		}
+		return true
+	})
+	bridges.Lock()
+	for _, b := range bridges.m {
+		b.halt()
+	}
+	bridges.m = loaded
+	bridges.Unlock()
+}
+
+// startBridge starts a bridge for r.
+func startBridge(id int, r bridgeRecord) *bridge {
+	b := &bridge{ID: id, bridgeRecord: r, sid: newSessionID(), queue: make(chan string, bridgeQueue),
+		stop: make(chan struct{}), status: "connecting"}
+	go b.run(bridgeBackoff)
+	return b
+}
+
+// addBridge stores and starts a new bridge.
+func addBridge(r bridgeRecord) (id int, e error) {
+	r.Created = time.Now().UTC()
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	dbLock.RLock()
+	id, e = bridgesDB.Insert(doc)
+	dbLock.RUnlock()
+	if e != nil {
+		return
+	}
+	bridges.Lock()
+	bridges.m[id] = startBridge(id, r)
+	bridges.Unlock()
+	return
+}
+
+// removeBridge stops and deletes the bridge with id.
+func removeBridge(id int) error {
+	bridges.Lock()
+	b, ok := bridges.m[id]
+	delete(bridges.m, id)
+	bridges.Unlock()
+	if !ok {
+		return errors.New("No such bridge.")
+	}
+	b.halt()
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return bridgesDB.Delete(id)
+}
+
+// restartBridge drops the connection of the bridge with id so it reconnects
+// straight away.
+func restartBridge(id int) error {
+	bridges.Lock()
+	defer bridges.Unlock()
+	b, ok := bridges.m[id]
+	if !ok {
+		return errors.New("No such bridge.")
+	}
+	b.halt()
+	bridges.m[id] = startBridge(id, b.bridgeRecord)
+	return nil
+}
+
+// listBridges returns the running bridges by ID.
+func listBridges() (list []*bridge) {
+	bridges.RLock()
+	for _, b := range bridges.m {
+		list = append(list, b)
+	}
+	bridges.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return
+}
+
+// halt stops b, dropping its connection.
+func (b *bridge) halt() {
+	close(b.stop)
+	b.Lock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.Unlock()
+}
+
+// stopped returns true once b has been halted.
+func (b *bridge) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *bridge) setStatus(status string) {
+	b.Lock()
+	b.status = status
+	b.Unlock()
+}
+
+// describe returns a line describing b for the bridge command.
+func (b *bridge) describe() string {
+	b.Lock()
+	defer b.Unlock()
+	return fmt.Sprintf("%d  %s <-> %s on %s as %s, %s", b.ID, b.Room, b.Channel, b.Address, b.Nick, b.status)
+}
+
+// run keeps b connected until it is halted, waiting backoff before the first
+// attempt to reconnect.
+func (b *bridge) run(backoff time.Duration) {
+	wait := backoff
+	for {
+		linked, err := b.session()
+		if b.stopped() {
+			return
+		}
+		if linked {
+			wait = backoff
+		}
+		log.Printf("bridge %d: %v, reconnecting in %s", b.ID, err, wait)
+		b.setStatus(fmt.Sprintf("reconnecting in %s (%v)", wait, err))
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > maxBridgeBackoff {
+			wait = maxBridgeBackoff
+		}
+	}
+}
+
+// dial connects to the IRC server of b.
+func (b *bridge) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: bridgeDialTime}
+	if b.Plain {
+		return dialer.Dial("tcp", b.Address)
+	}
+	host, _, _ := net.SplitHostPort(b.Address)
+	return tls.DialWithDialer(dialer, "tcp", b.Address, &tls.Config{ServerName: host})
+}
+
+// session connects to the IRC server and relays between the channel and the
+// chat server until the connection is lost. linked is true if it got onto
+// the channel.
+func (b *bridge) session() (linked bool, e error) {
+	b.setStatus("connecting")
+	conn, e := b.dial()
+	if e != nil {
+		return
+	}
+	b.Lock()
+	b.conn = conn
+	b.Unlock()
+	if b.stopped() {
+		conn.Close()
+		return false, errors.New("stopped")
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+		if linked {
+			part(b.Room, b)
+		}
+	}()
+	var wlock sync.Mutex
+	send := func(line string) {
+		wlock.Lock()
+		defer wlock.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+		if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+			conn.Close()
+		}
+	}
+	// what was said while the bridge was away is stale now
+	for len(b.queue) > 0 {
+		<-b.queue
+	}
+	go b.writer(send, done)
+	if b.Password != "" {
+		send("PASS " + b.Password)
+	}
+	nick := b.Nick
+	send("NICK " + nick)
+	send("USER " + strings.ToLower(b.Nick) + " 0 * :soshell bridge for " + b.Room)
+	members := make(map[string]bool) // nicks on the channel, by lower case
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircTimeout))
+		if !scanner.Scan() {
+			if e = scanner.Err(); e == nil {
+				e = errors.New("connection closed")
+			}
+			return
+		}
+		line := scanner.Text()
+		from := ircSource(line)
+		self := strings.EqualFold(from, nick)
+		cmd, params := parseIRC(line)
+		onChannel := len(params) > 0 && strings.EqualFold(params[0], b.Channel)
+		switch cmd {
+		case "PING":
+			if len(params) > 0 {
+				send("PONG :" + params[0])
+			}
+		case "001":
+			if len(params) > 0 {
+				nick = params[0]
+			}
+			send("JOIN " + b.Channel)
+		case "433":
+			if !linked {
+				nick += "_"
+				send("NICK " + nick)
+			}
+		case "403", "405", "471", "473", "474", "475":
+			return linked, fmt.Errorf("can't join %s: %s", b.Channel, params[len(params)-1])
+		case "ERROR":
+			if len(params) > 0 {
+				return linked, errors.New(params[0])
+			}
+			return linked, errors.New("closed by server")
+		case "353":
+			for _, name := range strings.Fields(params[len(params)-1]) {
+				if name = strings.TrimLeft(name, "~&@%+"); !strings.EqualFold(name, nick) {
+					members[strings.ToLower(name)] = true
+				}
+			}
+		case "JOIN":
+			if !onChannel {
+				break
+			}
+			if self {
+				linked = true
+				join(b.Room, b)
+				b.setStatus("connected")
+			} else {
+				members[strings.ToLower(from)] = true
+				b.relay("join", from, "")
+			}
+		case "PART", "KICK":
+			if !onChannel {
+				break
+			}
+			gone := from
+			if cmd == "KICK" && len(params) > 1 {
+				gone = params[1]
+			}
+			if strings.EqualFold(gone, nick) {
+				return linked, errors.New("left " + b.Channel)
+			}
+			delete(members, strings.ToLower(gone))
+			b.relay("part", gone, "")
+		case "QUIT":
+			if members[strings.ToLower(from)] {
+				delete(members, strings.ToLower(from))
+				b.relay("part", from, "")
+			}
+		case "NICK":
+			if self && len(params) > 0 {
+				nick = params[0]
+			} else if members[strings.ToLower(from)] && len(params) > 0 {
+				delete(members, strings.ToLower(from))
+				members[strings.ToLower(params[0])] = true
+				b.relay("nick", from, b.Prefix+params[0])
+			}
+		case "PRIVMSG":
+			if !onChannel || self || len(params) < 2 {
+				break
+			}
+			text := params[1]
+			if strings.HasPrefix(text, "\x01") {
+				if !strings.HasPrefix(text, "\x01ACTION ") {
+					break
+				}
+				text = "* " + strings.TrimSuffix(text[len("\x01ACTION "):], "\x01")
+			}
+			b.relay("message", from, text)
+		}
+	}
+}
+
+// writer sends the lines queued for the channel, pinging the server when
+// there is nothing to send, until done is closed.
+func (b *bridge) writer(send func(string), done chan struct{}) {
+	ping := time.NewTicker(ircPingEvery)
+	defer ping.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			send("PING :" + *hostname)
+		case line := <-b.queue:
+			send(line)
+			select {
+			case <-done:
+				return
+			case <-time.After(bridgeLineGap):
+			}
+		}
+	}
+}
+
+// relay passes something that happened on the channel to the chat server.
+func (b *bridge) relay(kind, from, text string) {
+	servers.broadcast(b.Room, roomMessage{Kind: kind, From: b.Prefix + from, Text: text,
+		Origin: "bridge", Session: b.sessionID()})
+}
+
+func (b *bridge) sessionID() string { return b.sid }
+
+func (b *bridge) nick() string { return b.Nick }
+
+// deliver queues m to be sent to the channel. It never blocks, when the queue
+// is full the message is dropped.
+func (b *bridge) deliver(m roomMessage) {
+	if m.Session == b.sessionID() {
+		return
+	}
+	var lines []string
+	switch m.Kind {
+	case "message":
+		for _, text := range ircSplit(m.Text) {
+			lines = append(lines, "PRIVMSG "+b.Channel+" :<"+ircText(m.From)+"> "+text)
+		}
+	case "join", "part", "nick":
+		lines = append(lines, "NOTICE "+b.Channel+" :"+ircText(m.line()))
+	}
+	for _, line := range lines {
+		select {
+		case b.queue <- line:
+		default:
+			log.Printf("bridge %d: queue full, dropped a line", b.ID)
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIRC is an IRC server a bridge connects to.
+type fakeIRC struct {
+	t  *testing.T
+	ln net.Listener
+}
+
+// fakeConn is the connection of a bridge to a fakeIRC.
+type fakeConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	at   time.Time // when it was accepted
+}
+
+func newFakeIRC(t *testing.T) *fakeIRC {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeIRC{t, ln}
+}
+
+// accept waits for the bridge to connect.
+func (f *fakeIRC) accept() *fakeConn {
+	f.t.Helper()
+	got := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := f.ln.Accept(); err == nil {
+			got <- conn
+		}
+	}()
+	select {
+	case conn := <-got:
+		f.t.Cleanup(func() { conn.Close() })
+		return &fakeConn{f.t, conn, bufio.NewReader(conn), time.Now()}
+	case <-time.After(5 * time.Second):
+		f.t.Fatal("the bridge didn't connect")
+		return nil
+	}
+}
+
+func (fc *fakeConn) send(line string) {
+	fc.t.Helper()
+	if _, err := fc.conn.Write([]byte(line + "\r\n")); err != nil {
+		fc.t.Fatal(err)
+	}
+}
+
+// expect skips the lines from the bridge until one starting with prefix.
+func (fc *fakeConn) expect(prefix string) string {
+	fc.t.Helper()
+	fc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := fc.r.ReadString('\n')
+		if err != nil {
+			fc.t.Fatalf("waiting for %q: %v", prefix, err)
+		}
+		if line = strings.TrimRight(line, "\r\n"); strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+// link welcomes the bridge once it has registered and puts it on #chat as
+// nick.
+func (fc *fakeConn) link(nick string) {
+	fc.t.Helper()
+	fc.send(":irc.test 001 " + nick + " :Welcome")
+	fc.expect("JOIN #chat")
+	fc.send(":" + nick + "!bot@test JOIN #chat")
+	fc.send(":irc.test 353 " + nick + " = #chat :" + nick + " @bob")
+}
+
+func testBridge(t *testing.T, f *fakeIRC) *bridge {
+	b := startBridge(0, bridgeRecord{Room: "bridgetest", Address: f.ln.Addr().String(), Channel: "#chat",
+		Nick: "soshell", Prefix: "irc/", Plain: true})
+	t.Cleanup(b.halt)
+	return b
+}
+
+func TestBridgeRelay(t *testing.T) {
+	m := &recorder{id: "watcher"}
+	join("bridgetest", m)
+	defer part("bridgetest", m)
+	f := newFakeIRC(t)
+	b := testBridge(t, f)
+	fc := f.accept()
+	if line := fc.expect("NICK "); line != "NICK soshell" {
+		t.Errorf("sent %q", line)
+	}
+	fc.expect("USER soshell ")
+	fc.send(":irc.test 433 * soshell :Nickname is already in use")
+	if line := fc.expect("NICK "); line != "NICK soshell_" {
+		t.Errorf("after 433 sent %q", line)
+	}
+	fc.link("soshell_")
+	waitFor(t, "the bridge to join", func() bool { return strings.HasSuffix(b.describe(), "connected") })
+
+	fc.send(":bob!b@remote PRIVMSG #chat :hello")
+	fc.send(":bob!b@remote PRIVMSG #chat :\x01ACTION waves\x01")
+	fc.send(":bob!b@remote PRIVMSG #chat :\x01VERSION\x01")
+	fc.send(":bob!b@remote PRIVMSG soshell_ :just to you")
+	fc.send(":soshell_!bot@test PRIVMSG #chat :<Alice> echoed")
+	fc.send(":bob!b@remote PRIVMSG #chat :bye")
+	waitFor(t, "the relayed messages", func() bool { return len(m.said()) == 3 })
+	if said, want := m.said(), []string{"irc/bob: hello", "irc/bob: * waves", "irc/bob: bye"}; !reflect.DeepEqual(said, want) {
+		t.Errorf("relayed %q, want %q", said, want)
+	}
+
+	servers.broadcast("bridgetest", roomMessage{Kind: "message", From: "Alice", Text: "hi\r\nthere"})
+	if line := fc.expect("PRIVMSG "); line != "PRIVMSG #chat :<Alice> hi  there" {
+		t.Errorf("sent %q", line)
+	}
+	servers.broadcast("bridgetest", roomMessage{Kind: "message", From: "Eve\r\nQUIT", Text: "hi"})
+	if line := fc.expect("PRIVMSG "); line != "PRIVMSG #chat :<Eve  QUIT> hi" {
+		t.Errorf("sent %q", line)
+	}
+	fc.send(":carol!c@remote JOIN #chat")
+	waitFor(t, "the join", func() bool {
+		m.Lock()
+		defer m.Unlock()
+		last := m.msgs[len(m.msgs)-1]
+		return last.Kind == "join" && last.From == "irc/carol"
+	})
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	defer func(d time.Duration) { bridgeBackoff = d }(bridgeBackoff)
+	bridgeBackoff = 50 * time.Millisecond
+	f := newFakeIRC(t)
+	b := testBridge(t, f)
+	fc := f.accept()
+	fc.expect("NICK soshell")
+	fc.expect("USER ")
+	fc.link("soshell")
+	waitFor(t, "the bridge to join", func() bool { return strings.HasSuffix(b.describe(), "connected") })
+
+	// the waits double while the bridge can't get onto the channel
+	var gaps []time.Duration
+	for i := 0; i < 3; i++ {
+		fc.send("ERROR :Closing link")
+		dropped := time.Now()
+		fc = f.accept()
+		gaps = append(gaps, fc.at.Sub(dropped))
+		fc.expect("NICK soshell")
+		fc.expect("USER ")
+	}
+	for i, gap := range gaps {
+		if min := bridgeBackoff << uint(i); gap < min {
+			t.Errorf("reconnect %d after %v, want at least %v", i+1, gap, min)
+		}
+	}
+
+	// and start again once it has
+	fc.link("soshell")
+	waitFor(t, "the bridge to join", func() bool { return strings.HasSuffix(b.describe(), "connected") })
+	fc.send("ERROR :Closing link")
+	dropped := time.Now()
+	if gap := f.accept().at.Sub(dropped); gap > 4*bridgeBackoff {
+		t.Errorf("reconnected after %v, want about %v", gap, bridgeBackoff)
+	}
+}
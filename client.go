@@ -12,9 +12,12 @@ HTML & CSS via JavaScript.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -36,24 +39,124 @@ func newPacket(t string) (pack packet) {
 // client is an extensible type representing a single websocket client.
 type client struct {
 	ws            *websocket.Conn
+	id            string // session ID
 	user          user
 	path, address string
 	server        string
-	command       *map[string]command
+	command       *commandSet
 	cmdPrefix     string
+	prefLock      sync.RWMutex // guards prefs and location, the server hub reads them
+	prefs         map[string]string
+	location      *time.Location // timezone of the profile, nil for the server's
+	aliases       map[string]string
+	history       []string
+	jobs          jobTable
+	hooks         hookSet       // enabled scripts
+	input         chan incoming // messages read by reader
+	readErr       error         // why reader stopped
+	wlock         sync.Mutex    // serialises writes to ws
+	irc           *ircConn      // set for IRC sessions, which have no ws
 }
 
-// recieve reads a single message and returns it.
+// incoming is a websocket message received from the browser.
+type incoming struct {
+	control bool
+	data    []byte
+}
+
+// controls handle the control packets the browser sends as binary messages,
+// keyed by packet type.
+var controls = make(map[string]func(c *client, p packet) error)
+
+// send writes a packet to the browser. It is safe to call from any goroutine.
+func (c *client) send(p packet) error {
+	if c.irc != nil {
+		return c.irc.notice(p)
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.ws.WriteJSON(p)
+}
+
+// reader reads messages from the websocket into c.input until the connection
+// fails. Cancel packets are handled straight away so they can interrupt the
+// foreground job.
+func (c *client) reader() {
+	defer close(c.input)
+	for {
+		t, m, err := c.ws.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			c.jobs.cancelAll()
+			return
+		}
+		msg := incoming{data: m}
+		if t == websocket.BinaryMessage {
+			var p packet
+			if json.Unmarshal(m, &p) == nil && p.Type == "cancel" {
+				if j := c.jobs.current(); j != nil {
+					j.cancel()
+				}
+				continue
+			}
+			msg.control = true
+		}
+		select {
+		case c.input <- msg:
+		default:
+			// never block, or cancel packets couldn't get through
+			c.appendMsg("#msg-list", "Too much input while busy, some was dropped.")
+		}
+	}
+}
+
+// recieve returns the next text message. Control packets that arrive first
+// are handled on the way. It fails with errCancelled if the foreground job is
+// cancelled while waiting.
 func (c *client) recieve() (b []byte, e error) {
-	t, m, e := c.ws.ReadMessage()
-	if t == 1 {
-		b = m
+	var done <-chan struct{}
+	if j := c.jobs.current(); j != nil {
+		done = j.ctx.Done()
 	}
-	return
+	for {
+		select {
+		case m, ok := <-c.input:
+			if !ok {
+				return nil, c.readErr
+			}
+			if !m.control {
+				return m.data, nil
+			}
+			if e = c.control(m.data); e != nil {
+				return nil, e
+			}
+		case <-done:
+			return nil, errCancelled
+		}
+	}
+}
+
+// control runs the handler for the control packet in b. Unknown and
+// malformed packets are ignored.
+func (c *client) control(b []byte) error {
+	var p packet
+	if err := json.Unmarshal(b, &p); err != nil {
+		log.Println("bad control packet:", err)
+		return nil
+	}
+	if p.Data == nil {
+		p.Data = make(map[string]string)
+	}
+	if handler, ok := controls[p.Type]; ok {
+		return handler(c, p)
+	}
+	return nil
 }
 
 // listener listens for incoming packets and passes them to the respective handlers.
 func (c *client) listener() (e error) {
+	c.input = make(chan incoming, 64)
+	go c.reader()
 	for {
 		b, e := c.recieve()
 		if e != nil {
@@ -68,28 +171,61 @@ func (c *client) listener() (e error) {
 	return
 }
 
+// parseInput runs a line of input as a command, or sends it to the connected
+// server as a chat message when it lacks the command prefix.
 func (c *client) parseInput(b []byte) (e error) {
-	args := getArgs(b)
-	if len(args) > 0 && len(args[0]) > 0 {
-		if c.cmdPrefix != "" && strings.Index(args[0], c.cmdPrefix) == 0 && len(args[0]) > 1 {
-			args[0] = strings.SplitN(args[0], c.cmdPrefix, 2)[1]
-			e = c.runCommand(args)
-		} else if c.cmdPrefix == "" {
-			e = c.runCommand(args)
+	line := strings.TrimSpace(string(b))
+	if len(line) == 0 {
+		return
+	}
+	if line, e = c.expandHistory(line); e != nil {
+		return
+	}
+	c.addHistory(line)
+	if c.cmdPrefix != "" {
+		if strings.HasPrefix(line, c.cmdPrefix) && len(line) > len(c.cmdPrefix) {
+			line = line[len(c.cmdPrefix):]
 		} else if c.server != "" {
-			if servers.exists(c.server) {
-				servers[c.server].broadcast <- fmt.Sprintf("<%s> %s", c.user.Name, string(b))
-			}
+			servers.broadcast(c.server, roomMessage{Kind: "message", From: c.user.Name, Text: line, Session: c.id})
+			return
 		} else {
-			e = errors.New("Command failed.")
+			return errors.New("Command failed.")
 		}
 	}
+	// each line ending in a lone & starts a background job
+	parts := splitWord(line, '&')
+	for _, part := range parts[:len(parts)-1] {
+		if part = strings.TrimSpace(part); part == "" {
+			return errors.New("Missing command before &.")
+		}
+		if e = c.runBackground(part); e != nil {
+			return
+		}
+	}
+	if last := strings.TrimSpace(parts[len(parts)-1]); last != "" {
+		e = c.runForeground(last)
+	}
 	return
 }
 
-func (c *client) runCommand(args []string) (e error) {
-	if cmd, exists := (*c.command)[strings.ToLower(args[0])]; exists {
-		e = cmd.Handler(c, args)
+// runCommand parses the arguments of the named command and runs it with the
+// given context, input and output.
+func (c *client) runCommand(ctx context.Context, words []string, in *lineBuffer, out output) (e error) {
+	name := strings.ToLower(words[0])
+	who := c.who(ctx)
+	if cmd, exists := (*who.command)[name]; exists {
+		a, err := parseArgs(cmd.Params, name, words[1:])
+		if err != nil {
+			return errors.New(err.Error() + " Usage: " + cmd.usage(who.cmdPrefix+name))
+		}
+		if cmd.Foreground && jobOf(ctx).background() {
+			return errors.New(name + " can't run in the background.")
+		}
+		a.ctx, a.in, a.out = ctx, in, out
+		a.user, a.server = who.user, who.server
+		if e = cmd.Handler(c, a); e == errUsage {
+			e = errors.New("Usage: " + cmd.usage(who.cmdPrefix+name))
+		}
 	} else {
 		e = errors.New("Command not found.")
 	}
@@ -131,7 +267,7 @@ func (c *client) appendMsg(selector, text string) (e error) {
 	p.Data["Class"] = "msg"
 	p.Data["Text"] = text
 	p.Data["Scroll"] = "true"
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -146,7 +282,7 @@ func (c *client) appendLink(selector, url, text string) (e error) {
 	p.Data["Target"] = "_blank"
 	p.Data["Scroll"] = "true"
 	p.Data["OnClick"] = "removeDecoration"
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -155,7 +291,7 @@ func (c *client) appendBreak(selector string) (e error) {
 	p.Data["Element"] = "br"
 	p.Data["Selector"] = selector
 	p.Data["Scroll"] = "true"
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -164,7 +300,7 @@ func (c *client) focus(selector, value string) (e error) {
 	p := newPacket("focus")
 	p.Data["Selector"] = selector
 	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -172,7 +308,7 @@ func (c *client) focus(selector, value string) (e error) {
 func (c *client) exists(selector string) (bl bool) {
 	p := newPacket("exists")
 	p.Data["Selector"] = selector
-	e := c.ws.WriteJSON(p)
+	e := c.send(p)
 	if e == nil {
 		b, e := c.recieve()
 		if e == nil && string(b) == "true" {
@@ -187,7 +323,7 @@ func (c *client) innerHTML(selector, value string) (e error) {
 	p := newPacket("innerHTML")
 	p.Data["Selector"] = selector
 	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -196,7 +332,7 @@ func (c *client) getHTML(selector string) (s string, e error) {
 	if c.exists(selector) {
 		p := newPacket("getHTML")
 		p.Data["Selector"] = selector
-		e = c.ws.WriteJSON(p)
+		e = c.send(p)
 		if e == nil {
 			b, e := c.recieve()
 			if e == nil {
@@ -215,7 +351,7 @@ func (c *client) setAttribute(selector, attribute, value string) (e error) {
 	p.Data["Selector"] = selector
 	p.Data["Attribute"] = attribute
 	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -224,7 +360,7 @@ func (c *client) getAttribute(selector, attribute string) (s string, e error) {
 	p := newPacket("getAttribute")
 	p.Data["Selector"] = selector
 	p.Data["Attribute"] = attribute
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	if e == nil {
 		b, e := c.recieve()
 		if e == nil {
@@ -239,7 +375,7 @@ func (c *client) setProperty(selector, property, value string) (e error) {
 	p := newPacket(property)
 	p.Data["Selector"] = selector
 	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
 
@@ -248,7 +384,7 @@ func (c *client) getProperty(selector, property string) (s string, e error) {
 	p := newPacket("getProperty")
 	p.Data["Selector"] = selector
 	p.Data["Property"] = property
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	if e == nil {
 		b, e := c.recieve()
 		if e == nil {
@@ -258,11 +394,20 @@ func (c *client) getProperty(selector, property string) (s string, e error) {
 	return
 }
 
+// sound plays the named notification sound.
+func (c *client) sound(name string) (e error) {
+	p := newPacket("sound")
+	p.Data["Selector"] = "body"
+	p.Data["Value"] = name
+	e = c.send(p)
+	return
+}
+
 // editable sets the editable property of the element
 func (c *client) editable(selector, value string) (e error) {
 	p := newPacket("editable")
 	p.Data["Selector"] = selector
 	p.Data["Value"] = value
-	e = c.ws.WriteJSON(p)
+	e = c.send(p)
 	return
 }
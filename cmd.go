@@ -10,204 +10,2048 @@ This file contains the command addons used used by the client via text commands.
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// command describes a text command. Name, Aliases, Category, Desc, Long,
+// Examples and Params are used to generate help and usage messages.
 type command struct {
-	Desc    string
-	Handler func(*client, []string) error
+	Name     string
+	Aliases  []string
+	Category string
+	Desc     string   // one line summary
+	Long     string   // longer description shown by help <command>
+	Usage    string   // overrides the usage generated from Params
+	Examples []string // example invocations without the command prefix
+	Params   []param
+	Handler  func(*client, *args) error
+
+	// Foreground commands can't run as background jobs. Commands that prompt
+	// or change the state of the session must set it.
+	Foreground bool
+}
+
+// commandSet maps command names and aliases to commands.
+type commandSet map[string]command
+
+// add registers cmd under its name and aliases.
+func (cs commandSet) add(cmd command) {
+	cs[cmd.Name] = cmd
+	for _, alias := range cmd.Aliases {
+		cs[alias] = cmd
+	}
 }
 
-var sysCommands = make(map[string]command)
-var chatCommands = make(map[string]command)
+// secret returns true if a param of cmd is marked Secret.
+func (cmd command) secret() bool {
+	for _, p := range cmd.Params {
+		if p.Secret {
+			return true
+		}
+	}
+	return false
+}
+
+// usage returns the synopsis of cmd when invoked as name.
+func (cmd command) usage(name string) string {
+	if cmd.Usage != "" {
+		return name + " " + cmd.Usage
+	}
+	parts := []string{name}
+	for _, p := range cmd.Params {
+		parts = append(parts, p.synopsis())
+	}
+	return strings.Join(parts, " ")
+}
+
+// errUsage is returned by handlers when they are used incorrectly, causing
+// the usage message to be shown.
+var errUsage = errors.New("Incorrect usage.")
+
+// renameCooldown is the minimum time between account renames.
+const renameCooldown = 7 * 24 * time.Hour
+
+var sysCommands = make(commandSet)
+var chatCommands = make(commandSet)
 
 func init() {
-	sysCommands["help"] = command{
-		Desc: "help returns help information about available commands.",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 0 {
-				if len(args) == 1 {
-					cmds := ""
-					for k := range sysCommands {
-						cmds += " " + k
-					}
-					e = c.appendMsg("#msg-list", "Available commands:"+cmds)
-				} else {
-					if cmd, ok := sysCommands[args[1]]; ok {
-						e = c.appendMsg("#msg-list", cmd.Desc)
-					} else {
-						e = c.appendMsg("#msg-list", "Command not available: "+args[1])
-					}
+	help := command{
+		Name:     "help",
+		Aliases:  []string{"?"},
+		Category: "general",
+		Desc:     "list commands or show the manual for one",
+		Long:     "Without arguments help lists the available commands grouped by category. Given a command name it shows that command's manual.",
+		Examples: []string{"help", "help login"},
+		Params:   []param{{Name: "command", Optional: true, Desc: "command to show the manual for", Complete: completeCommands}},
+		Handler: func(c *client, a *args) (e error) {
+			var lines []string
+			if !a.has("command") {
+				lines = helpIndex(*c.command, c.cmdPrefix)
+			} else {
+				name := strings.TrimPrefix(a.lower("command"), c.cmdPrefix)
+				cmd, ok := (*c.command)[name]
+				if !ok {
+					return a.println("Command not available: " + a.str("command"))
 				}
+				lines = cmd.manual(c.cmdPrefix)
 			}
-			return
-		},
-	}
-	//	sysCommands["motd"] = command{
-	//		Desc: "motd prints the current message-of-the-day.",
-	//		Handler: func(c *client, args []string) (e error) {
-	//			if len(args) > 0 {
-	//				// do something.
-	//			}
-	//			return
-	//		},
-	//	}
-	sysCommands["clear"] = command{
-		Desc: "clear the current terminal's content",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 0 {
-				c.innerHTML("#msg-list", " ")
+			for _, line := range lines {
+				if e = a.println(line); e != nil {
+					return
+				}
 			}
 			return
 		},
 	}
-	sysCommands["login"] = command{
-		Desc: "login lets you log into a registered user account.",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 0 {
-				if len(args) == 1 {
-					e = c.appendMsg("#msg-list", "Usage: login <name>")
-				} else {
-					name := args[1]
-					if isName(name) {
-						if userExists(name) {
-							pass, e := c.promptSecure("#msg-txt", "Please enter your password")
-							if e == nil && len(pass) > 0 {
-								e = c.user.login(name, pass)
-								if e != nil {
-									log.Println("login error:", e)
-									e = c.appendMsg("#msg-list", "Login failed")
-								} else {
-									e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
-									if e == nil {
-										e = c.appendMsg("#msg-list", "Welcome back, "+c.user.Name)
-									}
-								}
-							}
-						} else {
-							e = c.appendMsg("#msg-list", "User does not exist")
-						}
-					} else {
-						e = c.appendMsg("#msg-list", "Invalid characters in name")
+	sysCommands.add(help)
+	chatCommands.add(help)
+	motd := command{
+		Name:     "motd",
+		Category: "general",
+		Desc:     "show or change the message of the day",
+		Long: "With --room the welcome message shown on joining that chat server is used instead. " +
+			"Admins can set either, as a line or piped lines. Messages are templates that can use " +
+			"{{.Name}}, {{.Online}}, {{.Room}}, {{.Host}} and {{.Time}}, e.g. {{.Time.Format \"Mon 15:04\"}}. " +
+			"Clearing the message of the day falls back to the -motd file, if any.",
+		Examples: []string{
+			"motd",
+			"motd set Welcome {{.Name}}, {{.Online}} users are online.",
+			"note welcome | motd set --room lobby",
+			"motd clear -r lobby",
+		},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "show", Choices: []string{"show", "set", "clear"}},
+			{Name: "text", Optional: true, Rest: true},
+			{Name: "room", Flag: true, Short: "r", Complete: completeServers, Desc: "the welcome message of a chat server"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			room := a.str("room")
+			if a.lower("action") == "show" {
+				lines, err := c.motd(room)
+				if err != nil {
+					log.Println("motd:", err)
+				}
+				if len(lines) == 0 {
+					return a.println("No message set.")
+				}
+				for _, line := range lines {
+					if e = a.println(line); e != nil {
+						return
 					}
 				}
+				return
+			}
+			if !c.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			text := a.str("text")
+			if a.lower("action") == "clear" {
+				text = ""
+			} else if text == "" {
+				lines, err := a.input()
+				if err != nil {
+					return errUsage
+				}
+				text = strings.Join(lines, "\n")
 			}
+			if err := setMotd(room, text); err != nil {
+				return a.println(err.Error())
+			}
+			audit("motd "+a.lower("action"), c.user.Name, c.address, room)
+			if text == "" {
+				return a.println("Message cleared.")
+			}
+			return a.println("Message saved.")
+		},
+	}
+	sysCommands.add(motd)
+	chatCommands.add(motd)
+	clear := command{
+		Name:     "clear",
+		Aliases:  []string{"cls"},
+		Category: "general",
+		Desc:     "clear the current terminal's content",
+		Handler: func(c *client, a *args) (e error) {
+			c.innerHTML("#msg-list", " ")
 			return
 		},
 	}
-	sysCommands["connect"] = command{
-		Desc: "connect to a server.",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 1 {
-				c.connect(args[1])
-			} else {
-				e = c.appendMsg("#msg-list", "Usage: connect <server name>")
+	sysCommands.add(clear)
+	chatCommands.add(clear)
+	sysCommands.add(command{
+		Name:     "login",
+		Category: "account",
+		Desc:     "log into a registered account",
+		Long:     "login asks for your password, and for a one-time code if two-factor authentication is enabled. Repeated failures slow down further attempts.",
+		Examples: []string{"login alice"},
+		Params:   []param{{Name: "name"}},
+		Handler: func(c *client, a *args) (e error) {
+			name := a.str("name")
+			if !isName(name) {
+				return a.println("Invalid characters in name")
+			}
+			if wait := guard.wait(name, c.address); wait > 0 {
+				audit("login blocked", name, c.address, "")
+				return a.println(fmt.Sprintf("Too many failed logins. Try again in %s.", wait.Round(time.Second)))
+			}
+			pass, e := c.promptSecure("#msg-txt", "Please enter your password")
+			if e != nil || len(pass) == 0 {
+				return
+			}
+			// jobs started as someone else must not carry on as this user
+			c.jobs.stopBackground()
+			// every failure looks the same so names can't be probed
+			err := c.user.login(name, pass, func() (string, error) {
+				return c.promptSecure("#msg-txt", "Enter your authentication code (or a recovery code)")
+			})
+			if err != nil {
+				log.Println("login error:", err)
+				audit("login failed", name, c.address, err.Error())
+				for _, event := range guard.fail(name, c.address) {
+					audit(event, name, c.address, "")
+				}
+				return a.println("Login failed")
+			}
+			if n := guard.succeed(name); n > 0 {
+				audit("login", name, c.address, fmt.Sprintf("after %d failed attempts", n))
+			}
+			e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+			if e == nil {
+				e = a.println("Welcome back, " + c.user.Name)
+				c.showMotd("")
+				c.deliverReminders()
+			}
+			if e == nil && !c.user.verified {
+				e = a.println("Your email address is not verified. Use: verify <code> (or verify to resend)")
+			}
+			if r, err := userByID(c.user.ID); e == nil && err == nil {
+				c.aliases = r.Aliases
+				c.history = loadHistory(c.user.ID)
+				e = c.loadPrefs(r)
+				c.loadHooks()
 			}
 			return
 		},
-	}
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "connect",
+		Aliases:  []string{"join", "j"},
+		Category: "chat",
+		Desc:     "connect to a chat server",
+		Long:     "Joins the named server, creating it if nobody is on it yet. While connected, lines without the / prefix are sent as chat messages.",
+		Examples: []string{"connect lobby"},
+		Params:   []param{{Name: "server", Complete: completeServers}},
+		Handler: func(c *client, a *args) (e error) {
+			c.connect(a.str("server"))
+			return
+		},
+		Foreground: true,
+	})
 	//	sysCommands["disconnect"] = command{
 	//		Desc: "disconnect from connected server.",
-	//		Handler: func(c *client, args []string) (e error) {
+	//		Handler: func(c *client, a *args) (e error) {
 	//			if e = c.disconnect(); e != nil {
-	//				e = c.appendMsg("#msg-list", e.Error())
+	//				e = a.println(e.Error())
 	//			}
 	//			return
 	//		},
 	//	}
-	sysCommands["logout"] = command{
-		Desc: "logout lets you log out of the connected user account.",
-		Handler: func(c *client, args []string) (e error) {
+	sysCommands.add(command{
+		Name:     "logout",
+		Category: "account",
+		Desc:     "log out of your account",
+		Handler: func(c *client, a *args) (e error) {
+			c.jobs.stopBackground()
 			if err := c.user.logout(); err != nil {
 				log.Println(err)
-				e = c.appendMsg("#msg-list", err.Error())
+				e = a.println(err.Error())
 				return
 			}
+			c.resetPrefs()
+			c.stopHooks()
+			c.aliases = nil
+			c.history = nil
 			if err := c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>"); e != nil {
 				log.Println(err)
 				return
 			}
-			e = c.appendMsg("#msg-list", "You have logged out.")
+			e = a.println("You have logged out.")
 			return
 		},
-	}
-	sysCommands["register"] = command{
-		Desc: "register a user account",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 1 {
-				name := args[1]
-				if isName(name) {
-					if !userExists(name) {
-						email, e := c.prompt("Enter your email address")
-						if e == nil && isEmail(email) {
-							pass1, e := c.promptSecure("#msg-txt", "Enter a good password")
-							if e == nil {
-								pass2, e := c.promptSecure("#msg-txt", "Re-enter your password")
-								if e == nil && pass1 == pass2 {
-									c.user.Email = email
-									c.user.Name = name
-									e = c.user.save(name, pass1, email)
-									if e == nil {
-										e = c.appendMsg("#msg-list", "User account created (don't forget your password!)")
-									} else {
-										e = c.appendMsg("#msg-list", e.Error())
-									}
-								} else {
-									e = c.appendMsg("#msg-list", "Failed! Passwords did not match")
-								}
-							}
-						} else {
-							e = c.appendMsg("#msg-list", "Bad email address")
-						}
-					} else {
-						e = c.appendMsg("#msg-list", "User already exists")
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "register",
+		Category: "account",
+		Desc:     "register a user account",
+		Long:     "register asks for an email address and a password. A verification code is then emailed to you.",
+		Examples: []string{"register alice"},
+		Params:   []param{{Name: "name"}},
+		Handler: func(c *client, a *args) (e error) {
+			name := a.str("name")
+			if err := checkName(name); err != nil {
+				return a.println(err.Error())
+			}
+			if isAdminName(name) {
+				return a.println(errReserved.Error())
+			}
+			if userExists(name) || sessions.nameTaken(name, c) {
+				return a.println("User already exists")
+			}
+			email, e := c.prompt("Enter your email address")
+			if e != nil {
+				return
+			}
+			if !isEmail(email) {
+				return a.println("Bad email address")
+			}
+			pass1, e := c.promptSecure("#msg-txt", "Enter a good password")
+			if e != nil {
+				return
+			}
+			pass2, e := c.promptSecure("#msg-txt", "Re-enter your password")
+			if e != nil {
+				return
+			}
+			if pass1 != pass2 {
+				return a.println("Failed! Passwords did not match")
+			}
+			if err := c.user.save(name, pass1, email); err != nil {
+				return a.println(err.Error())
+			}
+			e = a.println("User account created (don't forget your password!)")
+			if err := sendVerification(c.user.ID, userRecord{Name: name, Email: email}); err != nil {
+				log.Println("verification mail error:", err)
+			} else if e == nil {
+				e = a.println("A verification code has been sent to " + email + ". Use: verify <code>")
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "verify",
+		Category: "account",
+		Desc:     "verify your email address",
+		Long:     "Given the code from your verification email it confirms your address. Without a code it emails you a new one.",
+		Examples: []string{"verify ABCDEFGH23456789"},
+		Params:   []param{{Name: "code", Optional: true, Secret: true}},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.has("code") {
+				if !c.user.auth {
+					return errUsage
+				}
+				if c.user.verified {
+					return a.println("Your email address is already verified")
+				}
+				r, err := userByID(c.user.ID)
+				if err == nil {
+					err = sendVerification(c.user.ID, r)
+				}
+				if err != nil {
+					log.Println("verification mail error:", err)
+					return a.println("Could not send verification code")
+				}
+				return a.println("A new verification code has been sent to " + r.Email)
+			}
+			t, err := useToken(verifyToken, a.str("code"))
+			if err != nil {
+				return a.println(err.Error())
+			}
+			r, err := changeUser(t.UserID, func(r *userRecord) error {
+				if r.Email != t.Email {
+					return errBadToken
+				}
+				r.Verified = true
+				return nil
+			})
+			if err == errBadToken || err == errNoUser {
+				return a.println(errBadToken.Error())
+			} else if err != nil {
+				log.Println("verify error:", err)
+				return a.println("Verification failed")
+			}
+			if c.user.auth && c.user.ID == t.UserID {
+				c.user.verified = true
+			}
+			e = a.println("Email address " + r.Email + " verified")
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "forgot",
+		Category: "account",
+		Desc:     "email a password reset token",
+		Long:     "Sends a reset token to the address registered for the account. Use it with reset. Only the latest token works, and repeated requests slow down further ones.",
+		Examples: []string{"forgot alice"},
+		Params:   []param{{Name: "name"}},
+		Handler: func(c *client, a *args) (e error) {
+			name := a.str("name")
+			if !isName(name) {
+				return a.println("Invalid characters in name")
+			}
+			if wait := resetGuard.wait(name, c.address); wait > 0 {
+				audit("forgot blocked", name, c.address, "")
+				return a.println(fmt.Sprintf("Too many reset requests. Try again in %s.", wait.Round(time.Second)))
+			}
+			// every request counts, sending a token is what is being limited
+			for _, event := range resetGuard.fail(name, c.address) {
+				audit("forgot "+event, name, c.address, "")
+			}
+			if id, r, err := userByName(name); err == nil && r.Email != "" {
+				if err = sendReset(id, r); err != nil {
+					log.Println("reset mail error:", err)
+				}
+			}
+			e = a.println("If that account exists, a reset token has been sent to its email address. Use: reset <token>")
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "reset",
+		Category: "account",
+		Desc:     "set a new password with an emailed reset token",
+		Examples: []string{"reset ABCDEFGH23456789"},
+		Params:   []param{{Name: "token", Secret: true}},
+		Handler: func(c *client, a *args) (e error) {
+			t, err := useToken(resetToken, a.str("token"))
+			if err != nil {
+				return a.println(err.Error())
+			}
+			if _, err = userByID(t.UserID); err != nil {
+				return a.println(errBadToken.Error())
+			}
+			pass1, e := c.promptSecure("#msg-txt", "Enter a new password")
+			if e != nil {
+				return
+			}
+			pass2, e := c.promptSecure("#msg-txt", "Re-enter your new password")
+			if e != nil {
+				return
+			}
+			if len(pass1) == 0 || pass1 != pass2 {
+				return a.println("Failed! Passwords did not match")
+			}
+			r, err := changeUser(t.UserID, func(r *userRecord) error {
+				r.Pass = pass1
+				// the token was delivered to the address on record, which proves it
+				r.Verified = r.Verified || r.Email == t.Email
+				return nil
+			})
+			if err != nil {
+				log.Println("reset error:", err)
+				return a.println("Password reset failed")
+			}
+			clearTokens(t.UserID)
+			e = a.println("Password changed for " + strings.Title(r.Name) + ". You can now log in.")
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "nick",
+		Category: "general",
+		Desc:     "change your guest name",
+		Long:     "Registered names can only be used by logging in, and admin names are reserved.",
+		Examples: []string{"nick wanderer"},
+		Params:   []param{{Name: "name"}},
+		Handler: func(c *client, a *args) (e error) {
+			if c.user.auth {
+				return a.println("You are logged in. Use rename to change your account name.")
+			}
+			name := a.str("name")
+			if !isName(name) || len(name) > 32 {
+				return a.println("Invalid characters in name")
+			}
+			if userExists(name) {
+				return a.println("That name is registered. Log in to use it.")
+			}
+			if isAdminName(name) {
+				return a.println(errReserved.Error())
+			}
+			if sessions.nameTaken(name, c) {
+				return a.println("That name is in use")
+			}
+			old := c.user.Name
+			c.user.Name = name
+			if c.server != "" {
+				servers.broadcast(c.server, roomMessage{Kind: "nick", From: old, Text: name})
+			}
+			e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+			if e == nil {
+				e = a.println("You are now known as " + name)
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "profile",
+		Category: "profile",
+		Desc:     "show or edit your profile",
+		Long:     "Without arguments profile shows your full profile. Fields: displayname, pronouns, timezone, avatar and bio. Use private or public to hide or show a field in whois; email, created and lastseen can be hidden too. Email is private until you make it public.",
+		Examples: []string{"profile set bio \"I like turtles\"", "profile clear avatar", "profile private email"},
+		Params: []param{
+			{Name: "action", Optional: true, Choices: []string{"set", "clear", "private", "public"}},
+			{Name: "field", Optional: true, Complete: completeProfileFields},
+			{Name: "value", Optional: true, Rest: true},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.auth {
+				return a.println("You must be logged in")
+			}
+			r, err := userByID(a.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			if !a.has("action") {
+				for _, line := range whois(r, true, true) {
+					if e = a.println(line); e != nil {
+						return
 					}
-				} else {
-					e = c.appendMsg("#msg-list", "Invalid characters in name")
 				}
-			} else {
-				e = c.appendMsg("#msg-list", "Usage: register <name>")
+				return
+			}
+			if !a.has("field") {
+				return errUsage
+			}
+			field, action := a.lower("field"), a.lower("action")
+			if action == "set" && !a.has("value") {
+				return errUsage
+			}
+			if (action == "private" || action == "public") && !isPrivacyField(field) {
+				return a.println("Unknown profile field: " + field)
+			}
+			r, err = changeUser(a.user.ID, func(r *userRecord) error {
+				switch action {
+				case "set", "clear":
+					return setProfileField(r, field, a.str("value"))
+				}
+				if r.Private == nil {
+					r.Private = make(map[string]bool)
+				}
+				r.Private[field] = action == "private"
+				return nil
+			})
+			if err != nil {
+				return a.println(err.Error())
+			}
+			if field == "timezone" {
+				for _, other := range sessions.byUser(a.user.ID) {
+					other.setLocation(r.Timezone)
+				}
 			}
+			e = a.println("Profile updated")
 			return
 		},
-	}
-	chatCommands["help"] = command{
-		Desc: "help returns help information about available commands.",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 0 {
-				if len(args) == 1 {
-					cmds := ""
-					for k := range chatCommands {
-						cmds += " " + k
-					}
-					e = c.appendMsg("#msg-list", "Available commands:"+cmds)
+	})
+	sysCommands.add(command{
+		Name:     "whois",
+		Category: "profile",
+		Desc:     "show information about a user",
+		Examples: []string{"whois alice"},
+		Params:   []param{{Name: "name", Complete: completeUsers}},
+		Handler: func(c *client, a *args) (e error) {
+			name := a.str("name")
+			id, r, err := userByName(name)
+			if err != nil {
+				if sessions.nameTaken(name, nil) {
+					return a.println(name + " is a guest and is online")
+				}
+				return a.println("No such user: " + name)
+			}
+			online := len(sessions.byUser(id)) > 0
+			full := (a.user.auth && a.user.ID == id) || a.user.isAdmin()
+			for _, line := range whois(r, online, full) {
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "set",
+		Category: "general",
+		Desc:     "change a preference",
+		Long:     "Leave out the value to restore the default. See prefs for the available keys. Timestamps use the timezone of your profile.",
+		Examples: []string{"set background #202020", "set timestamp short", "set autojoin lobby,games", "set sound"},
+		Params:   []param{{Name: "key", Complete: completePrefs}, {Name: "value", Optional: true, Rest: true}},
+		Handler: func(c *client, a *args) (e error) {
+			if err := c.setPref(a.lower("key"), a.str("value")); err != nil {
+				return a.println(err.Error())
+			}
+			msg := "Preference saved"
+			if !c.user.auth {
+				msg = "Preference set for this session (log in to keep preferences)"
+			}
+			e = a.println(msg)
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "prefs",
+		Category: "general",
+		Desc:     "list your preferences",
+		Handler: func(c *client, a *args) (e error) {
+			for _, key := range prefKeys() {
+				value, ok := c.pref(key)
+				if !ok {
+					value = "(default)"
+				}
+				if e = a.println(key + " = " + value + " - " + prefs[key].Desc); e != nil {
+					return
+				}
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "passwd",
+		Category: "account",
+		Desc:     "change your password",
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.auth {
+				return a.println("You must be logged in")
+			}
+			r, err := userByID(c.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			old, ok, e := c.recheckPassword(a, "passwd", r, "Enter your current password")
+			if !ok {
+				return
+			}
+			pass1, e := c.promptSecure("#msg-txt", "Enter a new password")
+			if e != nil {
+				return
+			}
+			pass2, e := c.promptSecure("#msg-txt", "Re-enter your new password")
+			if e != nil {
+				return
+			}
+			if len(pass1) == 0 || pass1 != pass2 {
+				return a.println("Failed! Passwords did not match")
+			}
+			_, err = changeUser(c.user.ID, func(r *userRecord) error {
+				if old != r.Pass {
+					return errBadPass
+				}
+				r.Pass = pass1
+				return nil
+			})
+			if err == errBadPass {
+				return c.badPassword(a, "passwd", r.Name)
+			} else if err != nil {
+				log.Println("passwd error:", err)
+				return a.println("Password change failed")
+			}
+			clearTokens(c.user.ID)
+			audit("passwd", r.Name, c.address, "")
+			e = a.println("Password changed")
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "email",
+		Category: "account",
+		Desc:     "change your email address",
+		Long:     "The new address must be verified before it counts as verified.",
+		Examples: []string{"email alice@example.com"},
+		Params:   []param{{Name: "address"}},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.auth {
+				return a.println("You must be logged in")
+			}
+			email := a.lower("address")
+			if !isEmail(email) {
+				return a.println("Bad email address")
+			}
+			r, err := userByID(c.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			pass, ok, e := c.recheckPassword(a, "email", r, "Enter your password")
+			if !ok {
+				return
+			}
+			old := r.Email
+			r, err = changeUser(c.user.ID, func(r *userRecord) error {
+				if pass != r.Pass {
+					return errBadPass
+				}
+				r.Email, r.Verified = email, false
+				return nil
+			})
+			if err == errBadPass {
+				return c.badPassword(a, "email", r.Name)
+			} else if err != nil {
+				log.Println("email error:", err)
+				return a.println("Email change failed")
+			}
+			clearTokens(c.user.ID)
+			c.user.Email, c.user.verified = email, false
+			audit("email", r.Name, c.address, old+" -> "+email)
+			if err = sendVerification(c.user.ID, r); err != nil {
+				log.Println("verification mail error:", err)
+				return a.println("Email changed, but the verification code could not be sent. Use verify to try again.")
+			}
+			e = a.println("Email changed. A verification code has been sent to " + email + ". Use: verify <code>")
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "rename",
+		Category: "account",
+		Desc:     "rename your account",
+		Long:     "Account names can be changed once a week.",
+		Examples: []string{"rename alicia"},
+		Params:   []param{{Name: "new name"}},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.auth {
+				return a.println("You must be logged in")
+			}
+			name := a.str("new name")
+			if err := checkName(name); err != nil {
+				return a.println(err.Error())
+			}
+			if sessions.nameTaken(name, c) {
+				return a.println("That name is in use")
+			}
+			r, err := userByID(c.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			if wait := r.Renamed.Add(renameCooldown).Sub(time.Now()); wait > 0 {
+				return a.println(fmt.Sprintf("You can rename again in %s", wait.Round(time.Minute)))
+			}
+			old := r.Name
+			if r, err = renameUser(c.user.ID, name); err != nil {
+				return a.println(err.Error())
+			}
+			for _, other := range sessions.byUser(c.user.ID) {
+				other.user.Name = strings.Title(r.Name)
+				if other.irc != nil {
+					other.irc.write(":" + ircMask(strings.Title(old)) + " NICK " + ircNick(other.user.Name))
+				} else if other != c {
+					other.innerHTML("#status-box", "<b>"+other.user.Name+"</b>")
+				}
+			}
+			if c.server != "" {
+				servers.broadcast(c.server, roomMessage{Kind: "nick", From: strings.Title(old), Text: c.user.Name})
+			}
+			audit("rename", r.Name, c.address, "from "+old)
+			e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+			if e == nil {
+				e = a.println("You are now known as " + c.user.Name)
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "deleteaccount",
+		Category: "account",
+		Desc:     "permanently delete your account",
+		Long:     "Asks for your name and password to confirm. With --purge content you authored is removed too.",
+		Examples: []string{"deleteaccount", "deleteaccount --purge"},
+		Params:   []param{{Name: "purge", Flag: true, Type: boolParam, Desc: "also remove content you authored"}},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.auth {
+				return a.println("You must be logged in")
+			}
+			r, err := userByID(c.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			confirm, e := c.prompt("This cannot be undone. Type your name to confirm")
+			if e != nil {
+				return
+			}
+			if !strings.EqualFold(confirm, r.Name) {
+				return a.println("Account not deleted")
+			}
+			if _, ok, e := c.recheckPassword(a, "deleteaccount", r, "Enter your password"); !ok {
+				return e
+			}
+			id := c.user.ID
+			if err = deleteUser(id); err != nil {
+				log.Println("deleteaccount error:", err)
+				return a.println("Account deletion failed")
+			}
+			if a.bool("purge") {
+				for _, hook := range purgeHooks {
+					hook(id, r.Name)
+				}
+			}
+			audit("deleteaccount", r.Name, c.address, "")
+			for _, other := range sessions.byUser(id) {
+				if other.irc != nil {
+					other.irc.close("This account has been deleted")
+					continue
+				}
+				if other.server != "" {
+					other.disconnect()
+				}
+				other.jobs.stopBackground()
+				other.user.logout()
+				other.resetPrefs()
+				other.stopHooks()
+				other.aliases = nil
+				other.history = nil
+				if other != c {
+					other.innerHTML("#status-box", "<b>"+other.user.Name+"</b>")
+					other.appendMsg("#msg-list", "This account has been deleted")
+				}
+			}
+			e = c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+			if e == nil {
+				e = a.println("Your account has been deleted")
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "2fa",
+		Category: "account",
+		Desc:     "manage two-factor authentication",
+		Long:     "enable shows a secret to add to an authenticator app, confirm <code> turns it on and prints recovery codes, disable turns it off. Admins can reset <name> for a user who lost their device.",
+		Examples: []string{"2fa enable", "2fa confirm 123456", "2fa reset alice"},
+		Params: []param{
+			{Name: "action", Choices: []string{"status", "enable", "confirm", "disable", "reset"}},
+			{Name: "code or name", Optional: true, Complete: completeUsers, Secret: true},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.auth {
+				return a.println("You must be logged in")
+			}
+			action := a.lower("action")
+			if action == "reset" {
+				if !c.user.isAdmin() {
+					return a.println("Permission denied")
+				}
+				if !a.has("code or name") {
+					return errUsage
+				}
+				id, r, err := userByName(a.str("code or name"))
+				if err != nil {
+					return a.println(err.Error())
+				}
+				if _, err = changeUser(id, func(r *userRecord) error {
+					r.TOTPSecret, r.TOTPEnabled, r.TOTPLast, r.Recovery = "", false, 0, nil
+					return nil
+				}); err != nil {
+					log.Println("2fa reset error:", err)
+					return a.println("Reset failed")
+				}
+				audit("2fa reset", c.user.Name, c.address, r.Name)
+				return a.println("Two-factor authentication disabled for " + strings.Title(r.Name))
+			}
+			r, err := userByID(c.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			switch action {
+			case "status":
+				if r.TOTPEnabled {
+					e = a.println(fmt.Sprintf("Two-factor authentication is enabled (%d recovery codes left)", len(r.Recovery)))
 				} else {
-					if cmd, ok := chatCommands[args[1]]; ok {
-						e = c.appendMsg("#msg-list", cmd.Desc)
-					} else {
-						e = c.appendMsg("#msg-list", "Command not available: "+args[1])
+					e = a.println("Two-factor authentication is disabled")
+				}
+			case "enable":
+				if r.TOTPEnabled {
+					return a.println("Two-factor authentication is already enabled")
+				}
+				r, err = changeUser(c.user.ID, func(r *userRecord) error {
+					if r.TOTPEnabled {
+						return errors.New("Two-factor authentication is already enabled")
+					}
+					r.TOTPSecret = newTOTPSecret()
+					return nil
+				})
+				if err != nil {
+					return a.println(err.Error())
+				}
+				e = a.println("Add this account to your authenticator app using the secret " + r.TOTPSecret + " or the URI:")
+				if e == nil {
+					e = a.println(totpURI(r.Name, r.TOTPSecret))
+				}
+				if e == nil {
+					e = a.println("Then finish with: 2fa confirm <code>")
+				}
+			case "confirm":
+				if !a.has("code or name") {
+					return errUsage
+				}
+				if r.TOTPEnabled || r.TOTPSecret == "" {
+					return a.println("Use 2fa enable first")
+				}
+				codes, hashes := newRecoveryCodes()
+				_, err = changeUser(c.user.ID, func(r *userRecord) error {
+					if r.TOTPEnabled || r.TOTPSecret == "" {
+						return errors.New("Use 2fa enable first")
+					}
+					step := checkTOTP(r.TOTPSecret, a.str("code or name"), time.Now(), r.TOTPLast)
+					if step == 0 {
+						return errBadCode
+					}
+					r.TOTPEnabled, r.TOTPLast, r.Recovery = true, step, hashes
+					return nil
+				})
+				if err != nil {
+					return a.println(err.Error())
+				}
+				e = a.println("Two-factor authentication enabled. Keep these single-use recovery codes somewhere safe:")
+				if e == nil {
+					e = a.println(strings.Join(codes, " "))
+				}
+			case "disable":
+				if !r.TOTPEnabled {
+					return a.println("Two-factor authentication is not enabled")
+				}
+				code, e := c.promptSecure("#msg-txt", "Enter your authentication code (or a recovery code)")
+				if e != nil {
+					return e
+				}
+				_, err = changeUser(c.user.ID, func(r *userRecord) error {
+					if !r.TOTPEnabled {
+						return errors.New("Two-factor authentication is not enabled")
+					}
+					if !secondFactor(r, code) {
+						return errBadCode
 					}
+					r.TOTPSecret, r.TOTPEnabled, r.TOTPLast, r.Recovery = "", false, 0, nil
+					return nil
+				})
+				if err != nil {
+					return a.println(err.Error())
 				}
+				e = a.println("Two-factor authentication disabled")
 			}
 			return
 		},
-	}
-	chatCommands["disconnect"] = command{
-		Desc: "disconnect from connected server.",
-		Handler: func(c *client, args []string) (e error) {
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "audit",
+		Category: "admin",
+		Desc:     "show the audit trail (admin)",
+		Examples: []string{"audit 50"},
+		Params:   []param{{Name: "count", Optional: true, Type: intParam, Default: "20"}},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			n := a.int("count")
+			if n < 1 {
+				return a.println("count must be at least 1")
+			}
+			for _, r := range recentAudit(n) {
+				line := fmt.Sprintf("%s %s %s %s %s", r.Time.Format(time.RFC3339), r.Event, r.Name, r.Address, r.Detail)
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "backup",
+		Category: "admin",
+		Desc:     "take a database backup (admin)",
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			path, err := backup()
+			if err != nil {
+				log.Println("backup error:", err)
+				return a.println("Backup failed: " + err.Error())
+			}
+			e = a.println("Backup written to " + path)
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "restore",
+		Category: "admin",
+		Desc:     "replace the database with a backup (admin)",
+		Long:     "A file name without a directory is looked up in the backup directory.",
+		Examples: []string{"restore soshell-20160101-120000.tar.gz"},
+		Params:   []param{{Name: "backup file"}},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			path := a.str("backup file")
+			if !strings.ContainsRune(path, os.PathSeparator) {
+				path = filepath.Join(backupDir(), path)
+			}
+			answer, e := c.prompt("Restoring replaces all current data. Type yes to continue")
+			if e != nil || answer != "yes" {
+				return
+			}
+			if err := restore(path, true); err != nil {
+				log.Println("restore error:", err)
+				return a.println("Restore failed: " + err.Error())
+			}
+			e = a.println("Database restored from " + path)
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "export",
+		Category: "admin",
+		Desc:     "export the database as jsonl or json (admin)",
+		Long:     "The export is written to the backup directory.",
+		Examples: []string{"export json"},
+		Params:   []param{{Name: "format", Optional: true, Default: "jsonl", Choices: []string{"jsonl", "json"}}},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			format := a.lower("format")
+			if err := os.MkdirAll(backupDir(), 0700); err != nil {
+				return a.println("Export failed: " + err.Error())
+			}
+			path := filepath.Join(backupDir(), "export-"+time.Now().UTC().Format("20060102-150405")+"."+format)
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return a.println("Export failed: " + err.Error())
+			}
+			defer f.Close()
+			if err := export(f, format); err != nil {
+				log.Println("export error:", err)
+				return a.println("Export failed: " + err.Error())
+			}
+			e = a.println("Exported to " + path)
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "plugins",
+		Category: "admin",
+		Desc:     "list or restart plugins (admin)",
+		Examples: []string{"plugins", "plugins restart weather"},
+		Params: []param{
+			{Name: "action", Optional: true, Choices: []string{"list", "restart"}},
+			{Name: "plugin", Optional: true, Complete: completePlugins},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			if a.lower("action") == "restart" {
+				p, ok := plugins[a.lower("plugin")]
+				if !ok {
+					return a.println("No such plugin.")
+				}
+				audit("plugin restart", a.user.Name, c.address, p.Name)
+				p.restart()
+				return a.println("Restarting plugin " + p.Name)
+			}
+			if len(plugins) == 0 {
+				return a.println("No plugins loaded.")
+			}
+			for _, name := range pluginNames() {
+				if e = a.println(plugins[name].status()); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "webhook",
+		Category: "admin",
+		Desc:     "manage the webhooks of chat servers (admin)",
+		Long: "An incoming webhook is a URL that says whatever is POSTed to it (plain text, a form or " +
+			"JSON with a text field) on its chat server as a bot. An outgoing webhook POSTs the " +
+			"messages said on its chat server to a URL as JSON, signed with an HMAC-SHA256 of the " +
+			"body in the X-Soshell-Signature header. Give the webhook ID to remove, log and test.",
+		Examples: []string{
+			"webhook in lobby ci",
+			"webhook out lobby https://example.com/hooks/chat --match deploy --from alice,bob",
+			"webhook log 123456",
+			"webhook list lobby",
+		},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "list", Choices: []string{"list", "in", "out", "remove", "log", "test"}},
+			{Name: "room", Optional: true, Complete: completeServers, Desc: "chat server, or webhook ID"},
+			{Name: "value", Optional: true, Desc: "bot name of an incoming webhook, or URL of an outgoing one"},
+			{Name: "match", Flag: true, Short: "m", Desc: "only send messages matching this regular expression"},
+			{Name: "from", Flag: true, Short: "f", Desc: "only send messages from these comma separated users"},
+			{Name: "bots", Flag: true, Type: boolParam, Desc: "also send messages posted by incoming webhooks"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			action, room, value := a.lower("action"), a.str("room"), a.str("value")
+			if (action == "in" || action == "out") && (room == "" || value == "") {
+				return errUsage
+			}
+			switch action {
+			case "in":
+				if !isName(value) || len(value) > 32 {
+					return a.println("Invalid bot name")
+				}
+				token := randToken() + randToken()
+				id, err := addWebhook(webhookRecord{Room: room, Name: value, Hash: hashToken(token), UserID: a.user.ID})
+				if err != nil {
+					return a.println(err.Error())
+				}
+				audit("webhook add", a.user.Name, c.address, fmt.Sprintf("%d in %s", id, room))
+				a.println(fmt.Sprintf("Added webhook %d. POST to this URL, which won't be shown again:", id))
+				return a.println(hookURL(token))
+			case "out":
+				if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					return a.println("The URL must be an http or https URL.")
+				}
+				var from []string
+				if a.has("from") {
+					from = strings.Split(a.lower("from"), ",")
+				}
+				secret := randHex(16)
+				id, err := addWebhook(webhookRecord{Room: room, URL: value, Secret: secret, Match: a.str("match"),
+					From: from, Bots: a.bool("bots"), UserID: a.user.ID})
+				if err != nil {
+					return a.println(err.Error())
+				}
+				audit("webhook add", a.user.Name, c.address, fmt.Sprintf("%d out %s", id, room))
+				a.println(fmt.Sprintf("Added webhook %d. Deliveries are signed with this secret, which won't be shown again:", id))
+				return a.println(secret)
+			case "remove", "log", "test":
+				id, _ := strconv.Atoi(room)
+				h, ok := getWebhook(id)
+				if !ok {
+					return a.println("No such webhook.")
+				}
+				switch action {
+				case "remove":
+					if err := removeWebhook(id); err != nil {
+						return a.println(err.Error())
+					}
+					audit("webhook remove", a.user.Name, c.address, fmt.Sprintf("%d %s", id, h.Room))
+					return a.println(fmt.Sprintf("Removed webhook %d", id))
+				case "test":
+					if !h.outgoing() {
+						return a.println("Only outgoing webhooks can be tested.")
+					}
+					h.send(hookPayload{Kind: "test", Room: h.Room, From: a.user.Name, Text: "Test delivery", Time: time.Now().UTC()})
+					return a.println("Test delivery queued, see webhook log " + room)
+				}
+				list := h.deliveries()
+				if len(list) == 0 {
+					return a.println("No deliveries yet.")
+				}
+				for _, d := range list {
+					line := fmt.Sprintf("%s  %s  %s (%d attempts)", d.Time.Format("2006-01-02 15:04:05"), d.ID, d.Status, d.Attempts)
+					if e = a.println(line); e != nil {
+						return
+					}
+				}
+				return
+			}
+			list := listWebhooks(room)
+			if len(list) == 0 {
+				return a.println("No webhooks.")
+			}
+			for _, h := range list {
+				if e = a.println(h.describe()); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "bridge",
+		Category: "admin",
+		Desc:     "link chat servers to channels on other IRC networks (admin)",
+		Long: "A bridge is a bot that sits on an IRC channel and relays messages between it and a chat " +
+			"server, with the sender's name in front, and tells each side who joins and leaves. It " +
+			"connects over TLS unless --plain is given and reconnects by itself when the connection " +
+			"is lost. Give the bridge ID to remove and restart.",
+		Examples: []string{
+			"bridge add lobby irc.example.net:6697 #soshell",
+			"bridge add dev irc.example.net:6667 #dev --plain --nick devbridge --prefix dev/",
+			"bridge restart 123456",
+		},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "list", Choices: []string{"list", "add", "remove", "restart"}},
+			{Name: "room", Optional: true, Complete: completeServers, Desc: "chat server, or bridge ID"},
+			{Name: "address", Optional: true, Desc: "host:port of the IRC server"},
+			{Name: "channel", Optional: true},
+			{Name: "nick", Flag: true, Short: "n", Default: "soshell", Desc: "nick of the bot"},
+			{Name: "prefix", Flag: true, Short: "p", Default: "irc/", Desc: "put in front of the names of IRC users"},
+			{Name: "plain", Flag: true, Type: boolParam, Desc: "connect without TLS"},
+			{Name: "password", Flag: true, Type: boolParam, Desc: "ask for the password of the IRC server"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			switch a.lower("action") {
+			case "add":
+				r := bridgeRecord{Room: a.str("room"), Address: a.str("address"), Channel: a.str("channel"),
+					Nick: a.str("nick"), Prefix: a.str("prefix"), Plain: a.bool("plain"), UserID: c.user.ID}
+				if r.Room == "" || r.Address == "" || r.Channel == "" {
+					return errUsage
+				}
+				if _, _, err := net.SplitHostPort(r.Address); err != nil {
+					return a.println("The address must be host:port.")
+				}
+				if !strings.HasPrefix(r.Channel, "#") || strings.ContainsAny(r.Channel, " ,\x07") {
+					return a.println("Invalid channel name")
+				}
+				if !isName(r.Nick) || len(r.Nick) > 30 {
+					return a.println("Invalid characters in nick")
+				}
+				if strings.ContainsAny(r.Prefix, " \t") || len(r.Prefix) > 16 {
+					return a.println("The prefix may be up to 16 characters without spaces.")
+				}
+				if a.bool("password") {
+					if r.Password, e = c.promptSecure("#msg-txt", "Please enter the password of the IRC server"); e != nil {
+						return
+					}
+				}
+				id, err := addBridge(r)
+				if err != nil {
+					return a.println(err.Error())
+				}
+				audit("bridge add", c.user.Name, c.address, fmt.Sprintf("%d %s %s %s", id, r.Room, r.Address, r.Channel))
+				return a.println(fmt.Sprintf("Added bridge %d", id))
+			case "remove", "restart":
+				id, _ := strconv.Atoi(a.str("room"))
+				if a.lower("action") == "restart" {
+					if err := restartBridge(id); err != nil {
+						return a.println(err.Error())
+					}
+					return a.println(fmt.Sprintf("Restarted bridge %d", id))
+				}
+				if err := removeBridge(id); err != nil {
+					return a.println(err.Error())
+				}
+				audit("bridge remove", c.user.Name, c.address, strconv.Itoa(id))
+				return a.println(fmt.Sprintf("Removed bridge %d", id))
+			}
+			list := listBridges()
+			if len(list) == 0 {
+				return a.println("No bridges.")
+			}
+			for _, b := range list {
+				if e = a.println(b.describe()); e != nil {
+					return
+				}
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "peer",
+		Category: "admin",
+		Desc:     "link chat servers with other soshell servers (admin)",
+		Long: "A peer is another soshell server, named by its -host, that shares chat servers with this " +
+			"one. Messages, joins, parts and topics pass between them and users on the other side " +
+			"appear as name@host. A peer given an address is dialled at that address (its " +
+			"-federation port), otherwise it is expected to dial this server. Both sides need the " +
+			"same key: add the peer on one side to get a new key, and on the other with --key to " +
+			"enter it. Only chat servers listed on both sides are shared.",
+		Examples: []string{
+			"peer add chat.example.org chat.example.org:7443 --rooms lobby,dev",
+			"peer add soshell.example.com --rooms lobby,dev --key",
+			"peer remove chat.example.org",
+		},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "list", Choices: []string{"list", "add", "remove"}},
+			{Name: "host", Optional: true, Desc: "host name of the peer"},
+			{Name: "address", Optional: true, Desc: "host:port to dial"},
+			{Name: "rooms", Flag: true, Short: "r", Desc: "comma separated chat servers to share"},
+			{Name: "key", Flag: true, Type: boolParam, Desc: "ask for the key given by the other side"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !c.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			host := a.lower("host")
+			switch a.lower("action") {
+			case "add":
+				if host == "" || !a.has("rooms") {
+					return errUsage
+				}
+				if strings.ContainsAny(host, " @/:") || strings.EqualFold(host, *hostname) {
+					return a.println("Invalid host name")
+				}
+				if a.has("address") {
+					if _, _, err := net.SplitHostPort(a.str("address")); err != nil {
+						return a.println("The address must be host:port.")
+					}
+				}
+				r := peerRecord{Host: host, Address: a.str("address"), UserID: c.user.ID}
+				for _, room := range strings.Split(a.str("rooms"), ",") {
+					if room = strings.TrimSpace(room); !isName(room) || room == "" {
+						return a.println("Invalid chat server name: " + room)
+					}
+					r.Rooms = append(r.Rooms, room)
+				}
+				if a.bool("key") {
+					if r.Key, e = c.promptSecure("#msg-txt", "Please enter the key of the link"); e != nil {
+						return
+					}
+					if len(r.Key) < 32 {
+						return a.println("The key is too short.")
+					}
+				} else {
+					r.Key = randHex(32)
+				}
+				if err := addPeer(r); err != nil {
+					return a.println(err.Error())
+				}
+				audit("peer add", c.user.Name, c.address, host+" "+strings.Join(r.Rooms, ","))
+				if a.bool("key") {
+					return a.println("Added peer " + host)
+				}
+				a.println("Added peer " + host + ". Add this server on the other side with --key and this key, which won't be shown again:")
+				return a.println(r.Key)
+			case "remove":
+				if err := removePeer(host); err != nil {
+					return a.println(err.Error())
+				}
+				audit("peer remove", c.user.Name, c.address, host)
+				return a.println("Removed peer " + host)
+			}
+			list := listPeers()
+			if len(list) == 0 {
+				return a.println("No peers.")
+			}
+			for _, p := range list {
+				if e = a.println(p.describe()); e != nil {
+					return
+				}
+			}
+			return
+		},
+		Foreground: true,
+	})
+	chatCommands.add(command{
+		Name:     "disconnect",
+		Aliases:  []string{"part", "leave"},
+		Category: "chat",
+		Desc:     "disconnect from the chat server",
+		Handler: func(c *client, a *args) (e error) {
 			if e = c.disconnect(); e != nil {
-				e = c.appendMsg("#msg-list", e.Error())
+				e = a.println(e.Error())
 			}
 			return
 		},
-	}
-	chatCommands["clear"] = command{
-		Desc: "clear the current terminal's content",
-		Handler: func(c *client, args []string) (e error) {
-			if len(args) > 0 {
-				c.innerHTML("#msg-list", " ")
+		Foreground: true,
+	})
+	chatCommands.add(command{
+		Name:     "topic",
+		Category: "chat",
+		Desc:     "show or set the topic of the chat server",
+		Long:     "Without text the topic is shown. Registered users can set the topic, which is kept after everyone leaves.",
+		Examples: []string{"topic", "topic Release planning at 3pm", "topic --clear"},
+		Params: []param{
+			{Name: "text", Optional: true, Rest: true},
+			{Name: "clear", Flag: true, Type: boolParam, Desc: "remove the topic"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if a.has("text") || a.bool("clear") {
+				if !a.user.auth {
+					return a.println("Log in to set the topic.")
+				}
+				if err := setTopic(a.server, a.str("text"), a.user.Name, c.id); err != nil {
+					return a.println(err.Error())
+				}
+				return
+			}
+			topic, err := getTopic(a.server)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			if topic == "" {
+				return a.println("No topic is set.")
+			}
+			return a.println("Topic: " + topic)
+		},
+	})
+	sysCommands.add(command{
+		Name:     "alias",
+		Category: "general",
+		Desc:     "list, show or define command aliases",
+		Long: "An alias runs one or more commands separated by ;. In the expansion $1 to $9 " +
+			"stand for the alias arguments and $* for all of them; without these the arguments " +
+			"are appended. Commands take precedence over aliases. Logged in users keep their aliases.",
+		Usage: "[name [= expansion]]",
+		Examples: []string{
+			"alias",
+			"alias hi = connect $1; set sound on",
+			"alias bio = profile set bio $*",
+		},
+		Params: []param{{Name: "definition", Optional: true, Rest: true}},
+		Handler: func(c *client, a *args) (e error) {
+			words := a.Words
+			if len(words) > 0 {
+				// accept name=expansion as well as name = expansion
+				if n := strings.Index(words[0], "="); n > 0 {
+					words = append([]string{words[0][:n], "="}, append([]string{words[0][n+1:]}, words[1:]...)...)
+				}
+			}
+			switch {
+			case len(words) == 0:
+				if len(c.aliases) == 0 {
+					return a.println("No aliases defined.")
+				}
+				for _, name := range c.aliasNames() {
+					if e = a.println(name + " = " + c.aliases[name]); e != nil {
+						return
+					}
+				}
+				return
+			case len(words) == 1:
+				name := strings.ToLower(words[0])
+				expansion, ok := c.aliases[name]
+				if !ok {
+					return a.println("No such alias: " + name)
+				}
+				return a.println(name + " = " + expansion)
+			case words[1] != "=":
+				return errUsage
+			}
+			// the words were unquoted by lex; quote them again but leave
+			// bare semicolons alone so they still separate commands
+			var quoted []string
+			for _, w := range words[2:] {
+				if w != "" && !strings.ContainsAny(w, " \t\r\n'\"`\\") {
+					quoted = append(quoted, w)
+				} else {
+					quoted = append(quoted, quoteWord(w))
+				}
+			}
+			expansion := strings.TrimSpace(strings.Join(quoted, " "))
+			if expansion == "" {
+				return errUsage
+			}
+			if err := c.setAlias(words[0], expansion); err != nil {
+				return a.println(err.Error())
+			}
+			return a.println("Alias " + strings.ToLower(words[0]) + " set.")
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "unalias",
+		Category: "general",
+		Desc:     "remove a command alias",
+		Examples: []string{"unalias hi"},
+		Params:   []param{{Name: "name", Complete: completeAliases}},
+		Handler: func(c *client, a *args) (e error) {
+			if err := c.setAlias(a.str("name"), ""); err != nil {
+				return a.println(err.Error())
+			}
+			return a.println("Alias " + a.lower("name") + " removed.")
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "history",
+		Category: "general",
+		Desc:     "show or clear your input history",
+		Long: "Lines you enter are kept so Up and Down recall them and Ctrl-R searches them. " +
+			"!! runs the previous line again, !n line n and !-n the line n back. Logged in " +
+			"users keep their history across sessions. Answers to prompts are never recorded.",
+		Examples: []string{"history", "history 50", "history --clear", "!!", "!12"},
+		Params: []param{
+			{Name: "count", Optional: true, Type: intParam, Default: "20", Desc: "number of lines to show"},
+			{Name: "clear", Flag: true, Type: boolParam, Desc: "forget your history"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if a.bool("clear") {
+				c.history = nil
+				if c.user.auth {
+					clearHistory(c.user.ID)
+				}
+				return a.println("History cleared.")
+			}
+			start := len(c.history) - a.int("count")
+			if start < 0 {
+				start = 0
+			}
+			for i := start; i < len(c.history); i++ {
+				if e = a.println(fmt.Sprintf("%d  %s", i+1, c.history[i])); e != nil {
+					return
+				}
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "note",
+		Category: "text",
+		Desc:     "list, show or delete your notes",
+		Long: "Notes hold the output of commands redirected with > note:name, or added " +
+			"with >> note:name. Without a name note lists your notes.",
+		Examples: []string{"audit 100 | grep failed > note:failures", "note failures", "note failures | wc", "note --delete failures"},
+		Params: []param{
+			{Name: "name", Optional: true, Complete: completeNotes},
+			{Name: "delete", Flag: true, Short: "d", Type: boolParam, Desc: "delete the note"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.auth {
+				return a.println("You must be logged in")
+			}
+			name := a.lower("name")
+			switch {
+			case a.bool("delete"):
+				if !a.has("name") {
+					return errUsage
+				}
+				if err := removeNote(a.user.ID, name); err != nil {
+					return a.println(err.Error())
+				}
+				return a.println("Deleted note:" + name)
+			case a.has("name"):
+				_, r, err := findNote(a.user.ID, name)
+				if err != nil {
+					return a.println(err.Error())
+				}
+				for _, line := range r.Lines {
+					if e = a.println(line); e != nil {
+						return
+					}
+				}
+				return
+			}
+			notes, err := listNotes(a.user.ID)
+			if err != nil {
+				return a.println(err.Error())
+			}
+			if len(notes) == 0 {
+				return a.println("No notes. Save some with: <command> > note:<name>")
+			}
+			for _, r := range notes {
+				line := fmt.Sprintf("%s - %d lines, updated %s", r.Name, len(r.Lines), r.Updated.Format("2006-01-02 15:04"))
+				if e = a.println(line); e != nil {
+					return
+				}
 			}
 			return
 		},
+	})
+	sysCommands.add(command{
+		Name:     "grep",
+		Category: "text",
+		Desc:     "show the piped lines matching a pattern",
+		Long:     "The pattern is a regular expression.",
+		Examples: []string{"audit 100 | grep login", "help | grep -i ACCOUNT", "prefs | grep -v default"},
+		Params: []param{
+			{Name: "pattern"},
+			{Name: "ignore-case", Flag: true, Short: "i", Type: boolParam, Desc: "ignore case distinctions"},
+			{Name: "invert", Flag: true, Short: "v", Type: boolParam, Desc: "show the lines not matching"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			lines, e := a.input()
+			if e != nil {
+				return
+			}
+			pattern := a.str("pattern")
+			if a.bool("ignore-case") {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.New("Bad pattern: " + err.Error())
+			}
+			for _, line := range lines {
+				if re.MatchString(line) != a.bool("invert") {
+					if e = a.println(line); e != nil {
+						return
+					}
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "head",
+		Category: "text",
+		Desc:     "show the first piped lines",
+		Examples: []string{"history 100 | head 5"},
+		Params:   []param{{Name: "count", Optional: true, Type: intParam, Default: "10"}},
+		Handler: func(c *client, a *args) (e error) {
+			lines, e := a.input()
+			if e != nil {
+				return
+			}
+			for i := 0; i < len(lines) && i < a.int("count"); i++ {
+				if e = a.println(lines[i]); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "tail",
+		Category: "text",
+		Desc:     "show the last piped lines",
+		Examples: []string{"note log | tail 5"},
+		Params:   []param{{Name: "count", Optional: true, Type: intParam, Default: "10"}},
+		Handler: func(c *client, a *args) (e error) {
+			lines, e := a.input()
+			if e != nil {
+				return
+			}
+			start := len(lines) - a.int("count")
+			if start < 0 {
+				start = 0
+			}
+			for _, line := range lines[start:] {
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "sort",
+		Category: "text",
+		Desc:     "sort the piped lines",
+		Examples: []string{"note scores | sort -nr", "history 100 | sort -u"},
+		Params: []param{
+			{Name: "numeric", Flag: true, Short: "n", Type: boolParam, Desc: "compare the numbers the lines start with"},
+			{Name: "reverse", Flag: true, Short: "r", Type: boolParam, Desc: "sort in descending order"},
+			{Name: "unique", Flag: true, Short: "u", Type: boolParam, Desc: "leave out repeated lines"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			lines, e := a.input()
+			if e != nil {
+				return
+			}
+			lines = append([]string(nil), lines...)
+			less := func(i, j int) bool { return lines[i] < lines[j] }
+			if a.bool("numeric") {
+				less = func(i, j int) bool { return leadingNumber(lines[i]) < leadingNumber(lines[j]) }
+			}
+			if a.bool("reverse") {
+				forward := less
+				less = func(i, j int) bool { return forward(j, i) }
+			}
+			sort.SliceStable(lines, less)
+			for i, line := range lines {
+				if a.bool("unique") && i > 0 && line == lines[i-1] {
+					continue
+				}
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "wc",
+		Category: "text",
+		Desc:     "count the piped lines, words and characters",
+		Examples: []string{"audit 500 | grep failed | wc -l"},
+		Params:   []param{{Name: "lines", Flag: true, Short: "l", Type: boolParam, Desc: "only count lines"}},
+		Handler: func(c *client, a *args) (e error) {
+			lines, e := a.input()
+			if e != nil {
+				return
+			}
+			if a.bool("lines") {
+				return a.println(strconv.Itoa(len(lines)))
+			}
+			words, chars := 0, 0
+			for _, line := range lines {
+				words += len(strings.Fields(line))
+				chars += utf8.RuneCountInString(line)
+			}
+			return a.println(fmt.Sprintf("%d lines, %d words, %d characters", len(lines), words, chars))
+		},
+	})
+	sysCommands.add(command{
+		Name:     "jobs",
+		Category: "general",
+		Desc:     "list your background jobs",
+		Long: "End a line with a separate & to run it in the background. Its output is shown tagged " +
+			"with the job ID. Ctrl-C cancels the job in the foreground. Logging in or out cancels the " +
+			"background jobs, which run as who you were when they started.",
+		Examples: []string{"sleep 1m &", "jobs"},
+		Handler: func(c *client, a *args) (e error) {
+			list := c.jobs.list()
+			if len(list) == 0 {
+				return a.println("No jobs.")
+			}
+			for _, j := range list {
+				line := fmt.Sprintf("[%d] running %s: %s", j.ID, time.Since(j.Started).Round(time.Second), j.Line)
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "fg",
+		Category: "general",
+		Desc:     "wait for a background job in the foreground",
+		Long:     "Without a job ID fg waits for the newest job. Ctrl-C then cancels it.",
+		Examples: []string{"fg", "fg 2"},
+		Params:   []param{{Name: "job", Optional: true, Type: intParam, Complete: completeJobs}},
+		Handler: func(c *client, a *args) (e error) {
+			j, ok := c.jobs.get(a.int("job"))
+			if !ok {
+				return a.println("No such job.")
+			}
+			if e = a.println(j.Line); e != nil {
+				return
+			}
+			prev := c.jobs.foreground(j)
+			defer c.jobs.foreground(prev)
+			select {
+			case <-j.done:
+			case <-a.ctx.Done():
+				return errCancelled
+			}
+			return
+		},
+		Foreground: true,
+	})
+	sysCommands.add(command{
+		Name:     "kill",
+		Category: "general",
+		Desc:     "cancel a background job",
+		Examples: []string{"kill 2"},
+		Params:   []param{{Name: "job", Type: intParam, Complete: completeJobs}},
+		Handler: func(c *client, a *args) (e error) {
+			j, ok := c.jobs.get(a.int("job"))
+			if !ok || a.int("job") == 0 {
+				return a.println("No such job.")
+			}
+			j.cancel()
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "sleep",
+		Category: "general",
+		Desc:     "wait for a while",
+		Long:     "Useful in aliases and background jobs. The longest wait is an hour.",
+		Examples: []string{"sleep 30s", "sleep 5m; note todo &"},
+		Params:   []param{{Name: "duration", Type: durParam}},
+		Handler: func(c *client, a *args) (e error) {
+			d := a.dur("duration")
+			if d < 0 || d > time.Hour {
+				return errors.New("Duration must be between 0s and 1h.")
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-a.ctx.Done():
+				return errCancelled
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "script",
+		Category: "general",
+		Desc:     "run, save and list Lua scripts",
+		Long: "Scripts are Lua 5.1 with the base, string, table and math libraries. Besides print they " +
+			"can use appendMsg(text), broadcast(text) to chat on your server, user(name) to look up " +
+			"a profile, kv.get(key), kv.set(key, value) and kv.keys() to keep values between runs, " +
+			"and the args, input, me and server variables. Enabled scripts have their on_join(user, " +
+			"server) and on_message(user, server, text) functions called when someone joins your " +
+			"chat server or sends a message there, and on_timer() every interval if one is given. " +
+			"Code outside functions runs before every call. Without code, save reads piped lines.",
+		Examples: []string{
+			`script save hi 'print("hello " .. (args[1] or me))'`,
+			"script run hi bob",
+			`script run -e 'for i = 1, 3 do print(i) end' | sort -r`,
+			"note greeter | script save greeter",
+			"script enable greeter 30m",
+		},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "list",
+				Choices: []string{"list", "run", "save", "show", "delete", "enable", "disable"}},
+			{Name: "name", Optional: true, Complete: completeScripts},
+			{Name: "args", Optional: true, Rest: true},
+			{Name: "eval", Flag: true, Short: "e", Type: boolParam, Desc: "run the code given instead of a saved script"},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.auth {
+				return a.println("You must be logged in")
+			}
+			name, action := a.lower("name"), a.lower("action")
+			if action != "list" && !a.has("name") {
+				return errUsage
+			}
+			var err error
+			switch action {
+			case "run":
+				var in []string
+				if a.in != nil {
+					in = *a.in
+				}
+				if a.bool("eval") {
+					src := strings.TrimSpace(a.str("name") + " " + a.str("args"))
+					return c.runScript(a.ctx, "eval", src, a.out, nil, in, "")
+				}
+				_, r, err := findScript(a.user.ID, name)
+				if err != nil {
+					return a.println(err.Error())
+				}
+				return c.runScript(a.ctx, r.Name, r.Source, a.out, strings.Fields(a.str("args")), in, "")
+			case "save":
+				src := a.str("args")
+				if src == "" {
+					lines, err := a.input()
+					if err != nil {
+						return errUsage
+					}
+					src = strings.Join(lines, "\n")
+				}
+				if err = saveScript(a.user.ID, name, src); err == nil {
+					reloadHooks(a.user.ID)
+					return a.println("Saved script " + name)
+				}
+			case "show":
+				_, r, err := findScript(a.user.ID, name)
+				if err != nil {
+					return a.println(err.Error())
+				}
+				for _, line := range strings.Split(r.Source, "\n") {
+					if e = a.println(line); e != nil {
+						return
+					}
+				}
+				return
+			case "delete":
+				if err = removeScript(a.user.ID, name); err == nil {
+					reloadHooks(a.user.ID)
+					return a.println("Deleted script " + name)
+				}
+			case "enable", "disable":
+				var every time.Duration
+				if a.has("args") {
+					if every, err = time.ParseDuration(a.str("args")); err != nil || every < minHookInterval {
+						return a.println("The interval must be a duration of at least " + minHookInterval.String())
+					}
+				}
+				err = changeScript(a.user.ID, name, false, func(r *scriptRecord) {
+					r.Enabled, r.Every = action == "enable", every
+				})
+				if err == nil {
+					reloadHooks(a.user.ID)
+					return a.println("Script " + name + " " + action + "d")
+				}
+			default:
+				scripts, err := listScripts(a.user.ID)
+				if err != nil {
+					return a.println(err.Error())
+				}
+				if len(scripts) == 0 {
+					return a.println("No scripts. Save one with: script save <name> <code>")
+				}
+				for _, r := range scripts {
+					line := fmt.Sprintf("%s - %d bytes, updated %s", r.Name, len(r.Source), r.Updated.Format("2006-01-02 15:04"))
+					if r.Enabled {
+						line += ", enabled"
+					}
+					if r.Enabled && r.Every > 0 {
+						line += " every " + r.Every.String()
+					}
+					if e = a.println(line); e != nil {
+						return
+					}
+				}
+				return
+			}
+			if err != nil {
+				return a.println(err.Error())
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "remind",
+		Category: "general",
+		Desc:     "set a reminder",
+		Long: "Times given with at are in the timezone of your profile. If you are offline when " +
+			"a reminder is due it is shown when you next log in. See reminders to list or cancel them.",
+		Examples: []string{"remind me in 10m check the oven", "remind me at 17:00 go home", "remind me at 2016-12-24 09:00 buy presents"},
+		Params:   []param{{Name: "who", Choices: []string{"me"}}, {Name: "when", Rest: true}},
+		Handler: func(c *client, a *args) (e error) {
+			return c.remind(a, a.Words[1:])
+		},
+	})
+	sysCommands.add(command{
+		Name:     "at",
+		Category: "general",
+		Desc:     "set a reminder for a time",
+		Long:     "The same as remind me at <time> <text>.",
+		Examples: []string{"at 17:00 go home", "at 2016-12-24 09:00 buy presents"},
+		Params:   []param{{Name: "time"}, {Name: "text", Rest: true}},
+		Handler: func(c *client, a *args) (e error) {
+			return c.remind(a, append([]string{"at"}, a.Words...))
+		},
+	})
+	sysCommands.add(command{
+		Name:     "reminders",
+		Category: "general",
+		Desc:     "list or cancel your reminders",
+		Examples: []string{"reminders", "reminders cancel 123456"},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "list", Choices: []string{"list", "cancel"}},
+			{Name: "id", Optional: true, Type: intParam},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.auth {
+				return a.println("You must be logged in")
+			}
+			ids, tasks := listTasks(func(r taskRecord) bool {
+				return r.Action == "remind" && r.UserID == a.user.ID
+			})
+			if a.lower("action") == "cancel" {
+				if _, ok := tasks[a.int("id")]; !ok {
+					return a.println("No such reminder.")
+				}
+				takeTask(a.int("id"))
+				return a.println("Reminder cancelled.")
+			}
+			if len(ids) == 0 {
+				return a.println("No reminders. Set one with: remind me in 10m <text>")
+			}
+			sort.Slice(ids, func(i, j int) bool { return tasks[ids[i]].Due.Before(tasks[ids[j]].Due) })
+			loc := c.userLocation()
+			for _, id := range ids {
+				line := fmt.Sprintf("%d  %s  %s", id, tasks[id].Due.In(loc).Format("2006-01-02 15:04"), tasks[id].Arg)
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	sysCommands.add(command{
+		Name:     "schedule",
+		Category: "admin",
+		Desc:     "list, add, remove or run recurring tasks (admin)",
+		Long: "Tasks run when their cron expression (minute hour day month weekday, in server time) " +
+			"matches. Quote expressions with spaces. The jobs are: " + strings.Join(taskNames(), ", ") + ".",
+		Examples: []string{
+			"schedule",
+			`schedule add "0 3 * * *" backup 7`,
+			`schedule add "*/30 9-17 * * 1-5" announce Remember to take a break.`,
+			"schedule add @weekly prune-history 90",
+			"schedule run 123456",
+			"schedule remove 123456",
+		},
+		Params: []param{
+			{Name: "action", Optional: true, Default: "list", Choices: []string{"list", "add", "remove", "run"}},
+			{Name: "spec", Optional: true, Desc: "cron expression, or task ID"},
+			{Name: "job", Optional: true, Complete: func(c *client) []string { return taskNames() }},
+			{Name: "arg", Optional: true, Rest: true},
+		},
+		Handler: func(c *client, a *args) (e error) {
+			if !a.user.isAdmin() {
+				return a.println("Permission denied")
+			}
+			ids, tasks := listTasks(func(r taskRecord) bool { return r.Spec != "" })
+			switch a.lower("action") {
+			case "add":
+				if !a.has("job") {
+					return errUsage
+				}
+				if _, err := parseCron(a.str("spec")); err != nil {
+					return a.println(err.Error())
+				}
+				if _, ok := taskActions[a.lower("job")]; !ok {
+					return a.println("Unknown job, use one of: " + strings.Join(taskNames(), ", "))
+				}
+				id, err := addTask(taskRecord{Spec: a.str("spec"), Action: a.lower("job"), Arg: a.str("arg"), UserID: a.user.ID})
+				if err != nil {
+					return a.println(err.Error())
+				}
+				audit("task add", a.user.Name, c.address, fmt.Sprintf("%d %s %s", id, a.str("spec"), a.lower("job")))
+				return a.println(fmt.Sprintf("Added task %d", id))
+			case "remove", "run":
+				id, _ := strconv.Atoi(a.str("spec"))
+				r, ok := tasks[id]
+				if !ok {
+					return a.println("No such task.")
+				}
+				audit("task "+a.lower("action"), a.user.Name, c.address, fmt.Sprintf("%d %s", id, r.Action))
+				if a.lower("action") == "run" {
+					go runTask(id, r)
+					return a.println(fmt.Sprintf("Running task %d", id))
+				}
+				takeTask(id)
+				return a.println(fmt.Sprintf("Removed task %d", id))
+			}
+			if len(ids) == 0 {
+				return a.println("No tasks scheduled.")
+			}
+			now := time.Now()
+			for _, id := range ids {
+				r := tasks[id]
+				line := fmt.Sprintf("%d  %s  %s %s", id, r.Spec, r.Action, r.Arg)
+				if spec, err := parseCron(r.Spec); err == nil {
+					if next := spec.next(now); !next.IsZero() {
+						line += " - next " + next.Format("2006-01-02 15:04")
+					}
+				}
+				if !r.LastRun.IsZero() {
+					line += ", last " + r.LastRun.Local().Format("2006-01-02 15:04")
+				}
+				if e = a.println(line); e != nil {
+					return
+				}
+			}
+			return
+		},
+	})
+	for _, name := range []string{"nick", "whois", "set", "prefs", "alias", "unalias", "history",
+		"note", "grep", "head", "tail", "sort", "wc", "jobs", "fg", "kill", "sleep", "script",
+		"remind", "at", "reminders"} {
+		chatCommands.add(sysCommands[name])
+	}
+}
+
+// leadingNumber returns the number line starts with, or 0 if there is none.
+func leadingNumber(line string) float64 {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0
 	}
+	n, _ := strconv.ParseFloat(strings.TrimRight(fields[0], ",.:;"), 64)
+	return n
 }
@@ -0,0 +1,180 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains tab completion. The browser sends a complete control packet
+with the input line up to the cursor and the server answers with the word being
+completed and the candidates for it, taken from the command registry, the
+completers of the command's params and, after >, the user's notes.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxCompletions limits the number of candidates sent to the browser.
+const maxCompletions = 50
+
+// completer returns the candidates for an argument. The caller filters them
+// by the typed prefix.
+type completer func(c *client) []string
+
+func init() {
+	controls["complete"] = func(c *client, p packet) error {
+		word, list := c.complete(p.Data["Line"])
+		r := newPacket("complete")
+		r.Data["Selector"] = "#msg-txt"
+		r.Data["Word"] = word
+		r.Data["Value"] = strings.Join(list, "\n")
+		return c.send(r)
+	}
+}
+
+// completeCommands returns the command and alias names available to c.
+func completeCommands(c *client) (list []string) {
+	for name := range *c.command {
+		list = append(list, name)
+	}
+	for name := range c.aliases {
+		list = append(list, name)
+	}
+	return
+}
+
+// completeUsers returns the names of the users online.
+func completeUsers(c *client) []string {
+	return sessions.names()
+}
+
+// completeServers returns the names of the open chat servers.
+func completeServers(c *client) []string {
+	return servers.names()
+}
+
+// completePrefs returns the preference keys.
+func completePrefs(c *client) []string {
+	return prefKeys()
+}
+
+// completeAliases returns the aliases of c.
+func completeAliases(c *client) []string {
+	return c.aliasNames()
+}
+
+// completeProfileFields returns the profile fields which can be hidden.
+func completeProfileFields(c *client) (list []string) {
+	for _, f := range profileFields {
+		list = append(list, f.Name)
+	}
+	return append(list, privateOnly...)
+}
+
+// lastWord returns the raw text of the word being typed at the end of line.
+func lastWord(line string) string {
+	i := strings.LastIndexFunc(line, unicode.IsSpace)
+	return line[i+1:]
+}
+
+// complete returns the word being completed at the end of line, as typed,
+// and the sorted candidates to replace it with.
+func (c *client) complete(line string) (word string, list []string) {
+	word = lastWord(line)
+	prefix := ""
+	if c.cmdPrefix != "" {
+		if !strings.HasPrefix(line, c.cmdPrefix) {
+			// chat messages complete the names of the users online
+			return word, filterCompletions(completeUsers(c), word, "")
+		}
+		line = line[len(c.cmdPrefix):]
+		prefix = c.cmdPrefix
+	}
+	// only the last command of a line or pipeline matters
+	for _, sep := range []rune{';', '|'} {
+		if parts := splitUnquoted(line, sep); len(parts) > 1 {
+			line = strings.TrimLeftFunc(parts[len(parts)-1], unicode.IsSpace)
+			word, prefix = lastWord(line), ""
+		}
+	}
+	if parts := splitUnquoted(line, '>'); len(parts) > 1 {
+		var notes []string
+		for _, name := range completeNotes(c) {
+			notes = append(notes, "note:"+name)
+		}
+		return word, filterCompletions(notes, word, "")
+	}
+	words, err := lex(line)
+	if err != nil {
+		return
+	}
+	if len(line) == 0 || unicode.IsSpace(rune(line[len(line)-1])) {
+		words = append(words, "")
+	}
+	if len(words) == 1 {
+		return word, filterCompletions(completeCommands(c), words[0], prefix)
+	}
+	cmd, ok := (*c.command)[strings.ToLower(words[0])]
+	if !ok {
+		return
+	}
+	partial := words[len(words)-1]
+	if strings.HasPrefix(partial, "--") {
+		for _, p := range cmd.Params {
+			if p.Flag {
+				list = append(list, "--"+p.Name)
+			}
+		}
+		return word, filterCompletions(list, partial, "")
+	}
+	// find the positional param the last word belongs to
+	pos := 0
+	for _, w := range words[1 : len(words)-1] {
+		if !strings.HasPrefix(w, "--") {
+			pos++
+		}
+	}
+	var p *param
+	for i := range cmd.Params {
+		if cmd.Params[i].Flag {
+			continue
+		}
+		if pos == 0 || cmd.Params[i].Rest {
+			p = &cmd.Params[i]
+			break
+		}
+		pos--
+	}
+	switch {
+	case p == nil:
+		return
+	case len(p.Choices) > 0:
+		list = p.Choices
+	case p.Complete != nil:
+		list = p.Complete(c)
+	}
+	return word, filterCompletions(list, partial, "")
+}
+
+// filterCompletions returns the quoted candidates in list starting with
+// partial, sorted and without duplicates, each with prefix added.
+func filterCompletions(list []string, partial, prefix string) (out []string) {
+	seen := make(map[string]bool)
+	lower := strings.ToLower(partial)
+	for _, s := range list {
+		if seen[s] || !strings.HasPrefix(strings.ToLower(s), lower) {
+			continue
+		}
+		seen[s] = true
+		out = append(out, prefix+quoteWord(s))
+	}
+	sort.Strings(out)
+	if len(out) > maxCompletions {
+		out = out[:maxCompletions]
+	}
+	return
+}
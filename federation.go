@@ -0,0 +1,676 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains federation, links between soshell servers that share chat
+servers. Peers connect over TLS and prove they know the shared key of the link
+with an HMAC bound to the TLS session, then exchange JSON frames, one per line.
+Messages, joins, parts, nick and topic changes on a shared chat server are
+passed to the peer, with names of local users sent as name@host. Every message
+has an ID and each one is only taken once, so messages can't loop between
+servers linked in a ring. A peer with an address is dialled, and redialled with
+a growing delay when the link drops, the others are waited for.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	peerProtocol     = 1
+	peerHandshake    = 30 * time.Second
+	peerPingEvery    = time.Minute
+	peerTimeout      = 3 * time.Minute
+	peerBackoff      = 2 * time.Second
+	maxPeerBackoff   = 5 * time.Minute
+	peerQueue        = 256       // frames waiting to be sent
+	maxPeerFrame     = 64 * 1024 // bytes
+	maxSeen          = 10000     // message IDs remembered before the oldest are forgotten
+	peerKeyingLabel  = "soshell federation"
+	maxPeerTextBytes = 8192
+)
+
+var peersDB *db.Col
+
+// peerRecord is the stored form of a peer.
+type peerRecord struct {
+	Host    string // the -host of the peer
+	Address string // host:port to dial, "" if the peer dials us
+	Key     string // shared key of the link
+	Rooms   []string
+	UserID  int
+	Created time.Time
+}
+
+// peer is a configured peer.
+type peer struct {
+	ID int
+	peerRecord
+	stop chan struct{} // closed when the peer is removed
+
+	sync.Mutex // guards the fields below
+	link       *peerLink
+	status     string
+}
+
+// peers holds the configured peers keyed by lower case host.
+var peers = struct {
+	sync.RWMutex
+	m map[string]*peer
+}{m: make(map[string]*peer)}
+
+// peerLink is an authenticated connection to a peer. It is a member of each
+// shared chat server.
+type peerLink struct {
+	p     *peer
+	conn  net.Conn
+	sid   string // session ID
+	queue chan peerFrame
+	// users on the peer's side of each shared chat server, only used by
+	// the goroutine reading the link
+	present map[string]map[string]bool
+}
+
+// peerFrame is sent over a link.
+type peerFrame struct {
+	Type     string     `json:"type"` // hello, auth, welcome, error, ping or event
+	Protocol int        `json:"protocol,omitempty"`
+	Host     string     `json:"host,omitempty"`
+	Nonce    string     `json:"nonce,omitempty"`
+	Proof    string     `json:"proof,omitempty"`
+	Text     string     `json:"text,omitempty"` // of an error
+	Event    *peerEvent `json:"event,omitempty"`
+}
+
+// peerEvent is a roomMessage passed over a link.
+type peerEvent struct {
+	ID   string    `json:"id"`
+	Kind string    `json:"kind"`
+	Room string    `json:"room"`
+	From string    `json:"from"` // name@host
+	Text string    `json:"text"`
+	Bot  bool      `json:"bot"`
+	Time time.Time `json:"time"`
+}
+
+// seenIDs remembers the IDs of the messages passed over links.
+var seenIDs = struct {
+	sync.Mutex
+	m     map[string]bool
+	order []string // the IDs in m, oldest first
+}{m: make(map[string]bool)}
+
+// markSeen remembers id, returning false if it was seen already. Once maxSeen
+// IDs are remembered the oldest tenth are forgotten.
+func markSeen(id string) bool {
+	seenIDs.Lock()
+	defer seenIDs.Unlock()
+	if seenIDs.m[id] || id == "" {
+		return false
+	}
+	if len(seenIDs.order) >= maxSeen {
+		n := len(seenIDs.order) - maxSeen + maxSeen/10
+		for _, old := range seenIDs.order[:n] {
+			delete(seenIDs.m, old)
+		}
+		seenIDs.order = append([]string(nil), seenIDs.order[n:]...)
+	}
+	seenIDs.m[id] = true
+	seenIDs.order = append(seenIDs.order, id)
+	return true
+}
+
+// hasControl returns true if s contains a control character, such as a line
+// break.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// address returns name as users on linked servers see it.
+func address(name string) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return name + "@" + *hostname
+}
+
+// loadPeersDB opens the peers collection, creating it if needed.
+func loadPeersDB() (e error) {
+	peersDB, e = openCollection("peers", "UserID")
+	return
+}
+
+// startPeers loads the stored peers, replacing any running ones, and starts
+// dialling the peers with addresses.
+func startPeers() {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	loaded := make(map[string]*peer)
+	peersDB.ForEachDoc(func(id int, doc []byte) bool {
+		var r peerRecord
+		if err := decodeJSON("peers", id, doc, &r); err != nil {
+			log.Println(err)
+		} else {
+			loaded[strings.ToLower(r.Host)] = startPeer(id, r)
+		}
+		return true
+	})
+	peers.Lock()
+	for _, p := range peers.m {
+		p.halt()
+	}
+	peers.m = loaded
+	peers.Unlock()
+}
+
+// startPeer returns the peer for r, dialling it if it has an address.
+func startPeer(id int, r peerRecord) *peer {
+	p := &peer{ID: id, peerRecord: r, stop: make(chan struct{}), status: "waiting for the peer to connect"}
+	if r.Address != "" {
+		p.status = "connecting"
+		go p.run()
+	}
+	return p
+}
+
+// addPeer stores and starts a new peer.
+func addPeer(r peerRecord) error {
+	if _, ok := getPeer(r.Host); ok {
+		return errors.New("That peer exists already.")
+	}
+	r.Created = time.Now().UTC()
+	doc, err := encodeDoc(r)
+	if err != nil {
+		return err
+	}
+	dbLock.RLock()
+	id, err := peersDB.Insert(doc)
+	dbLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	peers.Lock()
+	peers.m[strings.ToLower(r.Host)] = startPeer(id, r)
+	peers.Unlock()
+	return nil
+}
+
+// removePeer deletes the peer with host, dropping its link.
+func removePeer(host string) error {
+	peers.Lock()
+	p, ok := peers.m[strings.ToLower(host)]
+	delete(peers.m, strings.ToLower(host))
+	peers.Unlock()
+	if !ok {
+		return errors.New("No such peer.")
+	}
+	p.halt()
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return peersDB.Delete(p.ID)
+}
+
+// getPeer returns the peer with host.
+func getPeer(host string) (p *peer, ok bool) {
+	peers.RLock()
+	defer peers.RUnlock()
+	p, ok = peers.m[strings.ToLower(host)]
+	return
+}
+
+// listPeers returns the peers sorted by host.
+func listPeers() (list []*peer) {
+	peers.RLock()
+	for _, p := range peers.m {
+		list = append(list, p)
+	}
+	peers.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return
+}
+
+// halt stops p, dropping its link.
+func (p *peer) halt() {
+	close(p.stop)
+	p.Lock()
+	if p.link != nil {
+		p.link.conn.Close()
+	}
+	p.Unlock()
+}
+
+// stopped returns true once p has been halted.
+func (p *peer) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *peer) setStatus(status string) {
+	p.Lock()
+	p.status = status
+	p.Unlock()
+}
+
+// describe returns a line describing p for the peer command.
+func (p *peer) describe() string {
+	p.Lock()
+	defer p.Unlock()
+	dials := p.Address
+	if dials == "" {
+		dials = "(dials us)"
+	}
+	return fmt.Sprintf("%s  %s  %s, %s", p.Host, dials, strings.Join(p.Rooms, ","), p.status)
+}
+
+// room returns the shared chat server name as spelt here.
+func (p *peer) room(name string) (string, bool) {
+	for _, room := range p.Rooms {
+		if strings.EqualFold(room, name) {
+			return room, true
+		}
+	}
+	return "", false
+}
+
+// proof returns the HMAC a side of a link proves it knows the key with.
+// Binding it to the TLS session keeps it from being relayed.
+func (p *peer) proof(role, nonce string, keying []byte) string {
+	mac := hmac.New(sha256.New, []byte(p.Key))
+	fmt.Fprintf(mac, "%s\n%s\n%x", role, nonce, keying)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyingMaterial returns the secret exported from the TLS session of conn.
+func keyingMaterial(conn *tls.Conn) ([]byte, error) {
+	state := conn.ConnectionState()
+	return state.ExportKeyingMaterial(peerKeyingLabel, nil, 32)
+}
+
+// readFrame reads the next frame from sc.
+func readFrame(sc *bufio.Scanner) (f peerFrame, e error) {
+	if !sc.Scan() {
+		if e = sc.Err(); e == nil {
+			e = errors.New("link closed")
+		}
+		return
+	}
+	if e = json.Unmarshal(sc.Bytes(), &f); e == nil && f.Type == "error" {
+		e = errors.New(f.Text)
+	}
+	return
+}
+
+// writeFrame writes f to conn.
+func writeFrame(conn net.Conn, f peerFrame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	_, err = conn.Write(append(b, '\n'))
+	return err
+}
+
+func newFrameScanner(conn net.Conn) *bufio.Scanner {
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), maxPeerFrame)
+	return sc
+}
+
+// listenFederation accepts links from peers over TLS at addr.
+func listenFederation(addr string) {
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatal("federation:", err)
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		log.Fatal("federation:", err)
+	}
+	fmt.Println("Federation listening at " + addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("federation:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go acceptPeer(conn.(*tls.Conn))
+	}
+}
+
+// acceptPeer authenticates a peer that dialled us and serves the link.
+func acceptPeer(conn *tls.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(peerHandshake))
+	refuse := func(text string) {
+		writeFrame(conn, peerFrame{Type: "error", Text: text})
+	}
+	if err := conn.Handshake(); err != nil {
+		log.Println(addr, "federation:", err)
+		return
+	}
+	keying, err := keyingMaterial(conn)
+	if err != nil {
+		log.Println(addr, "federation:", err)
+		return
+	}
+	sc := newFrameScanner(conn)
+	hello, err := readFrame(sc)
+	if err != nil || hello.Type != "hello" {
+		refuse("Expected hello.")
+		return
+	}
+	if hello.Protocol != peerProtocol {
+		refuse(fmt.Sprintf("Protocol %d isn't supported, this server speaks %d.", hello.Protocol, peerProtocol))
+		return
+	}
+	p, ok := getPeer(hello.Host)
+	if !ok {
+		// not audited, anyone can knock
+		log.Printf("%s federation: refused unknown peer %q", addr, hello.Host)
+		refuse("Unknown peer.")
+		return
+	}
+	nonce := randHex(16)
+	err = writeFrame(conn, peerFrame{Type: "hello", Protocol: peerProtocol, Host: *hostname, Nonce: nonce,
+		Proof: p.proof("accept", hello.Nonce, keying)})
+	if err != nil {
+		return
+	}
+	auth, err := readFrame(sc)
+	if err != nil {
+		log.Println(addr, "federation:", err)
+		return
+	}
+	if auth.Type != "auth" || !hmac.Equal([]byte(auth.Proof), []byte(p.proof("dial", nonce, keying))) {
+		audit("peer refused", p.Host, addr, "bad key")
+		refuse("Authentication failed.")
+		return
+	}
+	l, err := p.claim(conn)
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+	if err = writeFrame(conn, peerFrame{Type: "welcome"}); err != nil {
+		p.release(l)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("federation: %s linked from %s", p.Host, addr)
+	err = l.serve(sc)
+	log.Printf("federation: link with %s lost: %v", p.Host, err)
+	if !p.stopped() {
+		p.setStatus(fmt.Sprintf("waiting for the peer to connect (%v)", err))
+	}
+}
+
+// run keeps dialling p until it is halted.
+func (p *peer) run() {
+	wait := peerBackoff
+	for {
+		linked, err := p.dial()
+		if p.stopped() {
+			return
+		}
+		if linked {
+			wait = peerBackoff
+		}
+		log.Printf("federation: %s: %v, reconnecting in %s", p.Host, err, wait)
+		p.setStatus(fmt.Sprintf("reconnecting in %s (%v)", wait, err))
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > maxPeerBackoff {
+			wait = maxPeerBackoff
+		}
+	}
+}
+
+// dial links with p and serves the link until it drops. linked is true if
+// the link was made.
+func (p *peer) dial() (linked bool, e error) {
+	dialer := &net.Dialer{Timeout: peerHandshake}
+	// the certificate isn't checked, the shared key authenticates the peer
+	conn, e := tls.DialWithDialer(dialer, "tcp", p.Address, &tls.Config{InsecureSkipVerify: true})
+	if e != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerHandshake))
+	keying, e := keyingMaterial(conn)
+	if e != nil {
+		return
+	}
+	nonce := randHex(16)
+	if e = writeFrame(conn, peerFrame{Type: "hello", Protocol: peerProtocol, Host: *hostname, Nonce: nonce}); e != nil {
+		return
+	}
+	sc := newFrameScanner(conn)
+	hello, e := readFrame(sc)
+	if e != nil {
+		return
+	}
+	if hello.Type != "hello" || !strings.EqualFold(hello.Host, p.Host) {
+		return false, fmt.Errorf("expected hello from %s", p.Host)
+	}
+	if hello.Protocol != peerProtocol {
+		return false, fmt.Errorf("the peer speaks protocol %d", hello.Protocol)
+	}
+	if !hmac.Equal([]byte(hello.Proof), []byte(p.proof("accept", nonce, keying))) {
+		audit("peer refused", p.Host, p.Address, "bad key")
+		return false, errors.New("the peer doesn't know the key")
+	}
+	if e = writeFrame(conn, peerFrame{Type: "auth", Proof: p.proof("dial", hello.Nonce, keying)}); e != nil {
+		return
+	}
+	if _, e = readFrame(sc); e != nil {
+		return
+	}
+	l, e := p.claim(conn)
+	if e != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("federation: linked with %s", p.Host)
+	return true, l.serve(sc)
+}
+
+// claim makes conn the link of p, failing if p is linked already.
+func (p *peer) claim(conn net.Conn) (*peerLink, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.link != nil {
+		return nil, errors.New("Already linked.")
+	}
+	if p.stopped() {
+		return nil, errors.New("The peer was removed.")
+	}
+	p.link = &peerLink{p: p, conn: conn, sid: newSessionID(), queue: make(chan peerFrame, peerQueue),
+		present: make(map[string]map[string]bool)}
+	p.status = "linked since " + time.Now().Format("2006-01-02 15:04:05")
+	return p.link, nil
+}
+
+// release forgets l as the link of p.
+func (p *peer) release(l *peerLink) {
+	p.Lock()
+	if p.link == l {
+		p.link = nil
+	}
+	p.Unlock()
+}
+
+// serve puts l on the shared chat servers and passes events over it until it
+// drops.
+func (l *peerLink) serve(sc *bufio.Scanner) (e error) {
+	done := make(chan struct{})
+	go l.writer(done)
+	l.up()
+	defer func() {
+		close(done)
+		l.conn.Close()
+		l.down()
+		l.p.release(l)
+	}()
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		f, err := readFrame(sc)
+		if err != nil {
+			return err
+		}
+		if f.Type == "event" && f.Event != nil {
+			l.receive(*f.Event)
+		}
+	}
+}
+
+// writer sends the queued frames, pinging the peer now and then, until done
+// is closed.
+func (l *peerLink) writer(done chan struct{}) {
+	ping := time.NewTicker(peerPingEvery)
+	defer ping.Stop()
+	for {
+		f := peerFrame{Type: "ping"}
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+		case f = <-l.queue:
+		}
+		if err := writeFrame(l.conn, f); err != nil {
+			l.conn.Close()
+			return
+		}
+	}
+}
+
+// send queues an event without blocking, dropping it when the queue is full.
+func (l *peerLink) send(ev peerEvent) {
+	select {
+	case l.queue <- peerFrame{Type: "event", Event: &ev}:
+	default:
+		log.Printf("federation: queue to %s full, dropped a message", l.p.Host)
+	}
+}
+
+// up joins l to the shared chat servers, telling the peer who is on them.
+// The link itself isn't announced.
+func (l *peerLink) up() {
+	for _, room := range l.p.Rooms {
+		s := enter(room, l)
+		l.present[room] = make(map[string]bool)
+		for _, m := range s.members() {
+			if _, ok := m.(*peerLink); ok {
+				continue
+			}
+			ev := peerEvent{ID: randHex(8), Kind: "join", Room: room, From: address(m.nick()), Time: time.Now()}
+			markSeen(ev.ID)
+			l.send(ev)
+		}
+	}
+}
+
+// down tells the shared chat servers that the users behind l have gone and
+// takes l off them.
+func (l *peerLink) down() {
+	for room, names := range l.present {
+		s, ok := servers.get(room)
+		if !ok {
+			continue
+		}
+		for name := range names {
+			s.send(roomMessage{Kind: "part", From: name, Origin: "federation", Session: l.sid})
+		}
+		s.remove(l)
+	}
+}
+
+// receive passes an event from the peer to its chat server.
+func (l *peerLink) receive(ev peerEvent) {
+	room, ok := l.p.room(ev.Room)
+	if !ok || !strings.Contains(ev.From, "@") || len(ev.Text) > maxPeerTextBytes ||
+		hasControl(ev.From) || hasControl(ev.Text) || !markSeen(ev.ID) {
+		return
+	}
+	// our own users only speak for themselves
+	if strings.HasSuffix(strings.ToLower(ev.From), "@"+strings.ToLower(*hostname)) {
+		return
+	}
+	present := l.present[room]
+	switch ev.Kind {
+	case "message":
+	case "join":
+		present[ev.From] = true
+	case "part":
+		delete(present, ev.From)
+	case "nick":
+		if !strings.Contains(ev.Text, "@") {
+			return
+		}
+		if present[ev.From] {
+			delete(present, ev.From)
+			present[ev.Text] = true
+		}
+	case "topic":
+		if err := storeTopic(room, ev.Text); err != nil {
+			log.Printf("federation: topic from %s: %v", l.p.Host, err)
+			return
+		}
+	default:
+		return
+	}
+	servers.broadcast(room, roomMessage{ID: ev.ID, Kind: ev.Kind, From: ev.From, Text: ev.Text, Bot: ev.Bot,
+		Origin: "federation", Session: l.sid})
+}
+
+func (l *peerLink) sessionID() string { return l.sid }
+
+func (l *peerLink) nick() string { return l.p.Host }
+
+// deliver passes m to the peer, unless it came from there.
+func (l *peerLink) deliver(m roomMessage) {
+	if m.Session == l.sid {
+		return
+	}
+	switch m.Kind {
+	case "message", "join", "part", "nick", "topic":
+	default:
+		return
+	}
+	markSeen(m.ID)
+	ev := peerEvent{ID: m.ID, Kind: m.Kind, Room: m.Room, From: address(m.From), Text: m.Text, Bot: m.Bot,
+		Time: m.Time.UTC()}
+	if m.Kind == "nick" {
+		ev.Text = address(m.Text)
+	}
+	l.send(ev)
+}
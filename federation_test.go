@@ -0,0 +1,38 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMarkSeen(t *testing.T) {
+	if markSeen("") {
+		t.Error("an empty ID was new")
+	}
+	for i := 0; i < maxSeen; i++ {
+		if !markSeen(fmt.Sprint("seen", i)) {
+			t.Fatalf("ID %d wasn't new", i)
+		}
+	}
+	if markSeen("seen0") || markSeen(fmt.Sprint("seen", maxSeen-1)) {
+		t.Error("a remembered ID was new")
+	}
+	// the oldest are forgotten to make room
+	if !markSeen("one more") {
+		t.Error("a new ID wasn't new once full")
+	}
+	if !markSeen("seen0") {
+		t.Error("the oldest ID is still remembered")
+	}
+	if markSeen(fmt.Sprint("seen", maxSeen-1)) || markSeen("one more") {
+		t.Error("the newest IDs were forgotten")
+	}
+	if len(seenIDs.order) != len(seenIDs.m) || len(seenIDs.m) > maxSeen {
+		t.Errorf("remembering %d IDs in order, %d in all", len(seenIDs.order), len(seenIDs.m))
+	}
+}
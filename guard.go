@@ -0,0 +1,183 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the login guard which slows down and eventually locks out
+repeated failed logins, both per account and per remote address. The same
+guard throttles password reset requests and the password checks before
+changes to an account.
+*/
+
+//
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	freeFailures  = 3                // failures allowed before backoff starts
+	maxBackoff    = 5 * time.Minute  // longest delay between attempts
+	lockFailures  = 10               // failures that trigger a lockout
+	lockDuration  = 15 * time.Minute // how long a lockout lasts
+	forgetFailure = time.Hour        // idle time after which failures are forgotten
+	spreadLimit   = 5                // accounts one address may fail on before it is flagged
+)
+
+// attempts tracks failed logins for one account or address.
+type attempts struct {
+	fails int
+	last  time.Time
+	until time.Time // no attempts are allowed before until
+	names map[string]bool
+}
+
+// loginGuard tracks failed logins per account and per address.
+type loginGuard struct {
+	sync.Mutex
+	accounts map[string]*attempts
+	addrs    map[string]*attempts
+	pruned   time.Time // when stale attempts were last forgotten
+}
+
+var guard = loginGuard{accounts: make(map[string]*attempts), addrs: make(map[string]*attempts)}
+
+// resetGuard counts password reset requests the same way, apart from the
+// logins so that asking for resets can't lock anyone out.
+var resetGuard = loginGuard{accounts: make(map[string]*attempts), addrs: make(map[string]*attempts)}
+
+// hostOf strips the port from a remote address.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// stale returns true once a can be forgotten.
+func (a *attempts) stale(now time.Time) bool {
+	return now.Sub(a.last) > forgetFailure && now.After(a.until)
+}
+
+// get returns the attempts for key, forgetting stale ones.
+func (g *loginGuard) get(m map[string]*attempts, key string, now time.Time) *attempts {
+	a, ok := m[key]
+	if !ok || a.stale(now) {
+		a = &attempts{names: make(map[string]bool)}
+		m[key] = a
+	}
+	return a
+}
+
+// wait returns how long the caller must wait before name may be tried again
+// from addr. Zero means the attempt is allowed.
+func (g *loginGuard) wait(name, addr string) time.Duration {
+	g.Lock()
+	defer g.Unlock()
+	now := time.Now()
+	var w time.Duration
+	if a, ok := g.accounts[strings.ToLower(name)]; ok {
+		w = a.until.Sub(now)
+	}
+	if a, ok := g.addrs[hostOf(addr)]; ok && a.until.Sub(now) > w {
+		w = a.until.Sub(now)
+	}
+	if w < 0 {
+		w = 0
+	}
+	return w
+}
+
+// prune forgets the stale attempts of every account and address. It does
+// the sweep at most once every forgetFailure.
+func (g *loginGuard) prune(now time.Time) {
+	if now.Sub(g.pruned) < forgetFailure {
+		return
+	}
+	g.pruned = now
+	for _, m := range []map[string]*attempts{g.accounts, g.addrs} {
+		for key, a := range m {
+			if a.stale(now) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// fail records a failed login and returns any audit events it triggered.
+func (g *loginGuard) fail(name, addr string) (events []string) {
+	g.Lock()
+	defer g.Unlock()
+	now := time.Now()
+	g.prune(now)
+	name = strings.ToLower(name)
+	for _, a := range []*attempts{g.get(g.accounts, name, now), g.get(g.addrs, hostOf(addr), now)} {
+		a.fails++
+		a.last = now
+		a.names[name] = true
+		switch {
+		case a.fails >= lockFailures:
+			a.until = now.Add(lockDuration)
+			if a.fails == lockFailures {
+				events = append(events, "lockout")
+			}
+		case a.fails > freeFailures:
+			d := time.Second << uint(a.fails-freeFailures-1)
+			if d > maxBackoff {
+				d = maxBackoff
+			}
+			a.until = now.Add(d)
+		}
+		if len(a.names) == spreadLimit+1 {
+			events = append(events, fmt.Sprintf("address tried %d accounts", len(a.names)))
+		}
+	}
+	return
+}
+
+// succeed clears the failures recorded for name. Those of the address are
+// kept, one good password doesn't excuse guessing at other accounts.
+func (g *loginGuard) succeed(name string) (hadFailures int) {
+	g.Lock()
+	defer g.Unlock()
+	name = strings.ToLower(name)
+	if a, ok := g.accounts[name]; ok {
+		hadFailures = a.fails
+	}
+	delete(g.accounts, name)
+	return
+}
+
+// recheckPassword asks the logged in user for the password of r again before
+// event, a change to the account. Like login it goes through the guard, so a
+// session left logged in can't be used to guess the password. ok is false,
+// and the user has been told why, if attempts are blocked or the password is
+// wrong.
+func (c *client) recheckPassword(a *args, event string, r userRecord, text string) (pass string, ok bool, e error) {
+	if wait := guard.wait(r.Name, c.address); wait > 0 {
+		audit(event+" blocked", r.Name, c.address, "")
+		return "", false, a.println(fmt.Sprintf("Too many failed attempts. Try again in %s.", wait.Round(time.Second)))
+	}
+	if pass, e = c.promptSecure("#msg-txt", text); e != nil {
+		return
+	}
+	if pass != r.Pass {
+		return "", false, c.badPassword(a, event, r.Name)
+	}
+	guard.succeed(r.Name)
+	return pass, true, nil
+}
+
+// badPassword records a failed password check for event with the guard.
+func (c *client) badPassword(a *args, event, name string) error {
+	audit(event+" failed", name, c.address, "")
+	for _, ev := range guard.fail(name, c.address) {
+		audit(ev, name, c.address, "")
+	}
+	return a.println("Password incorrect")
+}
@@ -0,0 +1,100 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file generates the help listing and the per command manual pages from the
+metadata commands are registered with.
+*/
+
+//
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// categoryOrder is the order categories are listed in by help. Categories not
+// listed here follow in alphabetical order.
+var categoryOrder = []string{"general", "chat", "text", "account", "profile", "plugins", "admin"}
+
+// helpIndex returns the lines of the command listing for cs, grouped by
+// category and sorted by name. Aliases are not listed separately.
+func helpIndex(cs commandSet, prefix string) (lines []string) {
+	groups := make(map[string][]command)
+	for key, cmd := range cs {
+		if key != cmd.Name {
+			continue
+		}
+		groups[cmd.Category] = append(groups[cmd.Category], cmd)
+	}
+	var cats []string
+	for cat := range groups {
+		cats = append(cats, cat)
+	}
+	rank := func(cat string) int {
+		for i, c := range categoryOrder {
+			if c == cat {
+				return i
+			}
+		}
+		return len(categoryOrder)
+	}
+	sort.Slice(cats, func(i, j int) bool {
+		ri, rj := rank(cats[i]), rank(cats[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return cats[i] < cats[j]
+	})
+	for _, cat := range cats {
+		cmds := groups[cat]
+		sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+		if cat == "" {
+			cat = "other"
+		}
+		lines = append(lines, strings.Title(cat)+" commands:")
+		for _, cmd := range cmds {
+			lines = append(lines, "    "+prefix+cmd.Name+" - "+cmd.Desc)
+		}
+	}
+	lines = append(lines, "Type "+prefix+"help <command> for more.")
+	return
+}
+
+// manual returns the lines of the help page for cmd.
+func (cmd command) manual(prefix string) (lines []string) {
+	lines = append(lines, "NAME", "    "+prefix+cmd.Name+" - "+cmd.Desc)
+	lines = append(lines, "USAGE", "    "+cmd.usage(prefix+cmd.Name))
+	if cmd.Long != "" {
+		lines = append(lines, "DESCRIPTION", "    "+cmd.Long)
+	}
+	if len(cmd.Params) > 0 {
+		lines = append(lines, "ARGUMENTS")
+		for _, p := range cmd.Params {
+			line := "    " + p.synopsis()
+			if p.Desc != "" {
+				line += " - " + p.Desc
+			}
+			if p.Default != "" {
+				line += " (default " + p.Default + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(cmd.Aliases) > 0 {
+		var aliases []string
+		for _, alias := range cmd.Aliases {
+			aliases = append(aliases, prefix+alias)
+		}
+		lines = append(lines, "ALIASES", "    "+strings.Join(aliases, ", "))
+	}
+	if len(cmd.Examples) > 0 {
+		lines = append(lines, "EXAMPLES")
+		for _, ex := range cmd.Examples {
+			lines = append(lines, "    "+prefix+ex)
+		}
+	}
+	return
+}
@@ -0,0 +1,281 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the per-user input history. Every line entered at the input
+box is recorded, while answers to prompts such as passwords never pass through
+here. Logged in users have their history saved. The browser recalls lines with
+the history and search control packets, and !! and !n rerun earlier lines.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+// maxHistory is the number of lines kept per user.
+const maxHistory = 500
+
+var historyDB *db.Col
+
+// historyLock serialises updates to a user's stored history, which several
+// sessions may append to at once.
+var historyLock sync.Mutex
+
+var historyReg = regexp.MustCompile(`^!(!|-?[0-9]+)`)
+
+// historyRecord is the stored history of a user.
+type historyRecord struct {
+	UserID int
+	Lines  []string
+}
+
+func init() {
+	controls["history"] = func(c *client, p packet) error {
+		n, _ := strconv.Atoi(p.Data["N"])
+		if n > len(c.history) {
+			n = len(c.history)
+		}
+		r := newPacket("history")
+		r.Data["Selector"] = "#msg-txt"
+		r.Data["N"] = strconv.Itoa(n)
+		if line, ok := c.historyLine(n); ok {
+			r.Data["Value"] = line
+		}
+		return c.send(r)
+	}
+	controls["search"] = func(c *client, p packet) error {
+		n, _ := strconv.Atoi(p.Data["N"])
+		r := newPacket("search")
+		r.Data["Selector"] = "#msg-txt"
+		r.Data["N"] = "0"
+		query := strings.ToLower(p.Data["Query"])
+		for n++; n <= len(c.history); n++ {
+			if line, _ := c.historyLine(n); strings.Contains(strings.ToLower(line), query) {
+				r.Data["N"] = strconv.Itoa(n)
+				r.Data["Value"] = line
+				break
+			}
+		}
+		return c.send(r)
+	}
+}
+
+// loadHistoryDB opens the history collection, creating it if needed.
+func loadHistoryDB() (e error) {
+	historyDB, e = openCollection("history", "UserID")
+	return
+}
+
+// storedHistory returns the document ID and record of the history of the
+// user. The ID is 0 if nothing has been stored yet.
+func storedHistory(userID int) (id int, r historyRecord, e error) {
+	ids, e := eq("UserID", userID).run(historyDB)
+	if e != nil || len(ids) == 0 {
+		return
+	}
+	doc, e := historyDB.Read(ids[0])
+	if e != nil {
+		return
+	}
+	e = decodeDoc("history", ids[0], doc, &r)
+	return ids[0], r, e
+}
+
+// loadHistory returns the saved history of the user.
+func loadHistory(userID int) []string {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	_, r, err := storedHistory(userID)
+	if err != nil {
+		log.Println(err)
+	}
+	return r.Lines
+}
+
+// saveHistory appends line to the saved history of the user.
+func saveHistory(userID int, line string) (e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	id, r, e := storedHistory(userID)
+	if e != nil {
+		return
+	}
+	r.UserID = userID
+	r.Lines = capHistory(append(r.Lines, line))
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	if id == 0 {
+		_, e = historyDB.Insert(doc)
+		return
+	}
+	return historyDB.Update(id, doc)
+}
+
+// clearHistory removes the saved history of the user.
+func clearHistory(userID int) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	deleteHistory(userID)
+}
+
+// deleteHistory is clearHistory for callers already holding dbLock.
+func deleteHistory(userID int) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	ids, err := eq("UserID", userID).run(historyDB)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, id := range ids {
+		if err := historyDB.Delete(id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// pruneHistory deletes the saved history of users last seen before cutoff,
+// and of accounts that no longer exist, and returns how many were deleted.
+func pruneHistory(cutoff time.Time) (n int, e error) {
+	users := make(map[int]int) // user ID to document ID
+	dbLock.RLock()
+	historyDB.ForEachDoc(func(id int, doc []byte) bool {
+		var r historyRecord
+		if err := decodeJSON("history", id, doc, &r); err != nil {
+			log.Println(err)
+		} else {
+			users[r.UserID] = id
+		}
+		return true
+	})
+	dbLock.RUnlock()
+	for userID, id := range users {
+		if r, err := userByID(userID); err == nil && !r.LastSeen.Before(cutoff) {
+			continue
+		}
+		dbLock.RLock()
+		historyLock.Lock()
+		err := historyDB.Delete(id)
+		historyLock.Unlock()
+		dbLock.RUnlock()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return
+}
+
+// capHistory drops the oldest lines beyond maxHistory.
+func capHistory(lines []string) []string {
+	if len(lines) > maxHistory {
+		return lines[len(lines)-maxHistory:]
+	}
+	return lines
+}
+
+// addHistory records line unless it repeats the previous line. Lines running
+// a command with a secret param are kept for the session but not saved.
+func (c *client) addHistory(line string) {
+	if n := len(c.history); n > 0 && c.history[n-1] == line {
+		return
+	}
+	c.history = capHistory(append(c.history, line))
+	if c.user.auth && !c.secretLine(line, 0) {
+		if err := saveHistory(c.user.ID, line); err != nil {
+			log.Println("history error:", err)
+		}
+	}
+}
+
+// secretLine returns true if a command of line, or of an alias it runs, has a
+// secret param. depth tracks alias expansion.
+func (c *client) secretLine(line string, depth int) bool {
+	if c.cmdPrefix != "" && depth == 0 {
+		if !strings.HasPrefix(line, c.cmdPrefix) {
+			return false
+		}
+		line = line[len(c.cmdPrefix):]
+	}
+	for _, text := range splitUnquoted(line, ';') {
+		for _, job := range splitWord(text, '&') {
+			for _, stage := range splitUnquoted(job, '|') {
+				words, err := lex(stage)
+				if err != nil {
+					// it won't run, but keep whatever it holds unsaved
+					return true
+				}
+				if len(words) == 0 {
+					continue
+				}
+				name := strings.ToLower(words[0])
+				if cmd, ok := (*c.command)[name]; ok {
+					if cmd.secret() {
+						return true
+					}
+				} else if expansion, ok := c.aliases[name]; ok && depth < maxAliasDepth &&
+					c.secretLine(substitute(expansion, words[1:]), depth+1) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// historyLine returns the line n lines back, 1 being the most recent.
+func (c *client) historyLine(n int) (string, bool) {
+	if n < 1 || n > len(c.history) {
+		return "", false
+	}
+	return c.history[len(c.history)-n], true
+}
+
+// expandHistory replaces a leading !! (the previous line), !n (line n) or !-n
+// (the line n back) with that line from the history. The rest of line is
+// appended to it. Chat messages are not expanded.
+func (c *client) expandHistory(line string) (string, error) {
+	body := line
+	if c.cmdPrefix != "" {
+		if !strings.HasPrefix(line, c.cmdPrefix) {
+			return line, nil
+		}
+		body = line[len(c.cmdPrefix):]
+	}
+	m := historyReg.FindStringSubmatch(body)
+	if m == nil {
+		return line, nil
+	}
+	n := 1
+	if m[1] != "!" {
+		n, _ = strconv.Atoi(m[1])
+		if n > 0 {
+			// count from the start of the history
+			n = len(c.history) - n + 1
+		} else {
+			n = -n
+		}
+	}
+	expanded, ok := c.historyLine(n)
+	if !ok {
+		return "", errors.New(m[0] + ": event not found")
+	}
+	expanded += body[len(m[0]):]
+	return expanded, c.appendMsg("#msg-list", expanded)
+}
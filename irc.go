@@ -0,0 +1,596 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the IRC gateway, which lets IRC clients onto chat servers.
+It speaks the part of RFC 1459/2812 a client needs to chat: NICK, USER and PASS
+to log into an account, JOIN, PART, PRIVMSG, NAMES and TOPIC on channels named
+after chat servers (#lobby is the lobby server), QUIT and PING. IRC users are
+members of the same hubs as browser clients.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxIRCLine      = 512 // bytes, as in RFC 2812
+	maxIRCText      = 400 // bytes of a message per PRIVMSG sent
+	maxIRCChannels  = 20
+	ircPingEvery    = 90 * time.Second
+	ircTimeout      = 4 * time.Minute // without hearing from the client
+	ircWriteTimeout = 10 * time.Second
+	ircMessageGap   = 500 * time.Millisecond // between messages from a client
+)
+
+// errQuit ends an IRC connection.
+var errQuit = errors.New("quit")
+
+// ircConn is a connection to the IRC gateway. Its session is a client
+// without a websocket, messages shown to it are sent as notices.
+type ircConn struct {
+	*client
+	conn    net.Conn
+	name    string // given with NICK before logging in
+	pass    string
+	gotUser bool
+	rooms   map[string]bool // chat servers joined
+	next    time.Time       // when the next message may be sent
+	wlock   sync.Mutex      // serialises writes to conn
+	closed  bool
+}
+
+// ircCommand handles a command sent by an IRC client.
+type ircCommand struct {
+	registered bool // only after logging in
+	handler    func(ic *ircConn, params []string) error
+}
+
+// ircCommands are keyed by upper case command name.
+var ircCommands = make(map[string]ircCommand)
+
+// listenIRC serves the IRC gateway over TLS at addr.
+func listenIRC(addr string) {
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatal("IRC:", err)
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		log.Fatal("IRC:", err)
+	}
+	fmt.Println("IRC gateway listening at " + addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("IRC:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveIRC(conn)
+	}
+}
+
+// serveIRC reads commands from an IRC client until it quits or goes quiet.
+func serveIRC(conn net.Conn) {
+	defer conn.Close()
+	ic := &ircConn{client: &client{id: newSessionID(), address: conn.RemoteAddr().String()},
+		conn: conn, rooms: make(map[string]bool)}
+	ic.irc = ic
+	sessions.add(ic.client)
+	defer sessions.remove(ic.client)
+	log.Println(ic.address, "IRC connected")
+	done := make(chan struct{})
+	defer close(done)
+	go ic.pinger(done)
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), 4096)
+	var err error
+	for err == nil {
+		conn.SetReadDeadline(time.Now().Add(ircTimeout))
+		if !scanner.Scan() {
+			err = scanner.Err()
+			break
+		}
+		line := scanner.Text()
+		if len(line) > maxIRCLine {
+			ic.reply("417", "Input line was too long")
+			continue
+		}
+		cmd, params := parseIRC(line)
+		if cmd == "" {
+			continue
+		}
+		c, ok := ircCommands[cmd]
+		if !ok {
+			ic.reply("421", cmd, "Unknown command")
+		} else if c.registered && !ic.user.auth {
+			ic.reply("451", "You have not registered")
+		} else {
+			err = c.handler(ic, params)
+		}
+	}
+	if err != nil && err != errQuit {
+		log.Println(ic.address, "IRC:", err)
+	}
+	for room := range ic.rooms {
+		part(room, ic)
+	}
+	ic.write("ERROR :Closing link")
+	ic.user.logout()
+	log.Println(ic.address, "IRC disconnected")
+}
+
+// pinger pings the client now and then so a dead connection times out.
+func (ic *ircConn) pinger(done chan struct{}) {
+	t := time.NewTicker(ircPingEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			ic.write("PING :" + *hostname)
+		}
+	}
+}
+
+// parseIRC splits line into its upper case command and parameters, dropping
+// any prefix.
+func parseIRC(line string) (cmd string, params []string) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return
+		}
+		line = line[i+1:]
+	}
+	for {
+		if line = strings.TrimLeft(line, " "); line == "" {
+			break
+		}
+		if line[0] == ':' {
+			params = append(params, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			params = append(params, line)
+			break
+		}
+		params = append(params, line[:i])
+		line = line[i:]
+	}
+	if len(params) == 0 {
+		return
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// write sends a line to the client. After a failed write the connection is
+// closed and further writes are dropped.
+func (ic *ircConn) write(line string) {
+	ic.wlock.Lock()
+	defer ic.wlock.Unlock()
+	if ic.closed {
+		return
+	}
+	ic.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := ic.conn.Write([]byte(line + "\r\n")); err != nil {
+		ic.closed = true
+		ic.conn.Close()
+	}
+}
+
+// close sends the client reason and closes the connection, which ends the
+// session.
+func (ic *ircConn) close(reason string) {
+	ic.write("ERROR :" + ircText(reason))
+	ic.wlock.Lock()
+	defer ic.wlock.Unlock()
+	ic.closed = true
+	ic.conn.Close()
+}
+
+// notice shows the text of p, a packet sent to the session, as a notice.
+// Packets without text mean nothing to IRC and are dropped.
+func (ic *ircConn) notice(p packet) error {
+	if p.Type != "appendElement" {
+		return nil
+	}
+	for _, text := range ircSplit(p.Data["Text"]) {
+		ic.write(":" + *hostname + " NOTICE " + ic.nick() + " :" + text)
+	}
+	return nil
+}
+
+// reply sends a numeric reply. The last parameter is sent as the trailing
+// one.
+func (ic *ircConn) reply(code string, params ...string) {
+	line := ":" + *hostname + " " + code + " " + ic.nick()
+	for i, p := range params {
+		if i == len(params)-1 {
+			p = ":" + p
+		}
+		line += " " + p
+	}
+	ic.write(line)
+}
+
+func (ic *ircConn) sessionID() string { return ic.id }
+
+func (ic *ircConn) nick() string {
+	if ic.user.auth {
+		return ic.user.Name
+	}
+	if ic.name != "" {
+		return ic.name
+	}
+	return "*"
+}
+
+// deliver shows m on its channel. Messages the client sent itself are not
+// echoed.
+func (ic *ircConn) deliver(m roomMessage) {
+	prefix, channel := ":"+ircMask(m.From), "#"+m.Room
+	switch m.Kind {
+	case "join":
+		ic.write(prefix + " JOIN " + channel)
+		if m.Session == ic.id {
+			ic.sendTopic(m.Room)
+			ic.sendNames(m.Room)
+		}
+	case "part":
+		ic.write(prefix + " PART " + channel)
+	case "nick":
+		ic.write(prefix + " NICK " + ircNick(m.Text))
+	case "topic":
+		ic.write(prefix + " TOPIC " + channel + " :" + ircText(m.Text))
+	case "message":
+		if m.Session == ic.id {
+			return
+		}
+		for _, text := range ircSplit(m.Text) {
+			ic.write(prefix + " PRIVMSG " + channel + " :" + text)
+		}
+	}
+}
+
+// ircMask returns the nick!user@host prefix of a chat server member.
+func ircMask(name string) string {
+	name = ircNick(name)
+	return name + "!" + strings.ToLower(name) + "@" + *hostname
+}
+
+// ircNick returns name as an IRC nick. Users on linked servers (name@host)
+// become name|host, and anything that would break the line is dropped.
+func ircNick(name string) string {
+	return strings.NewReplacer("@", "|", "!", "|", " ", "_", "\r", "", "\n", "", "\x00", "").Replace(name)
+}
+
+// ircText removes the characters that would break an IRC line from text.
+func ircText(text string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ", "\x00", "").Replace(text)
+}
+
+// ircSplit returns text made safe for IRC in pieces short enough to send.
+func ircSplit(text string) (list []string) {
+	text = ircText(text)
+	for text != "" {
+		n := len(text)
+		if n > maxIRCText {
+			for n = maxIRCText; n > 0 && !utf8.RuneStart(text[n]); n-- {
+			}
+		}
+		list = append(list, text[:n])
+		text = text[n:]
+	}
+	return
+}
+
+// ircSource returns the nick line was sent by, "" if it has no prefix.
+func ircSource(line string) string {
+	if !strings.HasPrefix(line, ":") {
+		return ""
+	}
+	source := strings.SplitN(line[1:], " ", 2)[0]
+	return strings.SplitN(source, "!", 2)[0]
+}
+
+// room returns the chat server joined as channel.
+func (ic *ircConn) room(channel string) (string, bool) {
+	for room := range ic.rooms {
+		if strings.EqualFold("#"+room, channel) {
+			return room, true
+		}
+	}
+	return "", false
+}
+
+// channelRoom returns the chat server for channel, matching an open one
+// regardless of case.
+func channelRoom(channel string) (string, bool) {
+	name := strings.TrimPrefix(channel, "#")
+	if len(channel) < 2 || channel[0] != '#' || !isName(name) || len(name) > 50 {
+		return "", false
+	}
+	for _, open := range servers.names() {
+		if strings.EqualFold(open, name) {
+			return open, true
+		}
+	}
+	return name, true
+}
+
+// sendTopic sends the topic of room.
+func (ic *ircConn) sendTopic(room string) {
+	topic, err := getTopic(room)
+	if err != nil {
+		log.Println(err)
+	}
+	if topic == "" {
+		ic.reply("331", "#"+room, "No topic is set")
+	} else {
+		ic.reply("332", "#"+room, ircText(topic))
+	}
+}
+
+// sendNames sends the names of the members of room.
+func (ic *ircConn) sendNames(room string) {
+	var names []string
+	if s, ok := servers.get(room); ok {
+		for _, name := range s.nicks() {
+			names = append(names, ircNick(name))
+		}
+	}
+	for len(names) > 0 {
+		n := len(names)
+		if n > 20 {
+			n = 20
+		}
+		ic.reply("353", "=", "#"+room, strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	ic.reply("366", "#"+room, "End of NAMES list")
+}
+
+// register logs the connection into the account named by NICK with the PASS
+// password once both NICK and USER have been sent. Accounts with two-factor
+// authentication take the code after the password, as password:code.
+func (ic *ircConn) register() error {
+	if ic.name == "" || !ic.gotUser {
+		return nil
+	}
+	name, pass := ic.name, ic.pass
+	ic.pass = ""
+	if pass == "" {
+		ic.reply("464", "Log in with PASS <password> and your account name as NICK")
+		return errQuit
+	}
+	if wait := guard.wait(name, ic.address); wait > 0 {
+		audit("login blocked", name, ic.address, "irc")
+		ic.reply("464", fmt.Sprintf("Too many failed logins. Try again in %s.", wait.Round(time.Second)))
+		return errQuit
+	}
+	noCode := func() (string, error) {
+		return "", errors.New("Authentication code required.")
+	}
+	err := ic.user.login(name, pass, noCode)
+	if i := strings.LastIndex(pass, ":"); err != nil && i >= 0 {
+		err = ic.user.login(name, pass[:i], func() (string, error) {
+			return pass[i+1:], nil
+		})
+	}
+	if err != nil {
+		audit("login failed", name, ic.address, "irc: "+err.Error())
+		for _, event := range guard.fail(name, ic.address) {
+			audit(event, name, ic.address, "")
+		}
+		ic.reply("464", "Login failed")
+		return errQuit
+	}
+	if n := guard.succeed(name); n > 0 {
+		audit("login", name, ic.address, fmt.Sprintf("irc, after %d failed attempts", n))
+	}
+	if ic.user.Name != name {
+		ic.write(":" + ircMask(name) + " NICK " + ic.user.Name)
+	}
+	ic.reply("001", "Welcome to soshell, "+ic.user.Name)
+	ic.reply("002", "Your host is "+*hostname)
+	ic.reply("004", *hostname, "soshell", "o", "t")
+	lines, err := renderMotd("", motdData{Name: ic.user.Name, Online: len(sessions.names()),
+		Host: *hostname, Time: time.Now()})
+	if err != nil {
+		log.Println("motd:", err)
+	}
+	if len(lines) == 0 {
+		ic.reply("422", "MOTD File is missing")
+		return nil
+	}
+	ic.reply("375", "- "+*hostname+" Message of the day -")
+	for _, line := range lines {
+		ic.reply("372", "- "+ircText(line))
+	}
+	ic.reply("376", "End of MOTD command")
+	return nil
+}
+
+func init() {
+	ircCommands["PASS"] = ircCommand{handler: func(ic *ircConn, params []string) error {
+		if ic.user.auth {
+			ic.reply("462", "You may not reregister")
+		} else if len(params) == 0 {
+			ic.reply("461", "PASS", "Not enough parameters")
+		} else {
+			ic.pass = params[0]
+		}
+		return nil
+	}}
+	ircCommands["NICK"] = ircCommand{handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			ic.reply("431", "No nickname given")
+			return nil
+		}
+		if ic.user.auth {
+			if !strings.EqualFold(params[0], ic.user.Name) {
+				ic.reply("432", params[0], "Your nick is your account name, use rename to change it")
+			}
+			return nil
+		}
+		if !isName(params[0]) || len(params[0]) > 32 {
+			ic.reply("432", params[0], "Erroneous nickname")
+			return nil
+		}
+		ic.name = params[0]
+		return ic.register()
+	}}
+	ircCommands["USER"] = ircCommand{handler: func(ic *ircConn, params []string) error {
+		if ic.user.auth {
+			ic.reply("462", "You may not reregister")
+			return nil
+		}
+		if len(params) < 4 {
+			ic.reply("461", "USER", "Not enough parameters")
+			return nil
+		}
+		ic.gotUser = true
+		return ic.register()
+	}}
+	ircCommands["PING"] = ircCommand{handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			ic.reply("409", "No origin specified")
+		} else {
+			ic.write(":" + *hostname + " PONG " + *hostname + " :" + params[0])
+		}
+		return nil
+	}}
+	ircCommands["PONG"] = ircCommand{handler: func(ic *ircConn, params []string) error {
+		return nil
+	}}
+	ircCommands["QUIT"] = ircCommand{handler: func(ic *ircConn, params []string) error {
+		return errQuit
+	}}
+	ircCommands["JOIN"] = ircCommand{registered: true, handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			ic.reply("461", "JOIN", "Not enough parameters")
+			return nil
+		}
+		if params[0] == "0" {
+			for room := range ic.rooms {
+				delete(ic.rooms, room)
+				part(room, ic)
+			}
+			return nil
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			if _, ok := ic.room(channel); ok {
+				continue
+			}
+			room, ok := channelRoom(channel)
+			if !ok {
+				ic.reply("403", channel, "No such channel")
+			} else if len(ic.rooms) >= maxIRCChannels {
+				ic.reply("405", channel, "You have joined too many channels")
+			} else {
+				ic.rooms[room] = true
+				join(room, ic)
+			}
+		}
+		return nil
+	}}
+	ircCommands["PART"] = ircCommand{registered: true, handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			ic.reply("461", "PART", "Not enough parameters")
+			return nil
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			room, ok := ic.room(channel)
+			if !ok {
+				ic.reply("442", channel, "You're not on that channel")
+				continue
+			}
+			delete(ic.rooms, room)
+			part(room, ic)
+		}
+		return nil
+	}}
+	ircCommands["PRIVMSG"] = ircCommand{registered: true, handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			ic.reply("411", "No recipient given (PRIVMSG)")
+			return nil
+		}
+		if len(params) < 2 || params[1] == "" {
+			ic.reply("412", "No text to send")
+			return nil
+		}
+		room, ok := ic.room(params[0])
+		if !ok {
+			if strings.HasPrefix(params[0], "#") {
+				ic.reply("404", params[0], "Cannot send to channel")
+			} else {
+				ic.reply("401", params[0], "No such nick/channel")
+			}
+			return nil
+		}
+		text := params[1]
+		if strings.HasPrefix(text, "\x01") {
+			// CTCP, of which only actions make sense to browser users
+			if !strings.HasPrefix(text, "\x01ACTION ") {
+				return nil
+			}
+			text = "* " + strings.TrimSuffix(text[len("\x01ACTION "):], "\x01")
+		}
+		if wait := time.Until(ic.next); wait > 0 {
+			time.Sleep(wait)
+		}
+		ic.next = time.Now().Add(ircMessageGap)
+		servers.broadcast(room, roomMessage{Kind: "message", From: ic.user.Name, Text: text,
+			Origin: "irc", Session: ic.id})
+		return nil
+	}}
+	ircCommands["NAMES"] = ircCommand{registered: true, handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			for room := range ic.rooms {
+				ic.sendNames(room)
+			}
+			return nil
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			if room, ok := channelRoom(channel); ok {
+				ic.sendNames(room)
+			} else {
+				ic.reply("366", channel, "End of NAMES list")
+			}
+		}
+		return nil
+	}}
+	ircCommands["TOPIC"] = ircCommand{registered: true, handler: func(ic *ircConn, params []string) error {
+		if len(params) == 0 {
+			ic.reply("461", "TOPIC", "Not enough parameters")
+			return nil
+		}
+		room, ok := ic.room(params[0])
+		if !ok {
+			ic.reply("442", params[0], "You're not on that channel")
+		} else if len(params) == 1 {
+			ic.sendTopic(room)
+		} else if err := setTopic(room, params[1], ic.user.Name, ic.id); err != nil {
+			ic.write(":" + *hostname + " NOTICE " + ic.nick() + " :" + err.Error())
+		}
+		return nil
+	}}
+}
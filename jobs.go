@@ -0,0 +1,259 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains jobs. Every line of commands runs as a job with its own
+context. Lines ending in & run in the background while the client keeps
+reading input, and their output is tagged with the job ID. The foreground job
+is cancelled by the cancel control packet the browser sends on Ctrl-C.
+*/
+
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxJobs limits the background jobs a client can have at once.
+const maxJobs = 10
+
+var errCancelled = errors.New("Cancelled.")
+
+// job is a line of commands being run.
+type job struct {
+	ID      int // 0 for lines run in the foreground
+	Line    string
+	Started time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	who     identity // of a background job
+}
+
+// identity is who a background job runs as. It is copied from the client
+// when the job starts, so the job never reads the fields of the client that
+// foreground commands such as login, connect and nick change under it.
+type identity struct {
+	user      user
+	server    string
+	command   *commandSet
+	cmdPrefix string
+	aliases   map[string]string
+}
+
+// identity returns who c is now. It must be called from the goroutine that
+// reads the input of c.
+func (c *client) identity() identity {
+	return identity{user: c.user, server: c.server, command: c.command, cmdPrefix: c.cmdPrefix, aliases: c.aliases}
+}
+
+// who returns who a command run with ctx runs as: the identity its job
+// started with if it runs in the background, else the client as it is.
+func (c *client) who(ctx context.Context) identity {
+	if j := jobOf(ctx); j.background() {
+		return j.who
+	}
+	return c.identity()
+}
+
+// jobKey is the context key of the job a context belongs to.
+type jobKey struct{}
+
+// jobOf returns the job ctx belongs to, if any.
+func jobOf(ctx context.Context) *job {
+	j, _ := ctx.Value(jobKey{}).(*job)
+	return j
+}
+
+// background returns true if j was started with &.
+func (j *job) background() bool {
+	return j != nil && j.ID != 0
+}
+
+// jobTable holds the jobs of a client.
+type jobTable struct {
+	sync.Mutex
+	next int
+	m    map[int]*job
+	fg   *job
+}
+
+// newJob returns a job for line. Background jobs are added to the table.
+func (t *jobTable) newJob(line string, bg bool) (j *job, e error) {
+	j = &job{Line: line, Started: time.Now(), done: make(chan struct{})}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	j.ctx = context.WithValue(j.ctx, jobKey{}, j)
+	if !bg {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if len(t.m) >= maxJobs {
+		j.cancel()
+		return nil, fmt.Errorf("You can have at most %d jobs.", maxJobs)
+	}
+	if t.m == nil {
+		t.m = make(map[int]*job)
+	}
+	t.next++
+	j.ID = t.next
+	t.m[j.ID] = j
+	return
+}
+
+// finish marks j as done and removes it from the table.
+func (t *jobTable) finish(j *job) {
+	t.Lock()
+	delete(t.m, j.ID)
+	if t.fg == j {
+		t.fg = nil
+	}
+	t.Unlock()
+	j.cancel()
+	close(j.done)
+}
+
+// foreground makes j the job cancelled by Ctrl-C and returns the previous one.
+func (t *jobTable) foreground(j *job) (prev *job) {
+	t.Lock()
+	defer t.Unlock()
+	prev, t.fg = t.fg, j
+	return
+}
+
+// current returns the foreground job, if any.
+func (t *jobTable) current() *job {
+	t.Lock()
+	defer t.Unlock()
+	return t.fg
+}
+
+// get returns the background job with id, or the newest one if id is 0.
+func (t *jobTable) get(id int) (*job, bool) {
+	t.Lock()
+	defer t.Unlock()
+	if id == 0 {
+		for n := range t.m {
+			if n > id {
+				id = n
+			}
+		}
+	}
+	j, ok := t.m[id]
+	return j, ok
+}
+
+// list returns the background jobs ordered by ID.
+func (t *jobTable) list() (jobs []*job) {
+	t.Lock()
+	for _, j := range t.m {
+		jobs = append(jobs, j)
+	}
+	t.Unlock()
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return
+}
+
+// cancelAll cancels every job, as when the client disconnects.
+func (t *jobTable) cancelAll() {
+	t.Lock()
+	defer t.Unlock()
+	for _, j := range t.m {
+		j.cancel()
+	}
+	if t.fg != nil {
+		t.fg.cancel()
+	}
+}
+
+// stopBackground cancels the background jobs and waits for them to finish,
+// as before the client logs in or out.
+func (t *jobTable) stopBackground() {
+	t.Lock()
+	var jobs []*job
+	for _, j := range t.m {
+		j.cancel()
+		jobs = append(jobs, j)
+	}
+	t.Unlock()
+	for _, j := range jobs {
+		<-j.done
+	}
+}
+
+// jobOutput tags each line written by a background job with its ID.
+type jobOutput struct {
+	out output
+	j   *job
+}
+
+func (o jobOutput) writeLine(text string) error {
+	if err := o.j.ctx.Err(); err != nil {
+		return errCancelled
+	}
+	return o.out.writeLine(fmt.Sprintf("[%d] %s", o.j.ID, text))
+}
+
+// runJob runs line as job j and reports how a background job ended.
+func (c *client) runJob(j *job, line string) (e error) {
+	defer c.jobs.finish(j)
+	var out output = msgOutput{c}
+	if j.background() {
+		out = jobOutput{out, j}
+	}
+	count := 0
+	e = c.runLine(j.ctx, line, nil, out, 0, &count)
+	if e == nil && j.ctx.Err() != nil {
+		e = errCancelled
+	}
+	if !j.background() {
+		return
+	}
+	switch {
+	case e == errCancelled || e == context.Canceled:
+		c.appendMsg("#msg-list", fmt.Sprintf("[%d] Killed: %s", j.ID, line))
+	case e != nil:
+		c.appendMsg("#msg-list", fmt.Sprintf("[%d] Failed: %s: %s", j.ID, line, e))
+	default:
+		c.appendMsg("#msg-list", fmt.Sprintf("[%d] Done: %s", j.ID, line))
+	}
+	return nil
+}
+
+// runForeground runs line as a foreground job and waits for it.
+func (c *client) runForeground(line string) error {
+	j, _ := c.jobs.newJob(line, false)
+	prev := c.jobs.foreground(j)
+	defer c.jobs.foreground(prev)
+	return c.runJob(j, line)
+}
+
+// runBackground starts line as a background job.
+func (c *client) runBackground(line string) error {
+	j, err := c.jobs.newJob(line, true)
+	if err != nil {
+		return err
+	}
+	if err = c.appendMsg("#msg-list", fmt.Sprintf("[%d] %s", j.ID, line)); err != nil {
+		c.jobs.finish(j)
+		return err
+	}
+	j.who = c.identity()
+	go c.runJob(j, line)
+	return nil
+}
+
+// completeJobs returns the IDs of the background jobs of c.
+func completeJobs(c *client) (list []string) {
+	for _, j := range c.jobs.list() {
+		list = append(list, fmt.Sprint(j.ID))
+	}
+	return
+}
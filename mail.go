@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the mailer used to send account emails. Mail is delivered
+over SMTP when -smtp is set, otherwise it is written as .eml files to -maildir
+which is handy for local testing.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mailer sends a plain text email.
+type mailer interface {
+	send(to, subject, body string) error
+}
+
+// mail is the mailer selected by the command line flags.
+var mail mailer
+
+// message formats an RFC 5322 message.
+func message(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// smtpMailer delivers mail through an SMTP server.
+type smtpMailer struct {
+	addr, from string
+	auth       smtp.Auth
+}
+
+func (m smtpMailer) send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, message(m.from, to, subject, body))
+}
+
+// fileMailer writes each message as a .eml file in dir.
+type fileMailer struct {
+	dir, from string
+}
+
+func (m fileMailer) send(to, subject, body string) error {
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(to, "@", "_at_", -1))
+	return ioutil.WriteFile(filepath.Join(m.dir, name), message(m.from, to, subject, body), 0600)
+}
+
+// setupMail selects the mailer from the command line flags.
+func setupMail() {
+	from := *mailFrom
+	if from == "" {
+		from = "soshell@" + *hostname
+	}
+	if *smtpAddr != "" {
+		var auth smtp.Auth
+		if *smtpUser != "" {
+			host, _, _ := net.SplitHostPort(*smtpAddr)
+			auth = smtp.PlainAuth("", *smtpUser, *smtpPass, host)
+		}
+		mail = smtpMailer{addr: *smtpAddr, from: from, auth: auth}
+		return
+	}
+	dir := *mailDir
+	if dir == "" {
+		dir = *dbpath + SEP + "mail"
+	}
+	mail = fileMailer{dir: dir, from: from}
+}
@@ -13,8 +13,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
 	"text/template"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -23,14 +23,30 @@ import (
 const SEP = string(os.PathSeparator)
 
 var (
-	httpPort    = flag.String("http", "80", "http service address")
-	httpsPort   = flag.String("https", "443", "https service address")
-	hostname    = flag.String("host", "localhost", "domain or host name")
-	dbpath      = flag.String("dbpath", "database", "database path")
-	certFile    = flag.String("cert", "cert.pem", "SSL certificate file")
-	keyFile     = flag.String("key", "key.pem", "SSL key file")
-	public      = flag.String("public", "public", "public web directory")
-	clientTempl *template.Template
+	httpPort      = flag.String("http", "80", "http service address")
+	httpsPort     = flag.String("https", "443", "https service address")
+	hostname      = flag.String("host", "localhost", "domain or host name")
+	dbpath        = flag.String("dbpath", "database", "database path")
+	certFile      = flag.String("cert", "cert.pem", "SSL certificate file")
+	keyFile       = flag.String("key", "key.pem", "SSL key file")
+	public        = flag.String("public", "public", "public web directory")
+	admins        = flag.String("admins", "", "comma separated list of admin user names")
+	backupPath    = flag.String("backups", "", "backup directory (default <dbpath>/backups)")
+	backupEvery   = flag.Duration("backup-every", 0, "interval between scheduled backups (0 disables)")
+	backupKeep    = flag.Int("backup-keep", 7, "number of scheduled backups to keep")
+	smtpAddr      = flag.String("smtp", "", "SMTP server address (host:port) for outgoing mail")
+	smtpUser      = flag.String("smtp-user", "", "SMTP user name")
+	smtpPass      = flag.String("smtp-pass", "", "SMTP password")
+	mailFrom      = flag.String("mail-from", "", "sender address for outgoing mail (default soshell@<host>)")
+	mailDir       = flag.String("maildir", "", "directory mail is written to when -smtp is not set (default <dbpath>/mail)")
+	pluginPath    = flag.String("plugins", "", "directory of plugin executables (empty disables plugins)")
+	pluginTimeout = flag.Duration("plugin-timeout", 30*time.Second, "time a plugin may take to respond")
+	scriptTimeout = flag.Duration("script-timeout", 2*time.Second, "longest a script may run")
+	scriptMemory  = flag.Int("script-memory", 64, "megabytes the heap may grow by while a script runs")
+	motdFile      = flag.String("motd", "", "file the message of the day is read from when none is set with motd set")
+	ircAddr       = flag.String("irc", "", "address the IRC gateway listens at over TLS, e.g. :6697 (empty disables)")
+	peerAddr      = flag.String("federation", "", "address linked soshell servers connect to over TLS, e.g. :7443 (empty disables)")
+	clientTempl   *template.Template
 )
 
 // isTLS checks for TLS and returns true if handshake is complete or false if not.
@@ -41,17 +57,6 @@ func isTLS(r *http.Request) bool {
 	return false
 }
 
-// getArgs splits a slice of bytes into a slice of string arguments.
-// Anything in '', "", or `` are consider a single argument (including spaces).
-func getArgs(b []byte) (s []string) {
-	re := regexp.MustCompile("`([\\S\\s]*)`|('([\\S \\t\\r]*)'|\"([\\S ]*)\"|\\S+)")
-	args := re.FindAllSubmatch(b, -1)
-	for _, val := range args {
-		s = append(s, string(val[0]))
-	}
-	return
-}
-
 // serveWs serves the websocket and starts the listener on successful connection.
 func serveWs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -71,14 +76,21 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer ws.Close()
-	var c = client{ws: ws, address: ws.RemoteAddr().String(),
+	var c = client{ws: ws, id: newSessionID(), address: ws.RemoteAddr().String(),
 		user: user{Name: guestName()}, command: &sysCommands}
+	sessions.add(&c)
+	defer sessions.remove(&c)
 	log.Println(c.address, r.URL, "connected")
 	c.innerHTML("#status-box", "<b>"+c.user.Name+"</b>")
+	c.showMotd("")
 	e := c.listener()
 	if e != nil && e != io.EOF {
 		log.Println(e)
 	}
+	if c.server != "" {
+		c.disconnect()
+	}
+	c.stopHooks()
 	c.user.logout()
 	log.Println(c.address, "disconnected")
 }
@@ -125,7 +137,10 @@ func pathExists(path string) bool {
 	return true
 }
 
-func init() {
+// setup parses the flags, makes sure the public and database directories
+// exist and loads the client template. It runs from main rather than init so
+// the package can be tested.
+func setup() {
 	flag.Parse()
 	dirs := map[string]os.FileMode{*public: 0755, *dbpath: 0700}
 	for path, perm := range dirs {
@@ -145,13 +160,35 @@ func init() {
 }
 
 func main() {
+	setup()
+	if flag.NArg() > 0 {
+		os.Exit(runSubcommand(flag.Args()))
+	}
 	r := mux.NewRouter()
 	r.HandleFunc("/", serveClient)
 	r.HandleFunc("/ws", serveWs)
+	r.HandleFunc("/hook/{token}", serveHook)
 	https := ":" + *httpsPort
 	http.Handle("/", r)
 	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir(*public))))
-	loadUserDB()
+	if err := loadUserDB(); err != nil {
+		log.Fatal(err)
+	}
+	startServices()
+	setupMail()
+	if dir := pluginDir(); dir != "" {
+		loadPlugins(dir)
+	}
+	go runScheduler()
+	if *ircAddr != "" {
+		go listenIRC(*ircAddr)
+	}
+	if *peerAddr != "" {
+		go listenFederation(*peerAddr)
+	}
+	if *backupEvery > 0 {
+		go backupScheduler(*backupEvery, *backupKeep)
+	}
 	go func() {
 		// cert.pem is ssl.crt + *server.ca.pem
 		fmt.Println("Listening at " + "https://" + *hostname + https)
@@ -170,5 +207,6 @@ func main() {
 	signal.Notify(c, os.Interrupt, os.Kill)
 	s := <-c
 	fmt.Printf("Caught %s signal. Shutting down.\n", s)
+	stopPlugins()
 	closeUserDB()
 }
@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the message of the day, shown when a client connects and
+again after login, and the welcome messages shown on joining a chat server.
+Both are text/template templates stored in the meta collection, see motdData
+for the variables. Without a stored message of the day the -motd file is used.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const maxMotdLen = 4000
+
+// motdLock serialises changes to the messages.
+var motdLock sync.Mutex
+
+// motdData holds the variables of the messages, e.g. {{.Name}}.
+type motdData struct {
+	Name   string // of the user the message is shown to
+	Online int    // users online
+	Room   string // chat server the message is for, "" for the message of the day
+	Host   string
+	Time   time.Time
+}
+
+// motdKey returns the meta key the message for room is stored under. The
+// message of the day has room "".
+func motdKey(room string) string {
+	if room == "" {
+		return "motd"
+	}
+	return "welcome:" + strings.ToLower(room)
+}
+
+// getMotd returns the template of the message for room, "" if there is none.
+func getMotd(room string) (text string, e error) {
+	dbLock.RLock()
+	_, e = getMeta(motdKey(room), &text)
+	dbLock.RUnlock()
+	if e != nil || text != "" || room != "" || *motdFile == "" {
+		return
+	}
+	b, e := ioutil.ReadFile(*motdFile)
+	return string(b), e
+}
+
+// setMotd stores the template of the message for room. An empty text removes
+// the message.
+func setMotd(room, text string) error {
+	if len(text) > maxMotdLen {
+		return fmt.Errorf("Messages may be at most %d characters long.", maxMotdLen)
+	}
+	if _, err := template.New("motd").Parse(text); err != nil {
+		return err
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	motdLock.Lock()
+	defer motdLock.Unlock()
+	return setMeta(motdKey(room), text)
+}
+
+// motd returns the lines of the message for room as c should see it.
+func (c *client) motd(room string) ([]string, error) {
+	return renderMotd(room, motdData{Name: c.user.Name, Online: len(sessions.names()), Room: room,
+		Host: *hostname, Time: time.Now()})
+}
+
+// renderMotd returns the lines of the message for room filled in with data.
+func renderMotd(room string, data motdData) (lines []string, e error) {
+	text, e := getMotd(room)
+	if e != nil || strings.TrimSpace(text) == "" {
+		return
+	}
+	t, e := template.New("motd").Parse(text)
+	if e != nil {
+		return
+	}
+	var b bytes.Buffer
+	if e = t.Execute(&b, data); e != nil {
+		return
+	}
+	return strings.Split(strings.TrimRight(b.String(), "\n"), "\n"), nil
+}
+
+// showMotd shows the message for room, if there is one.
+func (c *client) showMotd(room string) {
+	lines, err := c.motd(room)
+	if err != nil {
+		log.Println("motd:", err)
+	}
+	for _, line := range lines {
+		if err = c.appendMsg("#msg-list", line); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the per-user note store. Notes are named lists of lines
+written by redirecting the output of a command with > note:name and read back
+with the note command.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	maxNotes     = 100  // notes per user
+	maxNoteLines = 1000 // lines per note
+)
+
+var notesDB *db.Col
+
+// noteLock serialises changes to the notes of a user.
+var noteLock sync.Mutex
+
+// noteRecord is the stored form of a note.
+type noteRecord struct {
+	UserID  int
+	Name    string
+	Lines   []string
+	Updated time.Time
+}
+
+// loadNotesDB opens the notes collection, creating it if needed.
+func loadNotesDB() (e error) {
+	notesDB, e = openCollection("notes", "UserID")
+	return
+}
+
+// userNotes returns the notes of the user keyed by document ID. The caller
+// holds dbLock.
+func userNotes(userID int) (notes map[int]noteRecord, e error) {
+	ids, e := eq("UserID", userID).run(notesDB)
+	if e != nil {
+		return
+	}
+	notes = make(map[int]noteRecord)
+	for _, id := range ids {
+		doc, err := notesDB.Read(id)
+		if err != nil {
+			continue
+		}
+		var r noteRecord
+		if err = decodeDoc("notes", id, doc, &r); err != nil {
+			log.Println(err)
+			continue
+		}
+		notes[id] = r
+	}
+	return
+}
+
+// findNote returns the document ID and record of the note called name.
+func findNote(userID int, name string) (id int, r noteRecord, e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return lookupNote(userID, name)
+}
+
+// lookupNote is findNote for callers already holding dbLock.
+func lookupNote(userID int, name string) (id int, r noteRecord, e error) {
+	notes, e := userNotes(userID)
+	if e != nil {
+		return
+	}
+	for id, r := range notes {
+		if r.Name == name {
+			return id, r, nil
+		}
+	}
+	return 0, r, errors.New("No such note: " + name)
+}
+
+// listNotes returns the notes of the user sorted by name.
+func listNotes(userID int) (list []noteRecord, e error) {
+	dbLock.RLock()
+	notes, e := userNotes(userID)
+	dbLock.RUnlock()
+	for _, r := range notes {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return
+}
+
+// saveNote replaces the note called name with lines, or adds them to the end
+// of it when appending.
+func saveNote(userID int, name string, lines []string, appending bool) (e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	noteLock.Lock()
+	defer noteLock.Unlock()
+	notes, e := userNotes(userID)
+	if e != nil {
+		return
+	}
+	id, r := 0, noteRecord{UserID: userID, Name: name}
+	for nid, nr := range notes {
+		if nr.Name == name {
+			id, r = nid, nr
+		}
+	}
+	if id == 0 && len(notes) >= maxNotes {
+		return fmt.Errorf("You can have at most %d notes.", maxNotes)
+	}
+	if appending {
+		lines = append(r.Lines, lines...)
+	}
+	if len(lines) > maxNoteLines {
+		return fmt.Errorf("Notes may be at most %d lines long.", maxNoteLines)
+	}
+	r.Lines = lines
+	r.Updated = time.Now().UTC()
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	if id == 0 {
+		_, e = notesDB.Insert(doc)
+		return
+	}
+	return notesDB.Update(id, doc)
+}
+
+// removeNote deletes the note called name.
+func removeNote(userID int, name string) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	noteLock.Lock()
+	defer noteLock.Unlock()
+	id, _, err := lookupNote(userID, name)
+	if err != nil {
+		return err
+	}
+	return notesDB.Delete(id)
+}
+
+// deleteNotes removes every note of the user. The caller holds dbLock.
+func deleteNotes(userID int) {
+	notes, err := userNotes(userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for id := range notes {
+		if err := notesDB.Delete(id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// completeNotes returns the names of the notes of c.
+func completeNotes(c *client) (list []string) {
+	if !c.user.auth {
+		return
+	}
+	notes, err := listNotes(c.user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, r := range notes {
+		list = append(list, r.Name)
+	}
+	return
+}
@@ -0,0 +1,182 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the shell-like handling of a line of commands. Commands are
+separated by ; and joined into pipelines with |, where each command reads the
+output of the one before it. The output of a pipeline can be saved to a note
+with > note:name or added to one with >> note:name.
+*/
+
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxLineCommands limits the commands a single line, aliases included, runs.
+const maxLineCommands = 32
+
+// output receives the lines written by a command.
+type output interface {
+	writeLine(text string) error
+}
+
+// msgOutput writes lines to the message list of a client.
+type msgOutput struct {
+	c *client
+}
+
+func (o msgOutput) writeLine(text string) error {
+	return o.c.appendMsg("#msg-list", text)
+}
+
+// lineBuffer collects lines for the next command of a pipeline or a note.
+type lineBuffer []string
+
+func (b *lineBuffer) writeLine(text string) error {
+	*b = append(*b, text)
+	return nil
+}
+
+// splitUnquoted splits s at each sep that is not quoted or escaped.
+func splitUnquoted(s string, sep rune) []string {
+	return splitAt(s, sep, false)
+}
+
+// splitWord splits s at each sep that is not quoted or escaped and stands
+// alone, with a space or the end of s on each side. The & in a URL doesn't
+// start a background job.
+func splitWord(s string, sep rune) []string {
+	return splitAt(s, sep, true)
+}
+
+// splitAt splits s at each sep that is not quoted or escaped, and when word
+// is true only where sep stands alone.
+func splitAt(s string, sep rune, word bool) (parts []string) {
+	quote := rune(0)
+	escaped := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'' && quote != '`':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == sep && (!word || alone(s, i, len(string(sep)))):
+			parts = append(parts, s[start:i])
+			start = i + len(string(sep))
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// alone returns true if the n bytes at i in s have a space or the end of s on
+// each side.
+func alone(s string, i, n int) bool {
+	isSpace := func(b byte) bool { return b == ' ' || b == '\t' }
+	return (i == 0 || isSpace(s[i-1])) && (i+n == len(s) || isSpace(s[i+n]))
+}
+
+// runLine runs each command or pipeline of line in turn until ctx is
+// cancelled. The first command of a pipeline reads in and the last writes to
+// out. depth and count track alias expansion.
+func (c *client) runLine(ctx context.Context, line string, in *lineBuffer, out output, depth int, count *int) error {
+	for _, text := range splitUnquoted(line, ';') {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if err := c.runPipeline(ctx, text, in, out, depth, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPipeline runs a single pipeline and its redirection, if any.
+func (c *client) runPipeline(ctx context.Context, text string, in *lineBuffer, out output, depth int, count *int) (e error) {
+	stages := splitUnquoted(text, '|')
+	last := len(stages) - 1
+	note, appending := "", false
+	if parts := splitUnquoted(stages[last], '>'); len(parts) > 1 {
+		switch {
+		case len(parts) == 2:
+		case len(parts) == 3 && parts[1] == "":
+			appending = true
+		default:
+			return errors.New("Bad redirection, use > note:name or >> note:name")
+		}
+		target, err := lex(parts[len(parts)-1])
+		if err != nil {
+			return err
+		}
+		if len(target) != 1 || !strings.HasPrefix(target[0], "note:") {
+			return errors.New("Output can only be redirected to a note, e.g. > note:name")
+		}
+		if note = strings.ToLower(target[0][len("note:"):]); !isName(note) || note == "" {
+			return errors.New("Invalid characters in note name.")
+		}
+		if !c.who(ctx).user.auth {
+			return errors.New("You must be logged in to save notes.")
+		}
+		stages[last] = parts[0]
+	}
+	for i, stage := range stages {
+		words, err := lex(stage)
+		if err != nil {
+			return err
+		}
+		if len(words) == 0 {
+			return errors.New("Missing command in pipeline.")
+		}
+		stageOut := out
+		if i < last || note != "" {
+			stageOut = &lineBuffer{}
+		}
+		if e = c.runStage(ctx, words, in, stageOut, depth, count); e != nil {
+			return
+		}
+		if buf, ok := stageOut.(*lineBuffer); ok {
+			in = buf
+		}
+	}
+	if note != "" {
+		if e = saveNote(c.who(ctx).user.ID, note, *in, appending); e == nil {
+			e = out.writeLine(fmt.Sprintf("Saved %d lines to note:%s", len(*in), note))
+		}
+	}
+	return
+}
+
+// runStage runs a single command, expanding it first if it is an alias.
+// Registered commands take precedence over aliases of the same name.
+func (c *client) runStage(ctx context.Context, words []string, in *lineBuffer, out output, depth int, count *int) error {
+	name := strings.ToLower(words[0])
+	who := c.who(ctx)
+	if _, isCmd := (*who.command)[name]; !isCmd {
+		if expansion, ok := who.aliases[name]; ok {
+			if depth >= maxAliasDepth {
+				return errors.New("Alias " + name + " nests too deeply. Does it refer to itself?")
+			}
+			return c.runLine(ctx, substitute(expansion, words[1:]), in, out, depth+1, count)
+		}
+	}
+	if ctx.Err() != nil {
+		return errCancelled
+	}
+	if *count++; *count > maxLineCommands {
+		return fmt.Errorf("A line may run at most %d commands.", maxLineCommands)
+	}
+	return c.runCommand(ctx, words, in, out)
+}
@@ -0,0 +1,49 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitUnquoted(t *testing.T) {
+	for _, c := range []struct {
+		line  string
+		sep   rune
+		parts []string
+	}{
+		{"a; b;c", ';', []string{"a", " b", "c"}},
+		{"a | 'b | c' | d", '|', []string{"a ", " 'b | c' ", " d"}},
+		{`a \| b`, '|', []string{`a \| b`}},
+		{`echo "x > y" > note:a`, '>', []string{`echo "x > y" `, " note:a"}},
+		{"none", ';', []string{"none"}},
+	} {
+		if parts := splitUnquoted(c.line, c.sep); !reflect.DeepEqual(parts, c.parts) {
+			t.Errorf("splitUnquoted(%q, %q) = %q, want %q", c.line, c.sep, parts, c.parts)
+		}
+	}
+}
+
+func TestSplitWord(t *testing.T) {
+	for _, c := range []struct {
+		line  string
+		parts []string
+	}{
+		{"sleep 1m &", []string{"sleep 1m ", ""}},
+		{"a & b &", []string{"a ", " b ", ""}},
+		{"&", []string{"", ""}},
+		{"fetch https://x.test/?a=1&b=2", []string{"fetch https://x.test/?a=1&b=2"}},
+		{"fetch https://x.test/?a=1&b=2 &", []string{"fetch https://x.test/?a=1&b=2 ", ""}},
+		{"say a&", []string{"say a&"}},
+		{"say '&' \\&", []string{"say '&' \\&"}},
+		{"say \t&\tb", []string{"say \t", "\tb"}},
+	} {
+		if parts := splitWord(c.line, '&'); !reflect.DeepEqual(parts, c.parts) {
+			t.Errorf("splitWord(%q) = %q, want %q", c.line, parts, c.parts)
+		}
+	}
+}
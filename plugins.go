@@ -0,0 +1,671 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains plugins. A plugin is an executable in the -plugins directory
+started as a subprocess that speaks JSON-RPC 2.0, one message per line, over
+its stdin and stdout. The server calls initialize, to which the plugin answers
+with the commands it provides, and invoke for each use of one of them. While an
+invocation runs the plugin may call output, prompt and dom with the ID of the
+invoke request as "call". A plugin that crashes is restarted after a delay and
+one that goes quiet for longer than -plugin-timeout is given up on.
+*/
+
+//
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pluginProtocol   = 1
+	pluginInitWait   = 10 * time.Second // time allowed to answer initialize
+	pluginMinBackoff = time.Second
+	pluginMaxBackoff = time.Minute
+)
+
+// plugins holds the loaded plugins by name.
+var plugins = make(map[string]*plugin)
+
+// rpcMessage is a JSON-RPC 2.0 request, notification or response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError is the error member of a JSON-RPC response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// pluginCommand is a command as described by a plugin.
+type pluginCommand struct {
+	Name       string
+	Aliases    []string
+	Category   string
+	Desc       string
+	Long       string
+	Usage      string
+	Examples   []string
+	Params     []pluginParam
+	Foreground bool
+	Chat       bool // also available while connected to a chat server
+}
+
+// pluginParam is a param as described by a plugin. Type is one of text,
+// number, bool or duration.
+type pluginParam struct {
+	Name     string
+	Desc     string
+	Type     string
+	Default  string
+	Optional bool
+	Rest     bool
+	Flag     bool
+	Short    string
+	Choices  []string
+}
+
+// pluginCaller identifies the user invoking a plugin command.
+type pluginCaller struct {
+	Name    string `json:"name"`
+	ID      int    `json:"id"`
+	Auth    bool   `json:"auth"`
+	Admin   bool   `json:"admin"`
+	Session string `json:"session"`
+	Server  string `json:"server"`
+}
+
+// pluginCall is an invocation in progress.
+type pluginCall struct {
+	c         *client
+	a         *args
+	activity  chan struct{} // signalled when the plugin does something
+	prompting int32         // non-zero while waiting for the user
+}
+
+// plugin is a running, or restarting, plugin process.
+type plugin struct {
+	Name     string
+	path     string
+	commands []pluginCommand
+
+	sync.Mutex // guards the fields below
+	proc       *exec.Cmd
+	stdin      io.WriteCloser
+	running    bool
+	stopped    bool
+	restarts   int
+	lastErr    string
+	next       int64
+	pending    map[int64]chan rpcMessage
+	calls      map[int64]*pluginCall
+
+	wlock sync.Mutex // serialises writes to stdin
+}
+
+// loadPlugins starts every executable in dir and registers its commands.
+func loadPlugins(dir string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Println("plugins:", err)
+		return
+	}
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Println("plugins:", err)
+		return
+	}
+	for _, fi := range list {
+		if fi.IsDir() || fi.Mode()&0111 == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+		p := &plugin{Name: strings.ToLower(name), path: filepath.Join(dir, fi.Name())}
+		if _, ok := plugins[p.Name]; ok {
+			log.Println("plugins: duplicate plugin name", p.Name)
+			continue
+		}
+		ready := make(chan error, 1)
+		go p.supervise(ready)
+		if err := <-ready; err != nil {
+			log.Printf("plugin %s: %v", p.Name, err)
+			p.stop()
+			continue
+		}
+		plugins[p.Name] = p
+		log.Printf("Loaded plugin %s with %d commands.", p.Name, p.register())
+	}
+}
+
+// stopPlugins stops every plugin, as on shutdown.
+func stopPlugins() {
+	for _, p := range plugins {
+		p.stop()
+	}
+}
+
+// register adds the commands of p to the command registry. A command whose
+// name or any alias is taken, by a built in command or another plugin, is
+// refused. It returns the number of commands added.
+func (p *plugin) register() (added int) {
+	for _, pc := range p.commands {
+		name := strings.ToLower(pc.Name)
+		var aliases []string
+		for _, alias := range pc.Aliases {
+			aliases = append(aliases, strings.ToLower(alias))
+		}
+		if taken := commandTaken(append([]string{name}, aliases...)); taken != "" {
+			log.Printf("plugin %s: can't register command %q, %q is taken or invalid", p.Name, pc.Name, taken)
+			continue
+		}
+		cmd := command{
+			Name:       name,
+			Aliases:    aliases,
+			Category:   pc.Category,
+			Desc:       pc.Desc,
+			Long:       pc.Long,
+			Usage:      pc.Usage,
+			Examples:   pc.Examples,
+			Foreground: pc.Foreground,
+		}
+		if cmd.Category == "" {
+			cmd.Category = "plugins"
+		}
+		for _, pp := range pc.Params {
+			cmd.Params = append(cmd.Params, param{Name: pp.Name, Desc: pp.Desc, Type: pluginParamType(pp.Type),
+				Default: pp.Default, Optional: pp.Optional, Rest: pp.Rest, Flag: pp.Flag,
+				Short: pp.Short, Choices: pp.Choices})
+		}
+		cmd.Handler = func(c *client, a *args) error {
+			return p.invoke(c, a, name)
+		}
+		sysCommands.add(cmd)
+		if pc.Chat {
+			chatCommands.add(cmd)
+		}
+		added++
+	}
+	return
+}
+
+// commandTaken returns the first of names that is not a valid command name,
+// is given twice or is already a system or chat command, or "" if they are
+// all free.
+func commandTaken(names []string) string {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		_, sys := sysCommands[name]
+		_, chat := chatCommands[name]
+		if sys || chat || seen[name] || !isName(name) {
+			return name
+		}
+		seen[name] = true
+	}
+	return ""
+}
+
+// pluginParamType converts the type name of a plugin param.
+func pluginParamType(name string) paramType {
+	switch name {
+	case "number":
+		return intParam
+	case "bool":
+		return boolParam
+	case "duration":
+		return durParam
+	}
+	return strParam
+}
+
+// supervise runs the plugin process, restarting it when it exits. The result
+// of the first initialize is sent to ready.
+func (p *plugin) supervise(ready chan<- error) {
+	backoff := pluginMinBackoff
+	for {
+		started := time.Now()
+		err := p.run(ready)
+		ready = nil
+		p.Lock()
+		p.running = false
+		p.lastErr = err.Error()
+		stopped := p.stopped
+		p.Unlock()
+		if stopped {
+			return
+		}
+		log.Printf("plugin %s exited: %v", p.Name, err)
+		if time.Since(started) > pluginMaxBackoff {
+			backoff = pluginMinBackoff
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > pluginMaxBackoff {
+			backoff = pluginMaxBackoff
+		}
+		p.Lock()
+		p.restarts++
+		stopped = p.stopped
+		p.Unlock()
+		if stopped {
+			return
+		}
+	}
+}
+
+// run starts the plugin process, initializes it and reads its messages until
+// it exits.
+func (p *plugin) run(ready chan<- error) (e error) {
+	proc := exec.Command(p.path)
+	proc.Dir = filepath.Dir(p.path)
+	stdin, e := proc.StdinPipe()
+	if e != nil {
+		return p.fail(ready, e)
+	}
+	stdout, e := proc.StdoutPipe()
+	if e != nil {
+		return p.fail(ready, e)
+	}
+	proc.Stderr = pluginStderr{p}
+	if e = proc.Start(); e != nil {
+		return p.fail(ready, e)
+	}
+	p.Lock()
+	p.proc, p.stdin = proc, stdin
+	p.pending = make(map[int64]chan rpcMessage)
+	p.calls = make(map[int64]*pluginCall)
+	p.Unlock()
+	go func() {
+		if err := p.initialize(); err != nil {
+			p.fail(ready, err)
+			proc.Process.Kill()
+			return
+		}
+		if ready != nil {
+			ready <- nil
+		}
+	}()
+	p.read(stdout)
+	e = proc.Wait()
+	if e == nil {
+		e = errors.New("exited")
+	}
+	p.abort(e)
+	return
+}
+
+// fail reports e to ready, if set, and returns it.
+func (p *plugin) fail(ready chan<- error, e error) error {
+	if ready != nil {
+		ready <- e
+	}
+	return e
+}
+
+// initialize asks the plugin for its commands. After a restart the commands
+// registered the first time are kept.
+func (p *plugin) initialize() error {
+	id, ch, err := p.request("initialize", map[string]interface{}{"protocol": pluginProtocol, "server": *hostname}, nil)
+	if err != nil {
+		return err
+	}
+	var res rpcMessage
+	select {
+	case res = <-ch:
+	case <-time.After(pluginInitWait):
+		p.forget(id)
+		return errors.New("no answer to initialize")
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	var info struct {
+		Commands []pluginCommand
+	}
+	if err = json.Unmarshal(res.Result, &info); err != nil {
+		return err
+	}
+	p.Lock()
+	if p.commands == nil {
+		p.commands = info.Commands
+	}
+	p.running = true
+	p.Unlock()
+	return nil
+}
+
+// pluginStderr copies what a plugin writes to stderr to the log.
+type pluginStderr struct {
+	p *plugin
+}
+
+func (w pluginStderr) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		log.Printf("plugin %s: %s", w.p.Name, line)
+	}
+	return len(b), nil
+}
+
+// read handles the messages the plugin writes until its stdout is closed.
+func (p *plugin) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var m rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Printf("plugin %s: bad message: %v", p.Name, err)
+			continue
+		}
+		if m.Method != "" {
+			p.handle(m)
+			continue
+		}
+		var id int64
+		if err := json.Unmarshal(m.ID, &id); err != nil {
+			log.Printf("plugin %s: response with bad id %s", p.Name, m.ID)
+			continue
+		}
+		p.Lock()
+		ch, ok := p.pending[id]
+		delete(p.pending, id)
+		p.Unlock()
+		if ok {
+			ch <- m
+		}
+	}
+}
+
+// abort fails the requests still waiting for the plugin.
+func (p *plugin) abort(e error) {
+	p.Lock()
+	defer p.Unlock()
+	for id, ch := range p.pending {
+		ch <- rpcMessage{Error: &rpcError{Code: -32000, Message: "Plugin " + p.Name + " stopped: " + e.Error()}}
+		delete(p.pending, id)
+	}
+	p.calls = make(map[int64]*pluginCall)
+}
+
+// write sends a message to the plugin.
+func (p *plugin) write(m rpcMessage) error {
+	m.JSONRPC = "2.0"
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	stdin := p.stdin
+	p.Unlock()
+	if stdin == nil {
+		return errors.New("Plugin " + p.Name + " is not running.")
+	}
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	_, err = stdin.Write(append(b, '\n'))
+	return err
+}
+
+// request sends a request and returns its ID and the channel its response
+// arrives on. call, if set, receives the calls the plugin makes meanwhile.
+func (p *plugin) request(method string, params interface{}, call *pluginCall) (id int64, ch chan rpcMessage, e error) {
+	b, e := json.Marshal(params)
+	if e != nil {
+		return
+	}
+	ch = make(chan rpcMessage, 1)
+	p.Lock()
+	p.next++
+	id = p.next
+	p.pending[id] = ch
+	if call != nil {
+		p.calls[id] = call
+	}
+	p.Unlock()
+	if e = p.write(rpcMessage{ID: json.RawMessage(fmt.Sprint(id)), Method: method, Params: b}); e != nil {
+		p.forget(id)
+	}
+	return
+}
+
+// notify sends a notification.
+func (p *plugin) notify(method string, params interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return p.write(rpcMessage{Method: method, Params: b})
+}
+
+// forget stops waiting for the response to request id.
+func (p *plugin) forget(id int64) {
+	p.Lock()
+	delete(p.pending, id)
+	delete(p.calls, id)
+	p.Unlock()
+}
+
+// reply answers a request made by the plugin.
+func (p *plugin) reply(id json.RawMessage, result interface{}, err error) {
+	if id == nil {
+		return // a notification
+	}
+	m := rpcMessage{ID: id}
+	if err != nil {
+		m.Error = &rpcError{Code: -32000, Message: err.Error()}
+	} else if m.Result, err = json.Marshal(result); err != nil {
+		m.Error = &rpcError{Code: -32603, Message: err.Error()}
+	}
+	if err = p.write(m); err != nil {
+		log.Printf("plugin %s: %v", p.Name, err)
+	}
+}
+
+// handle runs a call made by the plugin on behalf of an invocation.
+func (p *plugin) handle(m rpcMessage) {
+	var params struct {
+		Call      int64
+		Text      string
+		Secure    bool
+		Op        string
+		Selector  string
+		Attribute string
+		Value     string
+		URL       string
+	}
+	if err := json.Unmarshal(m.Params, &params); err != nil {
+		p.reply(m.ID, nil, err)
+		return
+	}
+	p.Lock()
+	call, ok := p.calls[params.Call]
+	p.Unlock()
+	if !ok {
+		p.reply(m.ID, nil, errors.New("no such call"))
+		return
+	}
+	select {
+	case call.activity <- struct{}{}:
+	default:
+	}
+	c := call.c
+	switch m.Method {
+	case "output":
+		p.reply(m.ID, nil, call.a.println(params.Text))
+	case "prompt":
+		if jobOf(call.a.ctx).background() {
+			p.reply(m.ID, nil, errors.New("can't prompt in a background job"))
+			return
+		}
+		// the user may take a while, don't hold up other messages
+		atomic.AddInt32(&call.prompting, 1)
+		go func() {
+			defer atomic.AddInt32(&call.prompting, -1)
+			var s string
+			var err error
+			if params.Secure {
+				s, err = c.promptSecure("#msg-txt", params.Text)
+			} else {
+				s, err = c.prompt(params.Text)
+			}
+			p.reply(m.ID, map[string]string{"value": s}, err)
+		}()
+	case "dom":
+		if params.Selector == "" {
+			params.Selector = "#msg-list"
+		}
+		var err error
+		switch params.Op {
+		case "appendMsg":
+			err = c.appendMsg(params.Selector, params.Text)
+		case "appendLink":
+			err = c.appendLink(params.Selector, params.URL, params.Text)
+		case "innerHTML":
+			err = c.innerHTML(params.Selector, params.Value)
+		case "setAttribute":
+			err = c.setAttribute(params.Selector, params.Attribute, params.Value)
+		case "setProperty":
+			err = c.setProperty(params.Selector, params.Attribute, params.Value)
+		case "focus":
+			err = c.focus(params.Selector, params.Value)
+		case "sound":
+			err = c.sound(params.Value)
+		default:
+			err = errors.New("unknown dom op " + params.Op)
+		}
+		p.reply(m.ID, nil, err)
+	default:
+		p.reply(m.ID, nil, errors.New("unknown method "+m.Method))
+	}
+}
+
+// invoke runs a plugin command and waits for it to finish. The plugin is
+// given up on if it does nothing for -plugin-timeout, not counting the time
+// spent waiting for the user to answer a prompt.
+func (p *plugin) invoke(c *client, a *args, name string) error {
+	params := map[string]interface{}{
+		"command": name,
+		"args":    a.values,
+		"words":   a.Words,
+		"user": pluginCaller{Name: a.user.Name, ID: a.user.ID, Auth: a.user.auth,
+			Admin: a.user.isAdmin(), Session: c.id, Server: a.server},
+	}
+	if a.in != nil {
+		params["input"] = *a.in
+	}
+	call := &pluginCall{c: c, a: a, activity: make(chan struct{}, 1)}
+	id, ch, err := p.request("invoke", params, call)
+	if err != nil {
+		return err
+	}
+	defer p.forget(id)
+	timer := time.NewTimer(*pluginTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-ch:
+			if res.Error != nil {
+				return res.Error
+			}
+			return nil
+		case <-call.activity:
+			timer.Reset(*pluginTimeout)
+		case <-timer.C:
+			if atomic.LoadInt32(&call.prompting) > 0 {
+				timer.Reset(*pluginTimeout)
+				continue
+			}
+			p.notify("cancel", map[string]int64{"call": id})
+			return errors.New("Plugin " + p.Name + " timed out.")
+		case <-a.ctx.Done():
+			p.notify("cancel", map[string]int64{"call": id})
+			return errCancelled
+		}
+	}
+}
+
+// stop kills the plugin process and stops it being restarted.
+func (p *plugin) stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	if p.proc != nil && p.proc.Process != nil {
+		p.proc.Process.Kill()
+	}
+}
+
+// restart kills the plugin process so it is started again.
+func (p *plugin) restart() {
+	p.Lock()
+	defer p.Unlock()
+	if p.proc != nil && p.proc.Process != nil {
+		p.proc.Process.Kill()
+	}
+}
+
+// status describes the state of the plugin.
+func (p *plugin) status() string {
+	p.Lock()
+	defer p.Unlock()
+	state := "running"
+	if !p.running {
+		state = "restarting"
+		if p.lastErr != "" {
+			state += " (" + p.lastErr + ")"
+		}
+	}
+	var names []string
+	for _, pc := range p.commands {
+		names = append(names, pc.Name)
+	}
+	return fmt.Sprintf("%s: %s, %d restarts, commands: %s", p.Name, state, p.restarts, strings.Join(names, ", "))
+}
+
+// pluginNames returns the names of the loaded plugins sorted.
+func pluginNames() (names []string) {
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// completePlugins returns the names of the loaded plugins.
+func completePlugins(c *client) []string {
+	return pluginNames()
+}
+
+// pluginDir returns the directory plugins are loaded from, if any.
+func pluginDir() string {
+	if *pluginPath == "" {
+		return ""
+	}
+	if fi, err := os.Stat(*pluginPath); err != nil || !fi.IsDir() {
+		log.Println("plugins: not a directory:", *pluginPath)
+		return ""
+	}
+	return *pluginPath
+}
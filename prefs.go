@@ -0,0 +1,269 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the per-user preferences set with the set command. Logged in
+users have their preferences saved and applied again on their next login.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxAutojoin = 10 // servers in the autojoin preference
+
+var colorReg = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]{3,20}|rgba?\([0-9., %]+\))$`)
+
+// style is a CSS property of an element changed by a preference.
+type style struct {
+	Selector, Property, Default string
+}
+
+// pref describes a single preference.
+type pref struct {
+	Desc   string
+	styles []style
+	check  func(v string) (string, error)
+}
+
+// checkColor accepts CSS hex colors, color names and rgb()/rgba().
+func checkColor(v string) (string, error) {
+	if !colorReg.MatchString(v) {
+		return "", errors.New("Not a color. Use a name, #rrggbb or rgb(r, g, b).")
+	}
+	return v, nil
+}
+
+// checkOnOff accepts on/off style values.
+func checkOnOff(v string) (string, error) {
+	switch strings.ToLower(v) {
+	case "on", "yes", "true":
+		return "on", nil
+	case "off", "no", "false":
+		return "off", nil
+	}
+	return "", errors.New("Use on or off.")
+}
+
+// timestampFormats are the named timestamp formats.
+var timestampFormats = map[string]string{
+	"short":   "15:04",
+	"long":    "15:04:05",
+	"kitchen": time.Kitchen,
+	"date":    "2006-01-02 15:04",
+}
+
+var prefs = map[string]pref{
+	"background": {Desc: "message area background color",
+		styles: []style{{"#msg-list", "background", "black"}, {"#input-box", "background", "black"},
+			{"#msg-txt", "background", "black"}},
+		check: checkColor},
+	"color": {Desc: "message text color",
+		styles: []style{{"#msg-list", "color", "white"}, {"#msg-txt", "color", "white"}},
+		check:  checkColor},
+	"frame": {Desc: "page background color",
+		styles: []style{{"#main", "background", "grey"}},
+		check:  checkColor},
+	"border": {Desc: "border color",
+		styles: []style{{"#msg-list", "border-color", "grey"}, {"#input-box", "border-color", "grey"}},
+		check:  checkColor},
+	"timestamp": {Desc: "timestamp room messages: off, short, long, kitchen, date or a Go time layout",
+		check: func(v string) (string, error) {
+			if v == "off" {
+				return v, nil
+			}
+			if _, ok := timestampFormats[v]; ok {
+				return v, nil
+			}
+			if !strings.ContainsAny(v, "0123456789") {
+				return "", errors.New("Not a time format.")
+			}
+			return v, nil
+		}},
+	"autojoin": {Desc: "comma separated servers, the first with people on is joined after logging in",
+		check: func(v string) (string, error) {
+			rooms := strings.Split(v, ",")
+			if len(rooms) > maxAutojoin {
+				return "", fmt.Errorf("At most %d servers.", maxAutojoin)
+			}
+			for i, room := range rooms {
+				if rooms[i] = strings.TrimSpace(room); rooms[i] == "" {
+					return "", errors.New("Empty server name.")
+				} else if !isName(rooms[i]) {
+					return "", errors.New("Invalid characters in server name.")
+				}
+			}
+			return strings.Join(rooms, ","), nil
+		}},
+	"sound": {Desc: "play a sound for new room messages: on or off",
+		check: checkOnOff},
+}
+
+// prefKeys returns the preference names in sorted order.
+func prefKeys() (keys []string) {
+	for k := range prefs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// pref returns the value of the preference key, if it is set.
+func (c *client) pref(key string) (value string, ok bool) {
+	c.prefLock.RLock()
+	defer c.prefLock.RUnlock()
+	value, ok = c.prefs[key]
+	return
+}
+
+// setPref validates and sets a preference, saving it for logged in users.
+// An empty value restores the default.
+func (c *client) setPref(key, value string) (e error) {
+	p, ok := prefs[key]
+	if !ok {
+		return errors.New("Unknown preference: " + key)
+	}
+	if value != "" {
+		if value, e = p.check(value); e != nil {
+			return
+		}
+	}
+	// replace rather than modify the map, it is saved outside the lock
+	c.prefLock.Lock()
+	updated := make(map[string]string)
+	for k, v := range c.prefs {
+		updated[k] = v
+	}
+	if value == "" {
+		delete(updated, key)
+	} else {
+		updated[key] = value
+	}
+	c.prefs = updated
+	c.prefLock.Unlock()
+	if c.user.auth {
+		if _, err := changeUser(c.user.ID, func(r *userRecord) error {
+			r.Prefs = updated
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return c.applyStyles(key)
+}
+
+// applyStyles sends the CSS changes for key, or its defaults when unset.
+func (c *client) applyStyles(key string) (e error) {
+	for _, s := range prefs[key].styles {
+		value := s.Default
+		if v, ok := c.pref(key); ok {
+			value = v
+		}
+		if e = c.setProperty(s.Selector, s.Property, value); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// loadPrefs replaces the session preferences and timezone with those in r and
+// applies them, connecting to an autojoin server if any are set.
+func (c *client) loadPrefs(r userRecord) (e error) {
+	c.prefLock.Lock()
+	c.prefs = r.Prefs
+	c.prefLock.Unlock()
+	c.setLocation(r.Timezone)
+	for _, key := range prefKeys() {
+		if e = c.applyStyles(key); e != nil {
+			return
+		}
+	}
+	if rooms, ok := c.pref("autojoin"); ok && c.server == "" {
+		if room := autojoinRoom(strings.Split(rooms, ",")); room != "" {
+			c.connect(room)
+		}
+	}
+	return
+}
+
+// autojoinRoom returns the first of rooms with people on it, or the first
+// room when they are all empty. Blank entries, saved before they were
+// rejected, are skipped.
+func autojoinRoom(rooms []string) string {
+	first := ""
+	for _, room := range rooms {
+		if room == "" {
+			continue
+		}
+		if servers.exists(room) {
+			return room
+		}
+		if first == "" {
+			first = room
+		}
+	}
+	return first
+}
+
+// setLocation sets the timezone used for the timestamps and reminders of c
+// from the name of a profile timezone. An empty or unknown name means the
+// server's timezone.
+func (c *client) setLocation(tz string) {
+	var loc *time.Location
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			log.Println(err)
+		}
+	}
+	c.prefLock.Lock()
+	c.location = loc
+	c.prefLock.Unlock()
+}
+
+// userLocation returns the timezone of the profile of c, or the server's.
+func (c *client) userLocation() *time.Location {
+	c.prefLock.RLock()
+	defer c.prefLock.RUnlock()
+	if c.location != nil {
+		return c.location
+	}
+	return time.Local
+}
+
+// resetPrefs clears the session preferences and timezone and restores the
+// defaults.
+func (c *client) resetPrefs() {
+	c.prefLock.Lock()
+	c.prefs = nil
+	c.prefLock.Unlock()
+	c.setLocation("")
+	for _, key := range prefKeys() {
+		if err := c.applyStyles(key); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// stamp returns the timestamp prefix for a room message, if enabled.
+func (c *client) stamp(t time.Time) string {
+	format, ok := c.pref("timestamp")
+	if !ok || format == "off" {
+		return ""
+	}
+	if layout, ok := timestampFormats[format]; ok {
+		format = layout
+	}
+	return "[" + t.In(c.userLocation()).Format(format) + "] "
+}
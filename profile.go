@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the editable profile fields shown by whois. Each field can
+be marked private, hiding it from everyone except its owner and admins. The
+email address is private until its owner makes it public.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// profileField describes one editable field of a user profile.
+type profileField struct {
+	Name  string
+	Label string
+	Max   int
+	value func(r *userRecord) *string
+	check func(v string) error
+}
+
+// profileFields lists the editable fields in the order whois shows them.
+var profileFields = []profileField{
+	{Name: "displayname", Label: "Display name", Max: 48,
+		value: func(r *userRecord) *string { return &r.DisplayName }},
+	{Name: "pronouns", Label: "Pronouns", Max: 32,
+		value: func(r *userRecord) *string { return &r.Pronouns }},
+	{Name: "timezone", Label: "Timezone", Max: 64,
+		value: func(r *userRecord) *string { return &r.Timezone },
+		check: func(v string) error {
+			if _, err := time.LoadLocation(v); err != nil {
+				return errors.New("Unknown timezone, use a name like Europe/London.")
+			}
+			return nil
+		}},
+	{Name: "avatar", Label: "Avatar", Max: 512,
+		value: func(r *userRecord) *string { return &r.Avatar },
+		check: func(v string) error {
+			if u, err := url.Parse(v); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return errors.New("Avatar must be an http or https URL.")
+			}
+			return nil
+		}},
+	{Name: "bio", Label: "Bio", Max: 280,
+		value: func(r *userRecord) *string { return &r.Bio }},
+}
+
+// privateOnly are fields which aren't editable but can still be hidden.
+var privateOnly = []string{"email", "created", "lastseen"}
+
+// privateByDefault are fields hidden until their owner makes them public.
+var privateByDefault = map[string]bool{"email": true}
+
+// isPrivate returns true if field is hidden from whois for the account in r.
+// Private holds true or false once the owner chose, otherwise the default
+// from privateByDefault applies.
+func isPrivate(r *userRecord, field string) bool {
+	if private, ok := r.Private[field]; ok {
+		return private
+	}
+	return privateByDefault[field]
+}
+
+// findProfileField returns the field called name.
+func findProfileField(name string) (f profileField, ok bool) {
+	for _, f = range profileFields {
+		if f.Name == strings.ToLower(name) {
+			return f, true
+		}
+	}
+	return f, false
+}
+
+// isPrivacyField returns true if name can be marked private.
+func isPrivacyField(name string) bool {
+	if _, ok := findProfileField(name); ok {
+		return true
+	}
+	for _, n := range privateOnly {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setProfileField validates and sets a profile field. An empty value clears it.
+func setProfileField(r *userRecord, name, value string) error {
+	f, ok := findProfileField(name)
+	if !ok {
+		return errors.New("Unknown profile field: " + name)
+	}
+	value = strings.TrimSpace(value)
+	if utf8.RuneCountInString(value) > f.Max {
+		return fmt.Errorf("%s is limited to %d characters.", f.Label, f.Max)
+	}
+	if value != "" && f.check != nil {
+		if err := f.check(value); err != nil {
+			return err
+		}
+	}
+	*f.value(r) = value
+	return nil
+}
+
+// whois returns the lines describing the account in r. Private fields are
+// only included when full is true.
+func whois(r userRecord, online bool, full bool) (lines []string) {
+	show := func(field, label, value string) {
+		if value == "" || (isPrivate(&r, field) && !full) {
+			return
+		}
+		if isPrivate(&r, field) {
+			label += " (private)"
+		}
+		lines = append(lines, label+": "+value)
+	}
+	lines = append(lines, "Name: "+strings.Title(r.Name))
+	for _, f := range profileFields {
+		show(f.Name, f.Label, *f.value(&r))
+	}
+	show("email", "Email", r.Email)
+	if !r.Created.IsZero() {
+		show("created", "Registered", r.Created.Format("2006-01-02"))
+	}
+	if online {
+		show("lastseen", "Last seen", "online now")
+	} else if !r.LastSeen.IsZero() {
+		show("lastseen", "Last seen", r.LastSeen.Format("2006-01-02 15:04 MST"))
+	}
+	return
+}
+
+// touchUser records that the account with id was just seen.
+func touchUser(id int) {
+	changeUser(id, func(r *userRecord) error {
+		r.LastSeen = time.Now().UTC()
+		return nil
+	})
+}
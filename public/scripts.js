@@ -48,8 +48,130 @@ function Send() {
 	var elem = document.getElementById("msg-txt")
 	ws.send(elem.value);
 	elem.value = "";
+	HideCompletions();
+	recall = {n: 0, draft: ""};
+	search = null;
 	return false
 }
+// SendControl sends a control packet. Control packets are sent as binary
+// messages to keep them apart from input.
+function SendControl(type, data) {
+	ws.send(new Blob([JSON.stringify({"Type": type, "Data": data})]));
+}
+// completion holds the candidates Tab cycles through.
+var completion = null;
+// recall is the position in the history Up and Down move through, counting
+// back from the most recent line, and the line being typed before moving.
+var recall = {n: 0, draft: ""};
+// search holds the state of a Ctrl-R reverse history search.
+var search = null;
+function KeyDown(event) {
+	var elem = event.target;
+	if (event.ctrlKey && (event.key === "c" || event.key === "C") && elem.selectionStart === elem.selectionEnd) {
+		// without a selection to copy Ctrl-C cancels the foreground job
+		SendControl("cancel", {});
+		return false;
+	}
+	if (elem.type === "password") {
+		return true;
+	}
+	if (event.key === "Escape") {
+		if (search) {
+			elem.value = search.query;
+			search = null;
+		}
+		HideCompletions();
+		return true;
+	}
+	if (event.ctrlKey && (event.key === "r" || event.key === "R")) {
+		if (!search || elem.value !== search.value) {
+			search = {query: elem.value, n: 0, value: null};
+		}
+		SendControl("search", {"Query": search.query, "N": String(search.n)});
+		return false;
+	}
+	if (search && event.key !== "Control" && event.key !== "Shift") {
+		search = null;
+		HideCompletions();
+	}
+	if (event.key === "ArrowUp") {
+		if (recall.n === 0) {
+			recall.draft = elem.value;
+		}
+		SendControl("history", {"N": String(recall.n + 1)});
+		return false;
+	}
+	if (event.key === "ArrowDown") {
+		if (recall.n <= 1) {
+			recall.n = 0;
+			elem.value = recall.draft;
+		} else {
+			SendControl("history", {"N": String(recall.n - 1)});
+		}
+		return false;
+	}
+	if (event.key !== "Tab") {
+		return true;
+	}
+	if (completion && elem.value === completion.value) {
+		completion.index = (completion.index + 1) % completion.items.length;
+		InsertCompletion(elem, completion.items[completion.index]);
+		ShowCompletions();
+		return false;
+	}
+	HideCompletions();
+	SendControl("complete", {"Line": elem.value.substring(0, elem.selectionStart)});
+	return false;
+}
+// InsertCompletion replaces the word being completed with text.
+function InsertCompletion(elem, text) {
+	elem.value = completion.before + text + completion.after;
+	var pos = completion.before.length + text.length;
+	elem.setSelectionRange(pos, pos);
+	completion.value = elem.value;
+}
+function ShowCompletions() {
+	var list = document.getElementById("completions");
+	list.innerHTML = "";
+	completion.items.forEach(function (item, i) {
+		var node = document.createElement("span");
+		node.appendChild(document.createTextNode(item));
+		if (i === completion.index) {
+			node.className = "selected";
+		}
+		node.onclick = function () {
+			var elem = document.getElementById("msg-txt");
+			InsertCompletion(elem, item + " ");
+			HideCompletions();
+			elem.focus();
+		};
+		list.appendChild(node);
+	});
+	list.style.display = "block";
+}
+// ShowHint shows text in place of the completions.
+function ShowHint(text) {
+	var list = document.getElementById("completions");
+	list.innerHTML = "";
+	list.appendChild(document.createTextNode(text));
+	list.style.display = "block";
+}
+function HideCompletions() {
+	var list = document.getElementById("completions");
+	if (list) {
+		list.style.display = "none";
+	}
+	completion = null;
+}
+function CommonPrefix(items) {
+	var prefix = items[0];
+	items.forEach(function (item) {
+		while (item.toLowerCase().indexOf(prefix.toLowerCase()) !== 0) {
+			prefix = prefix.substring(0, prefix.length - 1);
+		}
+	});
+	return prefix;
+}
 var OnClick = {};
 OnClick["removeDecoration"] = function (obj) {
 	obj.onclick = function() {
@@ -174,4 +296,76 @@ DomMap["border-color"] = function (elem, obj) {
 	if (obj.Data.Value) {
 		elem.style.borderColor = obj.Data.Value;
 	}
-}
\ No newline at end of file
+}
+var audioCtx;
+DomMap["sound"] = function (elem, obj) {
+	var AudioContext = window.AudioContext || window.webkitAudioContext;
+	if (!AudioContext) {
+		return;
+	}
+	if (!audioCtx) {
+		audioCtx = new AudioContext();
+	}
+	var osc = audioCtx.createOscillator();
+	var gain = audioCtx.createGain();
+	osc.frequency.value = 880;
+	gain.gain.setValueAtTime(0.1, audioCtx.currentTime);
+	gain.gain.exponentialRampToValueAtTime(0.0001, audioCtx.currentTime + 0.2);
+	osc.connect(gain);
+	gain.connect(audioCtx.destination);
+	osc.start();
+	osc.stop(audioCtx.currentTime + 0.2);
+}
+DomMap["complete"] = function (elem, obj) {
+	var word = obj.Data.Word || "";
+	var end = elem.selectionStart;
+	var before = elem.value.substring(0, end);
+	if (before.length < word.length || before.substring(end - word.length) !== word) {
+		return; // the input changed while waiting for the server
+	}
+	var items = obj.Data.Value ? obj.Data.Value.split("\n") : [];
+	if (items.length === 0) {
+		return;
+	}
+	completion = {
+		items: items,
+		index: -1,
+		before: before.substring(0, end - word.length),
+		after: elem.value.substring(end)
+	};
+	if (items.length === 1) {
+		InsertCompletion(elem, items[0] + " ");
+		completion = null;
+		return;
+	}
+	var prefix = CommonPrefix(items);
+	if (prefix.length > word.length) {
+		InsertCompletion(elem, prefix);
+	} else {
+		completion.value = elem.value;
+	}
+	ShowCompletions();
+}
+DomMap["history"] = function (elem, obj) {
+	var n = parseInt(obj.Data.N, 10) || 0;
+	if (n === 0) {
+		return;
+	}
+	recall.n = n;
+	elem.value = obj.Data.Value || "";
+	elem.setSelectionRange(elem.value.length, elem.value.length);
+}
+DomMap["search"] = function (elem, obj) {
+	if (!search) {
+		return;
+	}
+	var n = parseInt(obj.Data.N, 10) || 0;
+	if (n === 0) {
+		ShowHint("reverse-i-search: no match for '" + search.query + "'");
+		return;
+	}
+	search.n = n;
+	search.value = obj.Data.Value || "";
+	elem.value = search.value;
+	ShowHint("reverse-i-search '" + search.query + "': " + search.value);
+}
@@ -0,0 +1,43 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains helpers for building tiedot queries. Queries are assembled
+from Go values rather than JSON text so user input is never spliced into them.
+*/
+
+//
+package main
+
+import (
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+// query is a tiedot query expression. Multiple expressions are a union.
+type query []interface{}
+
+// eq returns a query matching documents where field is equal to value.
+// field must be indexed on the collection the query is run against.
+func eq(field string, value interface{}) query {
+	return query{map[string]interface{}{
+		"eq": value,
+		"in": []interface{}{field},
+	}}
+}
+
+// run evaluates the query against col and returns the matching document IDs
+// in ascending order.
+func (q query) run(col *db.Col) (ids []int, e error) {
+	result := make(map[int]struct{})
+	if e = db.EvalQuery([]interface{}(q), col, &result); e != nil {
+		return
+	}
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return
+}
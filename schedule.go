@@ -0,0 +1,495 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the scheduler. Tasks are stored in the tasks collection and
+kept in memory while the server runs. Recurring tasks are admin jobs run when
+their cron expression matches the current minute. Reminders are one-off
+messages shown to a user when due, or when they next log in if they are
+offline at the time.
+*/
+
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	maxReminders    = 20 // pending reminders per user
+	maxReminderText = 500
+	maxReminderWait = 366 * 24 * time.Hour
+)
+
+var tasksDB *db.Col
+
+// taskRecord is the stored form of a task.
+type taskRecord struct {
+	Spec    string    // cron expression of a recurring task
+	Action  string    // one of taskActions, or remind
+	Arg     string    // given to the action, the text of a reminder
+	UserID  int       // who added the task
+	Due     time.Time // when a reminder is due
+	Created time.Time
+	LastRun time.Time
+}
+
+// taskAction runs a recurring task and returns a line describing the result.
+type taskAction struct {
+	Desc string
+	Run  func(arg string) (string, error)
+}
+
+// taskActions are the jobs recurring tasks can run, keyed by name.
+var taskActions = map[string]taskAction{
+	"backup": {
+		Desc: "take a backup, keeping the newest [arg] backups if given",
+		Run: func(arg string) (string, error) {
+			path, err := backup()
+			if err != nil {
+				return "", err
+			}
+			if keep, _ := strconv.Atoi(arg); keep > 0 {
+				rotateBackups(keep)
+			}
+			return "Backup written to " + path, nil
+		},
+	},
+	"announce": {
+		Desc: "show <arg> to everyone online",
+		Run: func(arg string) (string, error) {
+			if arg == "" {
+				return "", errors.New("nothing to announce")
+			}
+			list := sessions.list()
+			for _, c := range list {
+				c.appendMsg("#msg-list", "Announcement: "+arg)
+			}
+			return fmt.Sprintf("Announced to %d sessions", len(list)), nil
+		},
+	},
+	"prune-history": {
+		Desc: "delete the history of users not seen for <arg> days",
+		Run: func(arg string) (string, error) {
+			days, err := strconv.Atoi(arg)
+			if err != nil || days < 1 {
+				return "", errors.New("the number of days must be at least 1")
+			}
+			n, err := pruneHistory(time.Now().AddDate(0, 0, -days))
+			return fmt.Sprintf("Deleted the history of %d users", n), err
+		},
+	},
+}
+
+// taskNames returns the names of taskActions sorted.
+func taskNames() (list []string) {
+	for name := range taskActions {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return
+}
+
+// scheduler holds the tasks by document ID.
+var scheduler = struct {
+	sync.Mutex
+	tasks map[int]taskRecord
+}{tasks: make(map[int]taskRecord)}
+
+// loadTasksDB opens the tasks collection, creating it if needed, and loads
+// the tasks.
+func loadTasksDB() (e error) {
+	if tasksDB, e = openCollection("tasks", "UserID"); e != nil {
+		return
+	}
+	tasks := make(map[int]taskRecord)
+	tasksDB.ForEachDoc(func(id int, doc []byte) bool {
+		var r taskRecord
+		if err := decodeJSON("tasks", id, doc, &r); err != nil {
+			log.Println(err)
+		} else {
+			tasks[id] = r
+		}
+		return true
+	})
+	scheduler.Lock()
+	scheduler.tasks = tasks
+	scheduler.Unlock()
+	return
+}
+
+// addTask stores a new task and returns its ID.
+func addTask(r taskRecord) (id int, e error) {
+	r.Created = time.Now().UTC()
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if r.Action == "remind" {
+		n := 0
+		for _, t := range scheduler.tasks {
+			if t.Action == "remind" && t.UserID == r.UserID {
+				n++
+			}
+		}
+		if n >= maxReminders {
+			return 0, fmt.Errorf("You can have at most %d reminders.", maxReminders)
+		}
+	}
+	if id, e = tasksDB.Insert(doc); e == nil {
+		scheduler.tasks[id] = r
+	}
+	return
+}
+
+// takeTask removes the task with id and returns it. Only the first caller
+// for a task gets it, so a reminder is never delivered twice.
+func takeTask(id int) (r taskRecord, ok bool) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if r, ok = scheduler.tasks[id]; !ok {
+		return
+	}
+	delete(scheduler.tasks, id)
+	if err := tasksDB.Delete(id); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// ranTask records that the recurring task with id ran at t.
+func ranTask(id int, t time.Time) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	r, ok := scheduler.tasks[id]
+	if !ok {
+		return
+	}
+	r.LastRun = t.UTC()
+	scheduler.tasks[id] = r
+	if doc, err := encodeDoc(r); err != nil {
+		log.Println(err)
+	} else if err = tasksDB.Update(id, doc); err != nil {
+		log.Println(err)
+	}
+}
+
+// listTasks returns the IDs of the tasks match accepts, oldest first, along
+// with the tasks.
+func listTasks(match func(r taskRecord) bool) (ids []int, tasks map[int]taskRecord) {
+	tasks = make(map[int]taskRecord)
+	scheduler.Lock()
+	for id, r := range scheduler.tasks {
+		if match(r) {
+			ids = append(ids, id)
+			tasks[id] = r
+		}
+	}
+	scheduler.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return tasks[ids[i]].Created.Before(tasks[ids[j]].Created) })
+	return
+}
+
+// deleteTasks removes the reminders of the user. The caller holds dbLock.
+func deleteTasks(userID int) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	for id, r := range scheduler.tasks {
+		if r.Action == "remind" && r.UserID == userID {
+			delete(scheduler.tasks, id)
+			if err := tasksDB.Delete(id); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// runScheduler delivers due reminders every second and runs recurring tasks
+// at the start of every minute. Expired tokens are removed every hour.
+func runScheduler() {
+	last := time.Now().Truncate(time.Minute)
+	for now := range time.Tick(time.Second) {
+		ids, tasks := listTasks(func(r taskRecord) bool {
+			return r.Action == "remind" && !r.Due.After(now)
+		})
+		for _, id := range ids {
+			deliverReminder(id, tasks[id].UserID)
+		}
+		minute := now.Truncate(time.Minute)
+		if !minute.After(last) {
+			continue
+		}
+		last = minute
+		ids, tasks = listTasks(func(r taskRecord) bool {
+			if r.Spec == "" {
+				return false
+			}
+			spec, err := parseCron(r.Spec)
+			return err == nil && spec.match(minute)
+		})
+		for _, id := range ids {
+			go runTask(id, tasks[id])
+		}
+		if minute.Minute() == 0 {
+			go func() {
+				if n := pruneTokens(time.Now()); n > 0 {
+					log.Printf("removed %d expired tokens", n)
+				}
+			}()
+		}
+	}
+}
+
+// runTask runs the recurring task r and logs the result.
+func runTask(id int, r taskRecord) {
+	ranTask(id, time.Now())
+	action, ok := taskActions[r.Action]
+	if !ok {
+		log.Printf("task %d: unknown action %s", id, r.Action)
+		return
+	}
+	result, err := action.Run(r.Arg)
+	if err != nil {
+		log.Printf("task %d (%s) failed: %v", id, r.Action, err)
+		audit("task failed", "", "", fmt.Sprintf("%d %s: %v", id, r.Action, err))
+		return
+	}
+	log.Printf("task %d (%s): %s", id, r.Action, result)
+}
+
+// deliverReminder shows the reminder with id to the sessions of the user. It
+// is left queued if the user is offline.
+func deliverReminder(id, userID int) {
+	list := sessions.byUser(userID)
+	if len(list) == 0 {
+		return
+	}
+	r, ok := takeTask(id)
+	if !ok {
+		return
+	}
+	for _, c := range list {
+		c.appendMsg("#msg-list", "Reminder: "+r.Arg)
+		if sound, _ := c.pref("sound"); sound == "on" {
+			c.sound("message")
+		}
+	}
+}
+
+// deliverReminders shows the queued reminders of c, as when the user logs in.
+func (c *client) deliverReminders() {
+	now := time.Now()
+	ids, _ := listTasks(func(r taskRecord) bool {
+		return r.Action == "remind" && r.UserID == c.user.ID && !r.Due.After(now)
+	})
+	for _, id := range ids {
+		deliverReminder(id, c.user.ID)
+	}
+}
+
+// parseWhen parses the time of a reminder from the start of words, as in
+// "in 10m" or "at 17:00", and returns the time and the remaining words.
+// Clock times are in loc and mean the next time the clock shows them.
+func parseWhen(words []string, now time.Time, loc *time.Location) (t time.Time, rest []string, e error) {
+	if len(words) < 2 {
+		return t, nil, errors.New("Missing time.")
+	}
+	switch strings.ToLower(words[0]) {
+	case "in":
+		d, err := time.ParseDuration(words[1])
+		if err != nil || d <= 0 {
+			return t, nil, errors.New("Unknown duration " + words[1] + ", use one like 10m or 1h30m.")
+		}
+		t, rest = now.Add(d), words[2:]
+	case "at":
+		if len(words) > 2 {
+			if t, e = time.ParseInLocation("2006-01-02 15:04", words[1]+" "+words[2], loc); e == nil {
+				rest = words[3:]
+				break
+			}
+		}
+		clock, err := time.ParseInLocation("15:04", words[1], loc)
+		if err != nil {
+			return t, nil, errors.New("Unknown time " + words[1] + ", use one like 17:00 or 2016-01-02 17:00.")
+		}
+		local := now.In(loc)
+		t = time.Date(local.Year(), local.Month(), local.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		rest, e = words[2:], nil
+	default:
+		return t, nil, errors.New("The time must start with in or at.")
+	}
+	switch {
+	case !t.After(now):
+		e = errors.New("That time has already passed.")
+	case t.Sub(now) > maxReminderWait:
+		e = errors.New("Reminders can be at most a year away.")
+	}
+	return
+}
+
+// remind adds a reminder for c from words such as "in 10m tea" and reports
+// when it is due.
+func (c *client) remind(a *args, words []string) error {
+	if !a.user.auth {
+		return a.println("You must be logged in")
+	}
+	loc := c.userLocation()
+	due, rest, err := parseWhen(words, time.Now(), loc)
+	if err != nil {
+		return a.println(err.Error())
+	}
+	text := strings.Join(rest, " ")
+	if text == "" {
+		return errUsage
+	}
+	if len(text) > maxReminderText {
+		return a.println(fmt.Sprintf("Reminders may be at most %d characters long.", maxReminderText))
+	}
+	if _, err = addTask(taskRecord{Action: "remind", Arg: text, UserID: a.user.ID, Due: due.UTC()}); err != nil {
+		return a.println(err.Error())
+	}
+	return a.println("Reminder set for " + due.In(loc).Format("2006-01-02 15:04 MST"))
+}
+
+// cronSpec is a parsed cron expression, each field a set of bits.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// cronShortcuts are the named schedules parseCron accepts.
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// parseCron parses a standard five field cron expression: minute, hour, day
+// of month, month and day of week (0 or 7 is Sunday). Fields may be *, lists,
+// ranges and steps such as */15 or 1-5. The shortcuts @hourly, @daily,
+// @weekly, @monthly and @yearly are also accepted.
+func parseCron(s string) (cs cronSpec, e error) {
+	if full, ok := cronShortcuts[strings.ToLower(strings.TrimSpace(s))]; ok {
+		s = full
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return cs, errors.New("A cron expression has 5 fields: minute hour day month weekday.")
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&cs.minute, &cs.hour, &cs.dom, &cs.month, &cs.dow}
+	for i, f := range fields {
+		if *sets[i], e = parseCronField(f, bounds[i][0], bounds[i][1]); e != nil {
+			return cs, fmt.Errorf("Bad cron field %q: %v", f, e)
+		}
+	}
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	// as in Vixie cron a field starting with * is unrestricted, */2 included
+	cs.anyDom, cs.anyDow = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return
+}
+
+// parseCronField returns the set of values in field between min and max.
+func parseCronField(field string, min, max int) (set uint64, e error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if n := strings.Index(part, "/"); n >= 0 {
+			if step, e = strconv.Atoi(part[n+1:]); e != nil || step < 1 {
+				return 0, errors.New("bad step")
+			}
+			part = part[:n]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, e = strconv.Atoi(bounds[0]); e != nil {
+				return 0, errors.New("not a number")
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, e = strconv.Atoi(bounds[1]); e != nil {
+					return 0, errors.New("not a number")
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+// match returns true if the minute of t is in the schedule.
+func (cs cronSpec) match(t time.Time) bool {
+	if cs.minute&(1<<uint(t.Minute())) == 0 || cs.hour&(1<<uint(t.Hour())) == 0 ||
+		cs.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := cs.dom&(1<<uint(t.Day())) != 0, cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.anyDom || cs.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t in the schedule, or the zero time if
+// there is none within a few years.
+func (cs cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case cs.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cs.match(time.Date(t.Year(), t.Month(), t.Day(), firstBit(cs.hour), firstBit(cs.minute), 0, 0, t.Location())):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case cs.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case cs.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// firstBit returns the lowest value in set.
+func firstBit(set uint64) int {
+	for i := 0; i < 64; i++ {
+		if set&(1<<uint(i)) != 0 {
+			return i
+		}
+	}
+	return 0
+}
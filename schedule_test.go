@@ -0,0 +1,146 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cronBase is a Monday.
+var cronBase = time.Date(2026, 10, 19, 17, 42, 10, 0, time.UTC)
+
+func TestParseCron(t *testing.T) {
+	for _, c := range []struct {
+		expr           string
+		minute, dow    uint64
+		anyDom, anyDow bool
+		err            bool
+	}{
+		{expr: "* * * * *", minute: 1<<60 - 1, dow: 0xff, anyDom: true, anyDow: true},
+		{expr: "1,2-4 * * * *", minute: 0x1e, dow: 0xff, anyDom: true, anyDow: true},
+		{expr: "*/20 * * * *", minute: 1 | 1<<20 | 1<<40, dow: 0xff, anyDom: true, anyDow: true},
+		{expr: "5/20 * * * *", minute: 1<<5 | 1<<25 | 1<<45, dow: 0xff, anyDom: true, anyDow: true},
+		{expr: "0 0 * * 7", minute: 1, dow: 1 | 1<<7, anyDom: true},
+		{expr: "0 0 13 * 5", minute: 1, dow: 1 << 5},
+		{expr: "0 12 */2 * 1", minute: 1, dow: 1 << 1, anyDom: true},
+		{expr: "0 12 1 * */2", minute: 1, dow: 0x55, anyDow: true},
+		{expr: "@hourly", minute: 1, dow: 0xff, anyDom: true, anyDow: true},
+		{expr: "bad", err: true},
+		{expr: "* * * *", err: true},
+		{expr: "60 * * * *", err: true},
+		{expr: "4-1 * * * *", err: true},
+		{expr: "*/0 * * * *", err: true},
+		{expr: "a * * * *", err: true},
+		{expr: "* * 0 * *", err: true},
+	} {
+		cs, err := parseCron(c.expr)
+		if (err != nil) != c.err {
+			t.Errorf("parseCron(%q) error = %v, want error %v", c.expr, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cs.minute != c.minute || cs.dow != c.dow || cs.anyDom != c.anyDom || cs.anyDow != c.anyDow {
+			t.Errorf("parseCron(%q) = minute %#x dow %#x any %v/%v, want %#x %#x %v/%v", c.expr,
+				cs.minute, cs.dow, cs.anyDom, cs.anyDow, c.minute, c.dow, c.anyDom, c.anyDow)
+		}
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	for _, c := range []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"*/15 9-17 * * 1-5", time.Date(2026, 10, 19, 17, 45, 0, 0, time.UTC), true},
+		{"*/15 9-17 * * 1-5", time.Date(2026, 10, 19, 17, 46, 0, 0, time.UTC), false},
+		{"*/15 9-17 * * 1-5", time.Date(2026, 10, 25, 12, 0, 0, 0, time.UTC), false},
+		// both days restricted: either one matches
+		{"0 0 13 * 5", time.Date(2026, 10, 13, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 13 * 5", time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 13 * 5", time.Date(2026, 10, 22, 0, 0, 0, 0, time.UTC), false},
+		// */2 is unrestricted, so both must match
+		{"0 12 */2 * 1", time.Date(2026, 11, 9, 12, 0, 0, 0, time.UTC), true},
+		{"0 12 */2 * 1", time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC), false},
+		{"0 12 */2 * 1", time.Date(2026, 10, 26, 12, 0, 0, 0, time.UTC), false},
+		{"0 0 * * 7", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC), true},
+	} {
+		cs, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cs.match(c.at); got != c.want {
+			t.Errorf("%q match %s = %v, want %v", c.expr, c.at.Format("Mon 2006-01-02 15:04"), got, c.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	for _, c := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 19, 17, 43, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC)},
+		{"*/15 9-17 * * 1-5", time.Date(2026, 10, 19, 17, 45, 0, 0, time.UTC)},
+		{"*/15 9-17 * * 6", time.Date(2026, 10, 24, 9, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 12 */2 * 1", time.Date(2026, 11, 9, 12, 0, 0, 0, time.UTC)},
+		{"30 2 29 2 *", time.Date(2028, 2, 29, 2, 30, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	} {
+		cs, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cs.next(cronBase); !got.Equal(c.want) {
+			t.Errorf("%q next = %s, want %s", c.expr, got.Format("Mon 2006-01-02 15:04"), c.want.Format("Mon 2006-01-02 15:04"))
+		}
+	}
+}
+
+func TestParseWhen(t *testing.T) {
+	east := time.FixedZone("UTC+2", 2*60*60)
+	for _, c := range []struct {
+		words []string
+		loc   *time.Location
+		want  time.Time
+		rest  []string
+		err   bool
+	}{
+		{words: []string{"in", "10m", "tea"}, loc: time.UTC, want: cronBase.Add(10 * time.Minute), rest: []string{"tea"}},
+		{words: []string{"IN", "1h30m", "a", "b"}, loc: time.UTC, want: cronBase.Add(90 * time.Minute), rest: []string{"a", "b"}},
+		{words: []string{"at", "18:00", "x"}, loc: time.UTC, want: time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC), rest: []string{"x"}},
+		{words: []string{"at", "17:00", "x"}, loc: time.UTC, want: time.Date(2026, 10, 20, 17, 0, 0, 0, time.UTC), rest: []string{"x"}},
+		{words: []string{"at", "18:00", "x"}, loc: east, want: time.Date(2026, 10, 20, 16, 0, 0, 0, time.UTC), rest: []string{"x"}},
+		{words: []string{"at", "20:00"}, loc: east, want: time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC), rest: []string{}},
+		{words: []string{"at", "2026-12-24", "09:00", "x"}, loc: time.UTC, want: time.Date(2026, 12, 24, 9, 0, 0, 0, time.UTC), rest: []string{"x"}},
+		{words: []string{"at", "2020-12-24", "09:00", "x"}, loc: time.UTC, err: true},
+		{words: []string{"at", "25:00", "x"}, loc: time.UTC, err: true},
+		{words: []string{"in", "-5m", "x"}, loc: time.UTC, err: true},
+		{words: []string{"in", "9000h", "x"}, loc: time.UTC, err: true},
+		{words: []string{"on", "monday"}, loc: time.UTC, err: true},
+		{words: []string{"in"}, loc: time.UTC, err: true},
+	} {
+		got, rest, err := parseWhen(c.words, cronBase, c.loc)
+		if (err != nil) != c.err {
+			t.Errorf("parseWhen(%q) error = %v, want error %v", c.words, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !got.Equal(c.want) || !reflect.DeepEqual(rest, c.rest) {
+			t.Errorf("parseWhen(%q) = %s %q, want %s %q", c.words, got, rest, c.want, c.rest)
+		}
+	}
+}
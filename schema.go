@@ -0,0 +1,258 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the typed records stored in the database along with the
+schema version and the ordered list of migrations that bring an older database
+up to date when it is loaded.
+*/
+
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+// schemaVersion is the version of the newest migration below.
+var schemaVersion = len(migrations)
+
+// metaDB holds database wide settings such as the schema version.
+var metaDB *db.Col
+
+// userRecord is the stored form of a user account. Fields missing from a
+// document decode as their zero value.
+type userRecord struct {
+	Name     string
+	Pass     string
+	Email    string
+	Verified bool
+	Renamed  time.Time // time of the last rename, for the rename cooldown
+	Created  time.Time
+	LastSeen time.Time
+
+	// profile
+	DisplayName string
+	Bio         string
+	Pronouns    string
+	Timezone    string
+	Avatar      string
+	Private     map[string]bool // profile fields hidden from whois, or shown when false
+
+	Prefs   map[string]string
+	Aliases map[string]string
+
+	// two-factor authentication
+	TOTPSecret  string
+	TOTPEnabled bool
+	TOTPLast    int64    // last time step used, to reject replays
+	Recovery    []string // hashes of unused recovery codes
+}
+
+// metaRecord is a single key/value setting in the meta collection.
+type metaRecord struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// corruptError reports a document that could not be decoded.
+type corruptError struct {
+	Col string
+	ID  int
+	Err error
+}
+
+func (e *corruptError) Error() string {
+	return fmt.Sprintf("corrupt %s document %d: %v", e.Col, e.ID, e.Err)
+}
+
+// decodeDoc decodes a tiedot document into the record pointed to by v.
+func decodeDoc(col string, id int, doc map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(b, v)
+	}
+	if err != nil {
+		return &corruptError{Col: col, ID: id, Err: err}
+	}
+	return nil
+}
+
+// decodeJSON decodes a raw tiedot document, as passed to ForEachDoc, into the
+// record pointed to by v.
+func decodeJSON(col string, id int, b []byte, v interface{}) error {
+	if err := json.Unmarshal(b, v); err != nil {
+		return &corruptError{Col: col, ID: id, Err: err}
+	}
+	return nil
+}
+
+// encodeDoc converts a record into a tiedot document.
+func encodeDoc(v interface{}) (doc map[string]interface{}, e error) {
+	b, e := json.Marshal(v)
+	if e == nil {
+		e = json.Unmarshal(b, &doc)
+	}
+	return
+}
+
+// decodeUser decodes a users collection document.
+func decodeUser(id int, doc map[string]interface{}) (r userRecord, e error) {
+	e = decodeDoc("users", id, doc, &r)
+	return
+}
+
+// migration upgrades the database from the previous schema version.
+type migration struct {
+	Desc string
+	Up   func() error
+}
+
+// migrations are applied in order. Migration n (counting from 1) upgrades a
+// database at version n-1 to version n. Never reorder or remove entries.
+var migrations = []migration{
+	{
+		Desc: "normalise user names and emails to lower case",
+		Up: func() error {
+			return eachUser(func(id int, r *userRecord) bool {
+				name, email := strings.ToLower(r.Name), strings.ToLower(r.Email)
+				changed := name != r.Name || email != r.Email
+				r.Name, r.Email = name, email
+				return changed
+			})
+		},
+	},
+	{
+		Desc: "mark existing email addresses as verified",
+		Up: func() error {
+			return eachUser(func(id int, r *userRecord) bool {
+				r.Verified = true
+				return true
+			})
+		},
+	},
+	{
+		Desc: "move the timezone preference to the profile",
+		Up: func() error {
+			return eachUser(func(id int, r *userRecord) bool {
+				tz, ok := r.Prefs["timezone"]
+				if !ok {
+					return false
+				}
+				if r.Timezone == "" {
+					r.Timezone = tz
+				}
+				delete(r.Prefs, "timezone")
+				return true
+			})
+		},
+	},
+}
+
+// eachUser calls fn for every decodable user record and saves the record when
+// fn returns true. Corrupt documents are logged and skipped.
+func eachUser(fn func(id int, r *userRecord) bool) (e error) {
+	var ids []int
+	userDB.ForEachDoc(func(id int, _ []byte) bool {
+		ids = append(ids, id)
+		return true
+	})
+	for _, id := range ids {
+		doc, err := userDB.Read(id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		r, err := decodeUser(id, doc)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if fn(id, &r) {
+			if doc, e = encodeDoc(r); e != nil {
+				return
+			}
+			if e = userDB.Update(id, doc); e != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// loadMetaDB opens the meta collection, creating it if needed.
+func loadMetaDB() (e error) {
+	metaDB, e = openCollection("meta", "Key")
+	return
+}
+
+// getMeta decodes the value stored under key into v. It returns false if the
+// key has never been set.
+func getMeta(key string, v interface{}) (ok bool, e error) {
+	ids, e := eq("Key", key).run(metaDB)
+	if e != nil || len(ids) == 0 {
+		return
+	}
+	doc, e := metaDB.Read(ids[0])
+	if e != nil {
+		return
+	}
+	var r metaRecord
+	if e = decodeDoc("meta", ids[0], doc, &r); e != nil {
+		return
+	}
+	return true, json.Unmarshal(r.Value, v)
+}
+
+// setMeta stores v under key.
+func setMeta(key string, v interface{}) (e error) {
+	b, e := json.Marshal(v)
+	if e != nil {
+		return
+	}
+	doc, e := encodeDoc(metaRecord{Key: key, Value: b})
+	if e != nil {
+		return
+	}
+	ids, e := eq("Key", key).run(metaDB)
+	if e != nil {
+		return
+	}
+	if len(ids) > 0 {
+		return metaDB.Update(ids[0], doc)
+	}
+	_, e = metaDB.Insert(doc)
+	return
+}
+
+// migrate applies any migrations newer than the stored schema version. A
+// database created fresh has no stored version and nothing to migrate.
+func migrate(fresh bool) (e error) {
+	version := 0
+	if fresh {
+		version = schemaVersion
+	} else if _, e = getMeta("schema", &version); e != nil {
+		return
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than this server (%d)", version, schemaVersion)
+	}
+	for ; version < schemaVersion; version++ {
+		m := migrations[version]
+		log.Printf("Migrating database to schema version %d: %s", version+1, m.Desc)
+		if e = m.Up(); e != nil {
+			return fmt.Errorf("migration %d failed: %v", version+1, e)
+		}
+		if e = setMeta("schema", version+1); e != nil {
+			return
+		}
+	}
+	return setMeta("schema", version)
+}
@@ -0,0 +1,709 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains user scripts. Scripts are Lua run by the pure Go gopher-lua
+interpreter in a fresh state for every run, with only the base, string, table
+and math libraries and the bindings below. Each state has a bounded call stack
+and registry. A user runs one script at a time and at most maxScriptRuns run
+at once, and a run is stopped when it takes longer than -script-timeout or the
+heap grows by more than -script-memory megabytes while it runs. Enabled
+scripts are also run as hooks: their on_join, on_message and on_timer
+functions are called once per owner when someone joins the chat server the
+owner is on, when a message is sent there and at a set interval.
+*/
+
+//
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	maxScripts      = 50
+	maxScriptLen    = 16 * 1024 // bytes of source
+	maxScriptOutput = 200       // lines a run may write
+	maxBroadcasts   = 3         // chat messages a run may send
+	maxStringRep    = 1 << 20   // longest string string.rep may build
+	maxStoreKeys    = 200
+	maxStoreValue   = 4096
+	maxHookRuns     = 2 // hooks running at once per client, more are skipped
+	maxScriptRuns   = 4 // scripts running at once, one per user
+	minHookInterval = time.Minute
+	scriptCallStack = 200
+	scriptRegistry  = 256 * 1024 // most values on the Lua stack
+)
+
+var scriptsDB, storeDB *db.Col
+
+// scriptSlots are held by the scripts running: the slot of their user, so one
+// user can't keep the others waiting, and one of maxScriptRuns in all, which
+// bounds the heap growth watchMemory sees from other runs.
+var scriptSlots = struct {
+	sync.Mutex
+	users map[int]chan struct{}
+	all   chan struct{}
+}{users: make(map[int]chan struct{}), all: make(chan struct{}, maxScriptRuns)}
+
+// errScriptsBusy is returned when a script waited -script-timeout for a
+// slot.
+var errScriptsBusy = errors.New("Too many scripts are running, try again later.")
+
+// scriptLock serialises changes to the scripts of a user and storeLock those
+// to their stored values.
+var scriptLock, storeLock sync.Mutex
+
+// scriptRecord is the stored form of a script.
+type scriptRecord struct {
+	UserID  int
+	Name    string
+	Source  string
+	Enabled bool          // run as hooks
+	Every   time.Duration // interval on_timer is called at, 0 for never
+	Updated time.Time
+}
+
+// storeRecord holds the values scripts of a user keep with kv.set.
+type storeRecord struct {
+	UserID int
+	Data   map[string]string
+}
+
+// loadScriptsDB opens the scripts and store collections, creating them if
+// needed.
+func loadScriptsDB() (e error) {
+	if scriptsDB, e = openCollection("scripts", "UserID"); e != nil {
+		return
+	}
+	storeDB, e = openCollection("store", "UserID")
+	return
+}
+
+// userScripts returns the scripts of the user keyed by document ID. The
+// caller holds dbLock.
+func userScripts(userID int) (scripts map[int]scriptRecord, e error) {
+	ids, e := eq("UserID", userID).run(scriptsDB)
+	if e != nil {
+		return
+	}
+	scripts = make(map[int]scriptRecord)
+	for _, id := range ids {
+		doc, err := scriptsDB.Read(id)
+		if err != nil {
+			continue
+		}
+		var r scriptRecord
+		if err = decodeDoc("scripts", id, doc, &r); err != nil {
+			log.Println(err)
+			continue
+		}
+		scripts[id] = r
+	}
+	return
+}
+
+// findScript returns the document ID and record of the script called name.
+func findScript(userID int, name string) (id int, r scriptRecord, e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	scripts, e := userScripts(userID)
+	if e != nil {
+		return
+	}
+	for id, r := range scripts {
+		if r.Name == name {
+			return id, r, nil
+		}
+	}
+	return 0, r, errors.New("No such script: " + name)
+}
+
+// listScripts returns the scripts of the user sorted by name.
+func listScripts(userID int) (list []scriptRecord, e error) {
+	dbLock.RLock()
+	scripts, e := userScripts(userID)
+	dbLock.RUnlock()
+	for _, r := range scripts {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return
+}
+
+// saveScript stores the source of the script called name, keeping whether it
+// is enabled.
+func saveScript(userID int, name, src string) (e error) {
+	if len(src) > maxScriptLen {
+		return fmt.Errorf("Scripts may be at most %d bytes long.", maxScriptLen)
+	}
+	return changeScript(userID, name, true, func(r *scriptRecord) {
+		r.Source = src
+	})
+}
+
+// changeScript applies change to the script called name and saves it. A new
+// script is added if create is set.
+func changeScript(userID int, name string, create bool, change func(r *scriptRecord)) (e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	scriptLock.Lock()
+	defer scriptLock.Unlock()
+	scripts, e := userScripts(userID)
+	if e != nil {
+		return
+	}
+	id, r := 0, scriptRecord{UserID: userID, Name: name}
+	for sid, sr := range scripts {
+		if sr.Name == name {
+			id, r = sid, sr
+		}
+	}
+	if id == 0 && !create {
+		return errors.New("No such script: " + name)
+	}
+	if id == 0 && len(scripts) >= maxScripts {
+		return fmt.Errorf("You can have at most %d scripts.", maxScripts)
+	}
+	change(&r)
+	r.Updated = time.Now().UTC()
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	if id == 0 {
+		_, e = scriptsDB.Insert(doc)
+		return
+	}
+	return scriptsDB.Update(id, doc)
+}
+
+// removeScript deletes the script called name.
+func removeScript(userID int, name string) error {
+	id, _, err := findScript(userID, name)
+	if err != nil {
+		return err
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return scriptsDB.Delete(id)
+}
+
+// deleteScripts removes every script and stored value of the user. The
+// caller holds dbLock.
+func deleteScripts(userID int) {
+	scripts, err := userScripts(userID)
+	if err != nil {
+		log.Println(err)
+	}
+	for id := range scripts {
+		if err := scriptsDB.Delete(id); err != nil {
+			log.Println(err)
+		}
+	}
+	if id, _, err := userStore(userID); err != nil {
+		log.Println(err)
+	} else if id != 0 {
+		if err := storeDB.Delete(id); err != nil {
+			log.Println(err)
+		}
+	}
+	scriptSlots.Lock()
+	delete(scriptSlots.users, userID)
+	scriptSlots.Unlock()
+}
+
+// userSlot returns the slot held by the running script of the user.
+func userSlot(userID int) chan struct{} {
+	scriptSlots.Lock()
+	defer scriptSlots.Unlock()
+	slot, ok := scriptSlots.users[userID]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		scriptSlots.users[userID] = slot
+	}
+	return slot
+}
+
+// userStore returns the document ID and record of the stored values of the
+// user. The ID is 0 if nothing is stored. The caller holds dbLock.
+func userStore(userID int) (id int, r storeRecord, e error) {
+	r = storeRecord{UserID: userID, Data: make(map[string]string)}
+	ids, e := eq("UserID", userID).run(storeDB)
+	if e != nil || len(ids) == 0 {
+		return
+	}
+	doc, e := storeDB.Read(ids[0])
+	if e != nil {
+		return
+	}
+	if e = decodeDoc("store", ids[0], doc, &r); e != nil {
+		return
+	}
+	if r.Data == nil {
+		r.Data = make(map[string]string)
+	}
+	return ids[0], r, nil
+}
+
+// loadStore returns the values stored by the scripts of the user.
+func loadStore(userID int) (map[string]string, error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	_, r, err := userStore(userID)
+	return r.Data, err
+}
+
+// setStoreValue stores value under key, or deletes key if del is set, and
+// returns the updated values.
+func setStoreValue(userID int, key, value string, del bool) (data map[string]string, e error) {
+	if len(value) > maxStoreValue {
+		return nil, fmt.Errorf("values may be at most %d bytes long", maxStoreValue)
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	id, r, e := userStore(userID)
+	if e != nil {
+		return
+	}
+	if _, ok := r.Data[key]; !ok && !del && len(r.Data) >= maxStoreKeys {
+		return nil, fmt.Errorf("at most %d keys can be stored", maxStoreKeys)
+	}
+	if del {
+		delete(r.Data, key)
+	} else {
+		r.Data[key] = value
+	}
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	if id == 0 {
+		_, e = storeDB.Insert(doc)
+	} else {
+		e = storeDB.Update(id, doc)
+	}
+	return r.Data, e
+}
+
+// completeScripts returns the names of the scripts of c.
+func completeScripts(c *client) (list []string) {
+	if !c.user.auth {
+		return
+	}
+	scripts, err := listScripts(c.user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, r := range scripts {
+		list = append(list, r.Name)
+	}
+	return
+}
+
+// scriptRun is a script being run.
+type scriptRun struct {
+	c          *client
+	who        identity
+	out        output
+	lines      int // written so far
+	broadcasts int
+	store      map[string]string // loaded on first use
+}
+
+// runScript runs src as the script called name. If fn is set the global
+// function of that name is then called with params, unless the script doesn't
+// define it. The script sees words as args and in as input.
+func (c *client) runScript(ctx context.Context, name, src string, out output, words, in []string, fn string, params ...lua.LValue) (e error) {
+	who := c.who(ctx)
+	busy := time.After(*scriptTimeout)
+	for _, slot := range []chan struct{}{userSlot(who.user.ID), scriptSlots.all} {
+		select {
+		case slot <- struct{}{}:
+			defer func(slot chan struct{}) { <-slot }(slot)
+		case <-ctx.Done():
+			return errCancelled
+		case <-busy:
+			return errScriptsBusy
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, *scriptTimeout)
+	defer cancel()
+	var over int32
+	go watchMemory(ctx, cancel, &over)
+	r := &scriptRun{c: c, who: who, out: out}
+	L := r.state(words, in)
+	defer L.Close()
+	L.SetContext(ctx)
+	f, e := L.Load(strings.NewReader(src), name)
+	if e == nil {
+		L.Push(f)
+		e = L.PCall(0, 0, nil)
+	}
+	if e == nil && fn != "" {
+		if f, ok := L.GetGlobal(fn).(*lua.LFunction); ok {
+			e = L.CallByParam(lua.P{Fn: f, Protect: true}, params...)
+		}
+	}
+	if e == nil {
+		return
+	}
+	switch {
+	case atomic.LoadInt32(&over) != 0:
+		return errors.New("Script used too much memory.")
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("Script took longer than %s.", *scriptTimeout)
+	case ctx.Err() != nil:
+		return errCancelled
+	}
+	if err, ok := e.(*lua.ApiError); ok && err.Object != nil {
+		// leave out the stack trace
+		return errors.New(err.Object.String())
+	}
+	return
+}
+
+// watchMemory cancels a run when the heap grows by more than -script-memory
+// megabytes before ctx is done. gopher-lua can't account for the memory of a
+// state, so growth from the few other runs holding scriptSlots counts too.
+func watchMemory(ctx context.Context, cancel context.CancelFunc, over *int32) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	limit := m.HeapAlloc + uint64(*scriptMemory)<<20
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if runtime.ReadMemStats(&m); m.HeapAlloc > limit {
+				atomic.StoreInt32(over, 1)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// state returns a sandboxed Lua state with the bindings of r.
+func (r *scriptRun) state(words, in []string) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStack,
+		RegistrySize:    1024,
+		RegistryMaxSize: scriptRegistry,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// nothing that reaches the file system or loads code
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if s, ok := L.GetGlobal("string").(*lua.LTable); ok {
+		s.RawSetString("rep", L.NewFunction(luaRep))
+	}
+	L.SetGlobal("print", L.NewFunction(r.print))
+	L.SetGlobal("appendMsg", L.NewFunction(r.appendMsg))
+	L.SetGlobal("broadcast", L.NewFunction(r.broadcast))
+	L.SetGlobal("user", L.NewFunction(r.user))
+	L.SetGlobal("kv", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":  r.kvGet,
+		"set":  r.kvSet,
+		"keys": r.kvKeys,
+	}))
+	L.SetGlobal("args", luaList(L, words))
+	L.SetGlobal("input", luaList(L, in))
+	L.SetGlobal("me", lua.LString(r.who.user.Name))
+	L.SetGlobal("server", lua.LString(r.who.server))
+	return L
+}
+
+// luaList returns items as a Lua array.
+func luaList(L *lua.LState, items []string) *lua.LTable {
+	t := L.NewTable()
+	for _, s := range items {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+// luaRep is string.rep limited to results of maxStringRep bytes.
+func luaRep(L *lua.LState) int {
+	s, n := L.CheckString(1), L.CheckInt(2)
+	if n <= 0 || s == "" {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if n > maxStringRep/len(s) {
+		L.RaiseError("string.rep result longer than %d bytes", maxStringRep)
+	}
+	L.Push(lua.LString(strings.Repeat(s, n)))
+	return 1
+}
+
+// writeLine writes a line to the output of the run.
+func (r *scriptRun) writeLine(L *lua.LState, out output, text string) {
+	if r.lines++; r.lines > maxScriptOutput {
+		L.RaiseError("more than %d lines of output", maxScriptOutput)
+	}
+	if err := out.writeLine(text); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+}
+
+// print writes its arguments separated by spaces as a line of output.
+func (r *scriptRun) print(L *lua.LState) int {
+	words := make([]string, L.GetTop())
+	for i := range words {
+		words[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	r.writeLine(L, r.out, strings.Join(words, " "))
+	return 0
+}
+
+// appendMsg shows a line in the message list even when the output of the
+// script is piped.
+func (r *scriptRun) appendMsg(L *lua.LState) int {
+	r.writeLine(L, msgOutput{r.c}, L.CheckString(1))
+	return 0
+}
+
+// broadcast sends a chat message to the server the user is connected to.
+func (r *scriptRun) broadcast(L *lua.LState) int {
+	text := strings.TrimSpace(L.CheckString(1))
+	if text == "" {
+		L.ArgError(1, "empty message")
+	}
+	if r.broadcasts++; r.broadcasts > maxBroadcasts {
+		L.RaiseError("more than %d messages sent", maxBroadcasts)
+	}
+	name := r.who.server
+	if name == "" || !servers.broadcast(name, roomMessage{Kind: "message", From: r.who.user.Name, Text: text, Origin: "script"}) {
+		L.RaiseError("not connected to a server")
+	}
+	return 0
+}
+
+// user returns the public profile of the named user, or nil.
+func (r *scriptRun) user(L *lua.LState) int {
+	id, u, err := userByName(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	full := r.who.user.ID == id || r.who.user.isAdmin()
+	t := L.NewTable()
+	t.RawSetString("name", lua.LString(u.Name))
+	for _, f := range profileFields {
+		if v := *f.value(&u); v != "" && (full || !isPrivate(&u, f.Name)) {
+			t.RawSetString(f.Name, lua.LString(v))
+		}
+	}
+	if full || !isPrivate(&u, "lastseen") {
+		t.RawSetString("online", lua.LBool(len(sessions.byUser(id)) > 0))
+	}
+	L.Push(t)
+	return 1
+}
+
+// values returns the stored values of the user, loading them if needed.
+func (r *scriptRun) values(L *lua.LState) map[string]string {
+	if r.store == nil {
+		data, err := loadStore(r.who.user.ID)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		r.store = data
+	}
+	return r.store
+}
+
+// kvGet returns the value stored under a key, or nil.
+func (r *scriptRun) kvGet(L *lua.LState) int {
+	if v, ok := r.values(L)[L.CheckString(1)]; ok {
+		L.Push(lua.LString(v))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// kvSet stores a value under a key. Setting nil deletes the key.
+func (r *scriptRun) kvSet(L *lua.LState) int {
+	key, value, del := L.CheckString(1), "", L.Get(2) == lua.LNil
+	if !del {
+		value = L.CheckString(2)
+	}
+	data, err := setStoreValue(r.who.user.ID, key, value, del)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	r.store = data
+	return 0
+}
+
+// kvKeys returns the stored keys sorted.
+func (r *scriptRun) kvKeys(L *lua.LState) int {
+	var keys []string
+	for key := range r.values(L) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	L.Push(luaList(L, keys))
+	return 1
+}
+
+// hookSet holds the enabled scripts of a client.
+type hookSet struct {
+	sync.Mutex
+	scripts []scriptRecord
+	ctx     context.Context
+	cancel  context.CancelFunc // stops the timers and running hooks
+	busy    chan struct{}
+}
+
+// loadHooks enables the scripts of the user marked as hooks, replacing those
+// already running.
+func (c *client) loadHooks() {
+	c.stopHooks()
+	// IRC sessions have nowhere to show what scripts print
+	if !c.user.auth || c.irc != nil {
+		return
+	}
+	list, err := listScripts(c.user.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var enabled []scriptRecord
+	for _, r := range list {
+		if r.Enabled {
+			enabled = append(enabled, r)
+		}
+	}
+	if len(enabled) == 0 {
+		return
+	}
+	c.hooks.Lock()
+	defer c.hooks.Unlock()
+	c.hooks.scripts = enabled
+	c.hooks.ctx, c.hooks.cancel = context.WithCancel(context.Background())
+	c.hooks.busy = make(chan struct{}, maxHookRuns)
+	for _, r := range enabled {
+		if r.Every > 0 {
+			go c.hookTimer(c.hooks.ctx, c.hooks.busy, r)
+		}
+	}
+}
+
+// stopHooks disables the hooks of c, as when the user logs out.
+func (c *client) stopHooks() {
+	c.hooks.Lock()
+	defer c.hooks.Unlock()
+	if c.hooks.cancel != nil {
+		c.hooks.cancel()
+	}
+	c.hooks.scripts, c.hooks.cancel = nil, nil
+}
+
+// reloadHooks reloads the hooks of every session of the user.
+func reloadHooks(userID int) {
+	for _, c := range sessions.byUser(userID) {
+		c.loadHooks()
+	}
+}
+
+// fireHooks runs the hooks for m of the users among members, once per user
+// however many of their sessions are on the server. It doesn't wait for them.
+// Messages sent by scripts don't run hooks, so scripts can't set each other
+// off.
+func fireHooks(members map[string]member, m roomMessage) {
+	if m.Origin == "script" || (m.Kind != "join" && m.Kind != "message") {
+		return
+	}
+	fired := make(map[int]bool)
+	for _, v := range members {
+		if c, ok := v.(*client); ok && c.user.auth && !fired[c.user.ID] {
+			fired[c.user.ID] = true
+			c.fireHooks(m)
+		}
+	}
+}
+
+// fireHooks runs the hooks of c for m without waiting for them.
+func (c *client) fireHooks(m roomMessage) {
+	c.hooks.Lock()
+	scripts, ctx, busy := c.hooks.scripts, c.hooks.ctx, c.hooks.busy
+	c.hooks.Unlock()
+	for _, r := range scripts {
+		go c.runHook(ctx, busy, r, "on_"+m.Kind, lua.LString(m.From), lua.LString(m.Room), lua.LString(m.Text))
+	}
+}
+
+// hookTimer calls the on_timer function of r every interval until ctx is done.
+func (c *client) hookTimer(ctx context.Context, busy chan struct{}, r scriptRecord) {
+	t := time.NewTicker(r.Every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			// the timers of the other sessions of the user are skipped
+			if firstSession(sessions.byUser(c.user.ID)) == c {
+				c.runHook(ctx, busy, r, "on_timer")
+			}
+		}
+	}
+}
+
+// runHook calls the function fn of r, unless too many hooks are running.
+func (c *client) runHook(ctx context.Context, busy chan struct{}, r scriptRecord, fn string, params ...lua.LValue) {
+	select {
+	case busy <- struct{}{}:
+		defer func() { <-busy }()
+	default:
+		return
+	}
+	out := hookOutput{c, r.Name}
+	if err := c.runScript(ctx, r.Name, r.Source, out, nil, nil, fn, params...); err != nil && err != errCancelled && err != errScriptsBusy {
+		out.writeLine("Error: " + err.Error())
+	}
+}
+
+// hookOutput shows the lines written by a hook tagged with the script name.
+type hookOutput struct {
+	c    *client
+	name string
+}
+
+func (o hookOutput) writeLine(text string) error {
+	return o.c.appendMsg("#msg-list", "["+o.name+"] "+text)
+}
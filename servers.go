@@ -7,56 +7,218 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	//"strings"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-var servers serverList
+const maxTopicLen = 300
 
-func init() {
-	servers = make(serverList)
+// serverList holds the open chat servers by name.
+type serverList struct {
+	sync.Mutex
+	m map[string]*server
 }
 
-type serverList map[string]*server
+var servers = serverList{m: make(map[string]*server)}
 
-func (sl *serverList) exists(name string) (b bool) {
-	_, b = (*sl)[name]
+// get returns the open chat server called name.
+func (sl *serverList) get(name string) (s *server, ok bool) {
+	sl.Lock()
+	defer sl.Unlock()
+	s, ok = sl.m[name]
 	return
 }
 
-func (c *client) connect(name string) {
-	if servers.exists(name) == false {
-		servers[name] = newServer(name)
-		go servers[name].hub()
+func (sl *serverList) exists(name string) bool {
+	_, ok := sl.get(name)
+	return ok
+}
+
+// names returns the names of the open servers sorted.
+func (sl *serverList) names() (list []string) {
+	sl.Lock()
+	for name := range sl.m {
+		list = append(list, name)
+	}
+	sl.Unlock()
+	sort.Strings(list)
+	return
+}
+
+// broadcast sends m to the chat server name. It returns false if nobody is
+// on it.
+func (sl *serverList) broadcast(name string, m roomMessage) bool {
+	s, ok := sl.get(name)
+	return ok && s.send(m)
+}
+
+// close removes s from the list, unless a new server took its name.
+func (sl *serverList) close(s *server) {
+	sl.Lock()
+	if sl.m[s.name] == s {
+		delete(sl.m, s.name)
+	}
+	sl.Unlock()
+}
+
+// member is a session on a chat server, a browser client or an IRC connection.
+type member interface {
+	sessionID() string
+	nick() string
+	// deliver shows m to the member. It is called from the hub goroutine.
+	deliver(m roomMessage)
+}
+
+// openServer returns the chat server name, opening it if nobody is on it yet.
+func openServer(name string) *server {
+	servers.Lock()
+	defer servers.Unlock()
+	s, ok := servers.m[name]
+	if !ok {
+		s = newServer(name)
+		servers.m[name] = s
+		go s.hub()
+	}
+	return s
+}
+
+// enter adds m to the chat server name, opening it if nobody is on it yet.
+func enter(name string, m member) *server {
+	for {
+		// a server closing as its last member leaves is opened again
+		if s := openServer(name); s.add(m) {
+			return s
+		}
 	}
+}
+
+// join adds m to the chat server name and tells its members.
+func join(name string, m member) {
+	enter(name, m).send(roomMessage{Kind: "join", From: m.nick(), Session: m.sessionID()})
+}
+
+// part removes m from the chat server name.
+func part(name string, m member) error {
+	if s, ok := servers.get(name); ok && s.isConnected(m) {
+		s.send(roomMessage{Kind: "part", From: m.nick(), Session: m.sessionID()})
+		s.remove(m)
+		return nil
+	}
+	return errors.New("Not connected to a server.")
+}
+
+func (c *client) connect(name string) {
 	c.server = name
-	servers[name].connect <- c
-	servers[name].broadcast <- c.user.Name + " has connected."
+	join(name, c)
 	c.command = &chatCommands
 	c.cmdPrefix = "/"
+	c.showMotd(name)
+	if topic, err := getTopic(name); err != nil {
+		log.Println(err)
+	} else if topic != "" {
+		c.appendMsg("#msg-list", "Topic: "+topic)
+	}
 }
 
 func (c *client) disconnect() error {
-	name := c.server
-	if servers.exists(name) && servers[name].isConnected(c.user) {
-		(*servers[name]).broadcast <- c.user.Name + " has disconnected."
-		(*servers[name]).disconnect <- c
-		c.server = ""
-		c.command = &sysCommands
-		c.cmdPrefix = ""
-		return nil
+	if err := part(c.server, c); err != nil {
+		return err
+	}
+	c.server = ""
+	c.command = &sysCommands
+	c.cmdPrefix = ""
+	return nil
+}
+
+func (c *client) sessionID() string { return c.id }
+
+func (c *client) nick() string { return c.user.Name }
+
+func (c *client) deliver(m roomMessage) {
+	c.appendMsg("#msg-list", c.stamp(m.Time)+m.line())
+	if sound, _ := c.pref("sound"); sound == "on" {
+		c.sound("message")
 	}
-	return errors.New("Not connected to a server.")
+}
+
+// roomMessage is something said or done on a chat server.
+type roomMessage struct {
+	ID      string // unique, so linked servers can tell messages they have seen
+	Kind    string // message, join, part, nick or topic
+	Room    string
+	From    string
+	Text    string // the message, the new name for nick or the new topic
+	Bot     bool   // posted by an incoming webhook
+	Origin  string // what relayed the message, "" for users on this server
+	Session string // ID of the session that sent it, if any
+	Time    time.Time
+}
+
+// line returns m as shown in the message list.
+func (m roomMessage) line() string {
+	from := m.From
+	if m.Bot {
+		from += " [bot]"
+	}
+	switch m.Kind {
+	case "join":
+		return from + " has connected."
+	case "part":
+		return from + " has disconnected."
+	case "nick":
+		return from + " is now known as " + m.Text + "."
+	case "topic":
+		if m.Text == "" {
+			return from + " cleared the topic."
+		}
+		return from + " set the topic: " + m.Text
+	}
+	return fmt.Sprintf("<%s> %s", from, m.Text)
 }
 
 type server struct {
-	connections map[string]*client
-	connect     chan *client
-	disconnect  chan *client
-	broadcast   chan string
+	// guards connections, which only the hub changes
+	sync.Mutex
+	connections map[string]member // keyed by session ID
+	connect     chan member
+	disconnect  chan member
+	broadcast   chan roomMessage
+	done        chan struct{} // closed when the hub stops
 	name        string
 }
 
+// send passes m to the hub of s. It returns false if the hub has stopped.
+func (s *server) send(m roomMessage) bool {
+	select {
+	case s.broadcast <- m:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// add makes m a member of s. It returns false if the hub has stopped.
+func (s *server) add(m member) bool {
+	select {
+	case s.connect <- m:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// remove takes m off s.
+func (s *server) remove(m member) {
+	select {
+	case s.disconnect <- m:
+	case <-s.done:
+	}
+}
+
 func (s *server) empty() bool {
 	if len(s.connections) == 0 {
 		return true
@@ -64,29 +226,67 @@ func (s *server) empty() bool {
 	return false
 }
 
-func (s *server) isConnected(u user) bool {
-	if _, ok := s.connections[u.Name]; ok {
+func (s *server) isConnected(m member) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.connections[m.sessionID()]; ok {
 		return true
 	}
 	return false
 }
 
+// members returns the members of s.
+func (s *server) members() (list []member) {
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range s.connections {
+		list = append(list, m)
+	}
+	return
+}
+
+// nicks returns the names of the members sorted, once per name.
+func (s *server) nicks() (list []string) {
+	s.Lock()
+	seen := make(map[string]bool)
+	for _, m := range s.connections {
+		if name := m.nick(); !seen[name] {
+			seen[name] = true
+			list = append(list, name)
+		}
+	}
+	s.Unlock()
+	sort.Strings(list)
+	return
+}
+
 func (s *server) hub() {
 	defer log.Println("Server closed")
+	defer close(s.done)
 	for {
 		select {
-		case c := <-s.connect:
-			s.connections[c.user.Name] = c
-		case c := <-s.disconnect:
-			delete(s.connections, c.user.Name)
+		case m := <-s.connect:
+			s.Lock()
+			s.connections[m.sessionID()] = m
+			s.Unlock()
+		case m := <-s.disconnect:
+			s.Lock()
+			delete(s.connections, m.sessionID())
+			s.Unlock()
 			if s.empty() {
-				delete(servers, s.name)
+				servers.close(s)
 				return
 			}
-		case msg := <-s.broadcast:
+		case m := <-s.broadcast:
+			m.Room, m.Time = s.name, time.Now()
+			if m.ID == "" {
+				m.ID = randHex(8)
+			}
 			for _, v := range s.connections {
-				v.appendMsg("#msg-list", msg)
+				v.deliver(m)
 			}
+			fireHooks(s.connections, m)
+			sendWebhooks(m)
 		}
 	}
 }
@@ -94,9 +294,38 @@ func (s *server) hub() {
 func newServer(name string) (s *server) {
 	s = new(server)
 	s.name = name
-	s.connections = make(map[string]*client)
-	s.connect = make(chan *client)
-	s.disconnect = make(chan *client)
-	s.broadcast = make(chan string)
+	s.connections = make(map[string]member)
+	s.connect = make(chan member)
+	s.disconnect = make(chan member)
+	s.broadcast = make(chan roomMessage)
+	s.done = make(chan struct{})
 	return
 }
+
+// getTopic returns the topic of the chat server name, "" if it has none.
+func getTopic(name string) (topic string, e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	_, e = getMeta("topic:"+strings.ToLower(name), &topic)
+	return
+}
+
+// storeTopic stores the topic of the chat server name. An empty topic removes
+// it.
+func storeTopic(name, topic string) error {
+	if len(topic) > maxTopicLen {
+		return fmt.Errorf("Topics may be at most %d characters long.", maxTopicLen)
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return setMeta("topic:"+strings.ToLower(name), topic)
+}
+
+// setTopic stores the topic of the chat server name and tells its members.
+func setTopic(name, topic, from, session string) error {
+	if err := storeTopic(name, topic); err != nil {
+		return err
+	}
+	servers.broadcast(name, roomMessage{Kind: "topic", From: from, Text: topic, Session: session})
+	return nil
+}
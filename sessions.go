@@ -0,0 +1,115 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the list of online sessions. Each websocket or IRC
+connection is a session with its own ID, so one account may be logged in from
+several devices.
+*/
+
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var sessionCount uint64
+
+// sessionList holds every connected client keyed by session ID.
+type sessionList struct {
+	sync.Mutex
+	m map[string]*client
+}
+
+var sessions = sessionList{m: make(map[string]*client)}
+
+// newSessionID returns a unique ID for a new session.
+func newSessionID() string {
+	return fmt.Sprintf("s%d", atomic.AddUint64(&sessionCount, 1))
+}
+
+func (sl *sessionList) add(c *client) {
+	sl.Lock()
+	sl.m[c.id] = c
+	sl.Unlock()
+}
+
+func (sl *sessionList) remove(c *client) {
+	sl.Lock()
+	delete(sl.m, c.id)
+	sl.Unlock()
+}
+
+// nameTaken returns true if a session other than c is using name. Sessions
+// logged into the same account as c don't count.
+func (sl *sessionList) nameTaken(name string, c *client) bool {
+	sl.Lock()
+	defer sl.Unlock()
+	for _, other := range sl.m {
+		if other == c || !strings.EqualFold(other.user.Name, name) {
+			continue
+		}
+		if c != nil && c.user.auth && other.user.auth && c.user.ID == other.user.ID {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// list returns every session.
+func (sl *sessionList) list() (list []*client) {
+	sl.Lock()
+	defer sl.Unlock()
+	for _, c := range sl.m {
+		list = append(list, c)
+	}
+	return
+}
+
+// byUser returns the sessions logged into the account with id.
+func (sl *sessionList) byUser(id int) (list []*client) {
+	sl.Lock()
+	defer sl.Unlock()
+	for _, c := range sl.m {
+		if c.user.auth && c.user.ID == id {
+			list = append(list, c)
+		}
+	}
+	return
+}
+
+// names returns the names in use by online sessions, without duplicates.
+func (sl *sessionList) names() (list []string) {
+	sl.Lock()
+	defer sl.Unlock()
+	seen := make(map[string]bool)
+	for _, c := range sl.m {
+		// IRC sessions have no name until they log in
+		if key := strings.ToLower(c.user.Name); key != "" && !seen[key] {
+			seen[key] = true
+			list = append(list, c.user.Name)
+		}
+	}
+	return
+}
+
+// firstSession returns the session of list that was opened first, or nil.
+// IRC sessions, which don't run hooks, are skipped.
+func firstSession(list []*client) (first *client) {
+	for _, c := range list {
+		if c.irc != nil {
+			continue
+		}
+		// IDs are s1, s2 and so on
+		if first == nil || len(c.id) < len(first.id) || (len(c.id) == len(first.id) && c.id < first.id) {
+			first = c
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains the single-use, expiring tokens sent to users by email for
+address verification and password resets. Only a hash of each token is stored.
+*/
+
+//
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	verifyToken = "verify"
+	resetToken  = "reset"
+)
+
+var tokenDB *db.Col
+
+// tokenLock serialises changes to the tokens, so that a token is used once
+// and a new one replaces the old.
+var tokenLock sync.Mutex
+
+var errBadToken = errors.New("Invalid or expired code.")
+
+// tokenRecord is the stored form of an emailed token.
+type tokenRecord struct {
+	Hash    string
+	Kind    string
+	UserID  int
+	Email   string
+	Expires time.Time
+}
+
+// loadTokenDB opens the tokens collection, creating it if needed.
+func loadTokenDB() (e error) {
+	tokenDB, e = openCollection("tokens", "Hash")
+	return
+}
+
+// randToken returns a random, human-typeable token.
+func randToken() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.EncodeToString(b)
+}
+
+// hashToken returns the stored form of token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(token))))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken stores a new token of kind for the user and returns it. It
+// replaces any earlier token of that kind, only the latest one works.
+func newToken(kind string, id int, email string, ttl time.Duration) (token string, e error) {
+	token = randToken()
+	doc, e := encodeDoc(tokenRecord{Hash: hashToken(token), Kind: kind, UserID: id,
+		Email: email, Expires: time.Now().Add(ttl)})
+	if e != nil {
+		return "", e
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	removeTokens(func(r tokenRecord) bool { return r.UserID == id && r.Kind == kind })
+	_, e = tokenDB.Insert(doc)
+	return
+}
+
+// useToken consumes a token of kind and returns its record. A token can only
+// be used once and is rejected after it expires.
+func useToken(kind, token string) (r tokenRecord, e error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	ids, e := eq("Hash", hashToken(token)).run(tokenDB)
+	if e != nil {
+		return
+	}
+	for _, id := range ids {
+		doc, err := tokenDB.Read(id)
+		if err != nil {
+			continue
+		}
+		if err = decodeDoc("tokens", id, doc, &r); err != nil {
+			log.Println(err)
+			continue
+		}
+		if r.Kind != kind {
+			continue
+		}
+		if err = tokenDB.Delete(id); err != nil {
+			return r, err
+		}
+		if time.Now().After(r.Expires) {
+			return r, errBadToken
+		}
+		return r, nil
+	}
+	return r, errBadToken
+}
+
+// sendVerification emails a verification code to the address on record.
+func sendVerification(id int, r userRecord) error {
+	code, err := newToken(verifyToken, id, r.Email, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\nYour soshell verification code is:\n\n\t%s\n\n"+
+		"Enter \"verify %s\" in the console to confirm this address. The code expires in 24 hours.\n",
+		strings.Title(r.Name), code, code)
+	return mail.send(r.Email, "Verify your soshell email address", body)
+}
+
+// sendReset emails a password reset token to the address on record.
+func sendReset(id int, r userRecord) error {
+	token, err := newToken(resetToken, id, r.Email, time.Hour)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\nSomeone asked to reset the password for your soshell account.\n"+
+		"If it was you, enter \"reset %s\" in the console. The token expires in 1 hour.\n\n"+
+		"If it wasn't you, you can ignore this message.\n", strings.Title(r.Name), token)
+	return mail.send(r.Email, "Reset your soshell password", body)
+}
+
+// clearTokens removes all outstanding tokens for the user, so that none
+// outlives a change of password or address.
+func clearTokens(userID int) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	deleteTokens(userID)
+}
+
+// deleteTokens is clearTokens for callers already holding dbLock.
+func deleteTokens(userID int) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	removeTokens(func(r tokenRecord) bool { return r.UserID == userID })
+}
+
+// pruneTokens removes the tokens that expired before now and returns how
+// many it removed.
+func pruneTokens(now time.Time) int {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	return removeTokens(func(r tokenRecord) bool { return now.After(r.Expires) })
+}
+
+// removeTokens deletes the tokens match accepts and returns how many it
+// deleted. The caller must hold dbLock and tokenLock.
+func removeTokens(match func(r tokenRecord) bool) (n int) {
+	var ids []int
+	tokenDB.ForEachDoc(func(id int, b []byte) bool {
+		var r tokenRecord
+		if err := decodeJSON("tokens", id, b, &r); err == nil && match(r) {
+			ids = append(ids, id)
+		}
+		return true
+	})
+	for _, id := range ids {
+		if err := tokenDB.Delete(id); err != nil {
+			log.Println(err)
+		} else {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains RFC 6238 time-based one-time passwords (TOTP) used for
+optional two-factor authentication, along with single-use recovery codes.
+*/
+
+//
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpStep      = 30 // seconds
+	totpDigits    = 6
+	totpSkew      = 1 // steps either side of now that are accepted
+	recoveryCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random base32 encoded secret.
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI returns the otpauth:// provisioning URI for authenticator apps.
+func totpURI(name, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", *hostname)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpStep))
+	return "otpauth://totp/" + url.PathEscape(*hostname+":"+name) + "?" + v.Encode()
+}
+
+// hotp returns the RFC 4226 code for counter.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%uint32(math.Pow10(totpDigits)))
+}
+
+// checkTOTP returns the time step code matches, or 0 if it matches none of
+// the steps within totpSkew of t that are newer than last. Rejecting steps at
+// or before last stops a code from being used twice.
+func checkTOTP(secret, code string, t time.Time, last int64) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	now := t.Unix() / totpStep
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// newRecoveryCodes returns fresh recovery codes along with their hashes.
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCount; i++ {
+		code := strings.ToLower(randToken()[:10])
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return
+}
+
+// secondFactor checks code against the TOTP secret and recovery codes of r,
+// consuming whichever matched. The caller must save r when it returns true.
+func secondFactor(r *userRecord, code string) bool {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if step := checkTOTP(r.TOTPSecret, code, time.Now(), r.TOTPLast); step > 0 {
+		r.TOTPLast = step
+		return true
+	}
+	h := hashToken(strings.ToLower(strings.Replace(code, "-", "", -1)))
+	for i, rc := range r.Recovery {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+			r.Recovery = append(r.Recovery[:i], r.Recovery[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
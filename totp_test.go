@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTPVectors(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6238 appendix B, cut to six digits
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		if got := hotp(key, uint64(unix/totpStep)); got != want {
+			t.Errorf("hotp at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpStep
+	for _, c := range []struct {
+		name string
+		code string
+		at   time.Time
+		last int64
+		want int64
+	}{
+		{"current step", "050471", now, 0, step},
+		{"previous step", "081804", now, 0, step - 1},
+		{"next step", "050471", now.Add(-totpStep * time.Second), 0, step},
+		{"too old", "081804", now.Add(totpStep * time.Second), 0, 0},
+		{"too new", "050471", now.Add(-2 * totpStep * time.Second), 0, 0},
+		{"wrong code", "123456", now, 0, 0},
+		{"short code", "50471", now, 0, 0},
+		{"replayed", "050471", now, step, 0},
+		{"older than last", "081804", now, step, 0},
+		{"newer than last", "050471", now, step - 1, step},
+	} {
+		if got := checkTOTP(rfcSecret, c.code, c.at, c.last); got != c.want {
+			t.Errorf("%s: checkTOTP = %d, want %d", c.name, got, c.want)
+		}
+	}
+	if got := checkTOTP("not base32!", "050471", now, 0); got != 0 {
+		t.Errorf("bad secret: checkTOTP = %d, want 0", got)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCount || len(hashes) != recoveryCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCount)
+	}
+	r := userRecord{Recovery: hashes}
+	if !secondFactor(&r, codes[3]) {
+		t.Fatal("recovery code refused")
+	}
+	if len(r.Recovery) != recoveryCount-1 {
+		t.Errorf("%d recovery codes left, want %d", len(r.Recovery), recoveryCount-1)
+	}
+	if secondFactor(&r, codes[3]) {
+		t.Error("recovery code accepted twice")
+	}
+}
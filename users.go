@@ -6,13 +6,13 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/tiedot/db"
@@ -25,21 +25,21 @@ var (
 )
 
 var (
-	users     map[string]*user
-	guestlist map[string]bool
+	userLock    sync.Mutex
+	errNoUser   = errors.New("User not found.")
+	errReserved = errors.New("That name is reserved.") // names given by -admins
+	errBadPass  = errors.New("Password incorrect.")
+	errBadCode  = errors.New("Bad authentication code.")
+	guestReg    = regexp.MustCompile("^(?i)guest[0-9]+$")
 )
 
 type user struct {
 	Email, Name string
 	auth        bool
+	verified    bool
 	ID          int
 }
 
-func init() {
-	users = make(map[string]*user)
-	guestlist = make(map[string]bool)
-}
-
 // isEmail makes she that email is properly formated as an email address.
 func isEmail(email string) bool {
 	reg := regexp.MustCompile("^([\\w\\.\\-_]+)?\\w+@[\\w-_]+(\\.\\w+){1,}$")
@@ -58,41 +58,92 @@ func randNum() string {
 	return fmt.Sprintf("%d%d%d%d%d", ar[0], ar[1], ar[2], ar[3], ar[4])
 }
 
+// guestName returns a Guest##### name that is neither online nor registered.
 func guestName() string {
-	name := "Guest" + randNum()
 	for {
-		if _, ok := guestlist[name]; ok {
-			name = "Guest" + randNum()
-		} else {
-			guestlist[name] = true
-			break
+		name := "Guest" + randNum()
+		if !sessions.nameTaken(name, nil) && !userExists(name) {
+			return name
 		}
 	}
-	return name
 }
 
-func loadUserDB() {
-	var err error
-	database, err = db.OpenDB(*dbpath + SEP + "database")
-	if err != nil {
-		log.Fatal(err)
+// isGuestName returns true if name has the form used for guest names. Such
+// names can't be registered.
+func isGuestName(name string) bool {
+	return guestReg.MatchString(name)
+}
+
+// checkName returns an error if name can't be used for an account.
+func checkName(name string) error {
+	if !isName(name) {
+		return errors.New("Invalid characters in name.")
 	}
-	if err := database.Create("users"); err == nil {
-		userDB = database.Use("users")
-		if err := userDB.Index([]string{"Name"}); err != nil {
-			log.Println(err)
-		}
-		if err := userDB.Index([]string{"Pass"}); err != nil {
-			log.Println(err)
+	if len(name) > 32 {
+		return errors.New("Names can be at most 32 characters.")
+	}
+	if isGuestName(name) {
+		return errors.New("Guest names are reserved.")
+	}
+	return nil
+}
+
+// openCollection returns the collection name, creating it with an index on
+// each of paths if it doesn't exist yet.
+func openCollection(name string, paths ...string) (col *db.Col, e error) {
+	if err := database.Create(name); err == nil {
+		col = database.Use(name)
+		for _, path := range paths {
+			if err := col.Index([]string{path}); err != nil {
+				log.Println(err)
+			}
 		}
-		if err := userDB.Index([]string{"Email"}); err != nil {
-			log.Println(err)
+		return
+	}
+	if col = database.Use(name); col == nil {
+		e = fmt.Errorf("Can't open the %s collection.", name)
+	}
+	return
+}
+
+// loadUserDB opens the database and its collections and brings the schema up
+// to date. It doesn't start anything running off them, see startServices.
+func loadUserDB() (e error) {
+	if database, e = db.OpenDB(*dbpath + SEP + "database"); e != nil {
+		return
+	}
+	defer func() {
+		if e != nil {
+			database.Close()
 		}
+	}()
+	fresh := database.Use("users") == nil
+	if userDB, e = openCollection("users", "Name", "Pass", "Email"); e != nil {
+		return
+	}
+	if fresh {
 		log.Println("User database created.")
-	} else {
-		userDB = database.Use("users")
+	}
+	for _, load := range []func() error{loadMetaDB, loadTokenDB, loadAuditDB, loadHistoryDB, loadNotesDB,
+		loadScriptsDB, loadTasksDB, loadWebhooksDB, loadBridgesDB, loadPeersDB} {
+		if e = load(); e != nil {
+			return
+		}
+	}
+	if e = migrate(fresh); e != nil {
+		return
 	}
 	log.Println("Loaded user database.")
+	return
+}
+
+// startServices starts the webhooks, IRC bridges and federation peers stored
+// in the database. The command line subcommands open the database without
+// starting them.
+func startServices() {
+	startWebhooks()
+	startBridges()
+	startPeers()
 }
 
 func closeUserDB() {
@@ -102,77 +153,232 @@ func closeUserDB() {
 	log.Println("Closed user database.")
 }
 
+// userExists returns true if a registered account named name exists.
 func userExists(name string) bool {
-	_, rb, err := queryUser(name)
-	if err != nil {
+	_, _, err := userByName(name)
+	if err != nil && err != errNoUser {
 		log.Println(err)
 	}
-	if rb["Name"] == strings.ToLower(name) {
-		return true
+	return err == nil
+}
+
+// userByName returns the ID and record of the account registered as name.
+func userByName(name string) (id int, r userRecord, err error) {
+	if !isName(name) {
+		return 0, r, errNoUser
 	}
-	return false
+	return firstUser(eq("Name", strings.ToLower(name)))
 }
 
-func userID(name string) int {
-	var query interface{}
-	result := make(map[int]struct{})
-	json.Unmarshal([]byte(`[{"eq": "`+strings.ToLower(name)+`", "in": ["Name"]}]`), &query)
-	if err := db.EvalQuery(query, userDB, &result); err != nil {
+// userByEmail returns the ID and record of the account registered with email.
+func userByEmail(email string) (id int, r userRecord, err error) {
+	if !isEmail(email) {
+		return 0, r, errNoUser
+	}
+	return firstUser(eq("Email", strings.ToLower(email)))
+}
+
+// userByID returns the record stored under id.
+func userByID(id int) (r userRecord, err error) {
+	dbLock.RLock()
+	doc, err := userDB.Read(id)
+	dbLock.RUnlock()
+	if err != nil {
+		return r, errNoUser
+	}
+	if r, err = decodeUser(id, doc); err != nil {
 		log.Println(err)
-		return 0
 	}
-	for id := range result {
-		return id
-		break //only need one result
+	return
+}
+
+// firstUser runs q against the users collection and returns the first match.
+func firstUser(q query) (id int, r userRecord, err error) {
+	dbLock.RLock()
+	ids, err := q.run(userDB)
+	dbLock.RUnlock()
+	if err != nil {
+		return 0, r, err
+	}
+	if len(ids) == 0 {
+		return 0, r, errNoUser
+	}
+	id = ids[0]
+	if r, err = userByID(id); err != nil {
+		return 0, r, err
 	}
-	return 0
+	return
 }
 
-func userDoc(id int) (rb map[string]interface{}, err error) {
-	rb, err = userDB.Read(id)
+// insertUser stores a new account record. The name check and the insert
+// happen under userLock so two registrations can't claim the same name.
+func insertUser(r userRecord) (id int, err error) {
+	r.Name, r.Email = strings.ToLower(r.Name), strings.ToLower(r.Email)
+	doc, err := encodeDoc(r)
+	if err != nil {
+		return 0, err
+	}
+	userLock.Lock()
+	defer userLock.Unlock()
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	ids, err := eq("Name", r.Name).run(userDB)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	if len(ids) > 0 {
+		return 0, errors.New("User already exists.")
+	}
+	return userDB.Insert(doc)
+}
+
+// changeUser applies change to the record stored under id and saves it. The
+// record is read and written under userLock, so a command that waited at a
+// prompt doesn't overwrite changes made meanwhile. Nothing is saved when
+// change returns an error.
+func changeUser(id int, change func(r *userRecord) error) (r userRecord, err error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+	if r, err = userByID(id); err != nil {
+		return
+	}
+	if err = change(&r); err != nil {
+		return
+	}
+	r.Name, r.Email = strings.ToLower(r.Name), strings.ToLower(r.Email)
+	doc, err := encodeDoc(r)
+	if err != nil {
+		return
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	err = userDB.Update(id, doc)
 	return
 }
 
-func queryUser(name string) (id int, rb map[string]interface{}, err error) {
-	if id := userID(name); id == 0 {
-		return 0, nil, errors.New("User not found.")
-	} else {
-		rb, err = userDoc(id)
-		if err != nil {
-			return 0, nil, err
+// renameUser changes the name of the account stored under id. Like
+// insertUser the check and the update happen under userLock.
+func renameUser(id int, name string) (r userRecord, err error) {
+	if err = checkName(name); err != nil {
+		return
+	}
+	if isAdminName(name) {
+		return r, errReserved
+	}
+	name = strings.ToLower(name)
+	userLock.Lock()
+	defer userLock.Unlock()
+	if r, err = userByID(id); err != nil {
+		return
+	}
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	ids, err := eq("Name", name).run(userDB)
+	if err != nil {
+		return
+	}
+	for _, other := range ids {
+		if other != id {
+			return r, errors.New("User already exists.")
 		}
 	}
+	r.Name = name
+	r.Renamed = time.Now().UTC()
+	doc, err := encodeDoc(r)
+	if err != nil {
+		return
+	}
+	err = userDB.Update(id, doc)
 	return
 }
 
+// deleteUser removes the account stored under id along with its tokens,
+// history, notes, scripts and reminders.
+func deleteUser(id int) error {
+	userLock.Lock()
+	defer userLock.Unlock()
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if err := userDB.Delete(id); err != nil {
+		return err
+	}
+	deleteTokens(id)
+	deleteHistory(id)
+	deleteNotes(id)
+	deleteScripts(id)
+	deleteTasks(id)
+	return nil
+}
+
+// purgeHooks remove content authored by a deleted account when the user asks
+// for it with "deleteaccount purge".
+var purgeHooks []func(id int, name string)
+
 // login checks the users password and loads their info from the users database.
-func (u *user) login(name, pass string) error {
-	if id, doc, err := queryUser(name); err != nil {
+// If the account has two-factor authentication enabled code is called to get
+// the one-time code.
+func (u *user) login(name, pass string, code func() (string, error)) error {
+	id, r, err := userByName(name)
+	if err != nil {
 		log.Println(err)
 		return err
-	} else {
-		name = strings.ToLower(name)
-		if doc["Name"] == name && doc["Pass"] == pass {
-			u.Name = strings.Title(doc["Name"].(string))
-			u.Email = doc["Email"].(string)
-			u.ID = id
-			u.auth = true
-			users[name] = u
-			return nil
-		}
+	}
+	if r.Name != strings.ToLower(name) || r.Pass != pass {
 		return errors.New("Bad username or password.")
 	}
+	var c string
+	if r.TOTPEnabled {
+		if c, err = code(); err != nil {
+			return err
+		}
+	}
+	// the record may have changed while waiting for the code
+	r, err = changeUser(id, func(r *userRecord) error {
+		if r.Pass != pass {
+			return errors.New("Bad username or password.")
+		}
+		// saves the used second factor too
+		if r.TOTPEnabled && !secondFactor(r, c) {
+			return errBadCode
+		}
+		r.LastSeen = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.Name = strings.Title(r.Name)
+	u.Email = r.Email
+	u.verified = r.Verified
+	u.ID = id
+	u.auth = true
+	return nil
+}
+
+// isAdminName returns true if name is one of the names given by -admins.
+// Those names are reserved, the accounts are made with the adduser
+// subcommand.
+func isAdminName(name string) bool {
+	for _, admin := range strings.Split(*admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && strings.EqualFold(admin, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin returns true if u is logged in as one of the names given by -admins.
+func (u *user) isAdmin() bool {
+	return u.auth && isAdminName(u.Name)
 }
 
 func (u *user) logout() error {
 	if u.auth == true {
-		delete(users, strings.ToLower(u.Name))
+		touchUser(u.ID)
 		u.Name = guestName()
 		u.Email = "blank"
 		u.auth = false
+		u.verified = false
 		u.ID = 0
 		return nil
 	}
@@ -181,15 +387,16 @@ func (u *user) logout() error {
 
 // save will save a users info in users database.
 func (u *user) save(name, pass, email string) error {
-	if userExists(name) {
-		return errors.New("User already exists.")
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if isAdminName(name) {
+		return errReserved
 	}
-	_, err := userDB.Insert(map[string]interface{}{
-		"Name":  strings.ToLower(name),
-		"Pass":  pass,
-		"Email": email})
+	id, err := insertUser(userRecord{Name: name, Pass: pass, Email: email, Created: time.Now().UTC()})
 	if err != nil {
 		return err
 	}
+	u.ID = id
 	return nil
 }
@@ -0,0 +1,455 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+This file contains room webhooks. An incoming webhook is a secret URL anything
+POSTed to is said on its chat server by a bot. An outgoing webhook POSTs each
+message said on its chat server that matches its filters to a URL as JSON,
+signed with an HMAC-SHA256 of the body in the X-Soshell-Signature header.
+Failed deliveries are retried a few times and the last few deliveries of each
+webhook are kept for the webhook log command.
+*/
+
+//
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxHookLines    = 10   // lines a single incoming request may post
+	maxHookBody     = 8192 // bytes of an incoming request
+	minHookGap      = time.Second
+	hookAttempts    = 4   // deliveries of an outgoing message before giving up
+	hookQueue       = 100 // messages waiting per outgoing webhook
+	hookLogSize     = 50  // deliveries remembered per outgoing webhook
+	hookHTTPTimeout = 10 * time.Second
+)
+
+var webhooksDB *db.Col
+
+// hookBackoff is the wait before retrying a failed delivery, doubled each
+// time.
+var hookBackoff = 2 * time.Second
+
+// webhookRecord is the stored form of a webhook.
+type webhookRecord struct {
+	Room    string
+	Name    string // the bot an incoming webhook posts as
+	Hash    string // of the token in the URL of an incoming webhook
+	URL     string // where an outgoing webhook delivers to
+	Secret  string // signing key of an outgoing webhook
+	Match   string // regular expression messages must match, if set
+	From    []string
+	Bots    bool // also forward messages posted by incoming webhooks
+	UserID  int
+	Created time.Time
+}
+
+// outgoing returns true if r delivers messages rather than receiving them.
+func (r webhookRecord) outgoing() bool {
+	return r.URL != ""
+}
+
+// delivery is an attempt to deliver a message to an outgoing webhook.
+type delivery struct {
+	ID       string
+	Time     time.Time
+	Attempts int
+	Status   string
+	OK       bool
+}
+
+// webhook is a loaded webhook.
+type webhook struct {
+	ID int
+	webhookRecord
+	match *regexp.Regexp
+	queue chan hookPayload // waiting to be delivered
+	stop  chan struct{}    // closed when the webhook is removed
+
+	sync.Mutex // guards the fields below
+	last       time.Time
+	log        []delivery
+}
+
+// webhooks holds the loaded webhooks by ID.
+var webhooks = struct {
+	sync.RWMutex
+	m map[int]*webhook
+}{m: make(map[int]*webhook)}
+
+// hookPayload is the JSON body an outgoing webhook POSTs.
+type hookPayload struct {
+	ID   string    `json:"id"`
+	Kind string    `json:"kind"`
+	Room string    `json:"room"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	Bot  bool      `json:"bot"`
+	Time time.Time `json:"time"`
+}
+
+// loadWebhooksDB opens the webhooks collection, creating it if needed.
+func loadWebhooksDB() (e error) {
+	webhooksDB, e = openCollection("webhooks", "Hash")
+	return
+}
+
+// startWebhooks starts the stored webhooks, replacing any running ones.
+func startWebhooks() {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	loaded := make(map[int]*webhook)
+	webhooksDB.ForEachDoc(func(id int, doc []byte) bool {
+		var r webhookRecord
+		if err := decodeJSON("webhooks", id, doc, &r); err != nil {
+			log.Println(err)
+		} else if h, err := startWebhook(id, r); err != nil {
+			log.Printf("webhook %d: %v", id, err)
+		} else {
+			loaded[id] = h
+		}
+		return true
+	})
+	webhooks.Lock()
+	for _, h := range webhooks.m {
+		close(h.stop)
+	}
+	webhooks.m = loaded
+	webhooks.Unlock()
+}
+
+// startWebhook returns the loaded form of r, starting the delivery of an
+// outgoing webhook.
+func startWebhook(id int, r webhookRecord) (h *webhook, e error) {
+	h = &webhook{ID: id, webhookRecord: r, stop: make(chan struct{})}
+	if r.Match != "" {
+		if h.match, e = regexp.Compile("(?i)" + r.Match); e != nil {
+			return nil, e
+		}
+	}
+	if r.outgoing() {
+		h.queue = make(chan hookPayload, hookQueue)
+		go h.deliver()
+	}
+	return
+}
+
+// addWebhook stores and starts a new webhook.
+func addWebhook(r webhookRecord) (id int, e error) {
+	r.Created = time.Now().UTC()
+	h, e := startWebhook(0, r)
+	if e != nil {
+		return
+	}
+	doc, e := encodeDoc(r)
+	if e != nil {
+		return
+	}
+	dbLock.RLock()
+	id, e = webhooksDB.Insert(doc)
+	dbLock.RUnlock()
+	if e != nil {
+		close(h.stop)
+		return
+	}
+	h.ID = id
+	webhooks.Lock()
+	webhooks.m[id] = h
+	webhooks.Unlock()
+	return
+}
+
+// removeWebhook deletes the webhook with id.
+func removeWebhook(id int) error {
+	webhooks.Lock()
+	h, ok := webhooks.m[id]
+	delete(webhooks.m, id)
+	webhooks.Unlock()
+	if !ok {
+		return errors.New("No such webhook.")
+	}
+	close(h.stop)
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return webhooksDB.Delete(id)
+}
+
+// getWebhook returns the webhook with id.
+func getWebhook(id int) (h *webhook, ok bool) {
+	webhooks.RLock()
+	defer webhooks.RUnlock()
+	h, ok = webhooks.m[id]
+	return
+}
+
+// listWebhooks returns the webhooks of room, or all if room is "", by ID.
+func listWebhooks(room string) (list []*webhook) {
+	webhooks.RLock()
+	for _, h := range webhooks.m {
+		if room == "" || strings.EqualFold(h.Room, room) {
+			list = append(list, h)
+		}
+	}
+	webhooks.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return
+}
+
+// incomingWebhook returns the incoming webhook with token.
+func incomingWebhook(token string) (*webhook, bool) {
+	hash := hashToken(token)
+	webhooks.RLock()
+	defer webhooks.RUnlock()
+	for _, h := range webhooks.m {
+		if !h.outgoing() && hmac.Equal([]byte(h.Hash), []byte(hash)) {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// hookURL returns the URL of the incoming webhook with token.
+func hookURL(token string) string {
+	return "https://" + *hostname + ":" + *httpsPort + "/hook/" + token
+}
+
+// randHex returns n random bytes hex encoded.
+func randHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// serveHook says the lines POSTed to an incoming webhook URL on its chat
+// server. The body is either JSON with a text field, a form with a text
+// field or plain text.
+func serveHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if !isTLS(r) {
+		http.Error(w, "HTTPS required", 403)
+		return
+	}
+	h, ok := incomingWebhook(mux.Vars(r)["token"])
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	h.Lock()
+	early := time.Since(h.last) < minHookGap
+	if !early {
+		h.last = time.Now()
+	}
+	h.Unlock()
+	if early {
+		http.Error(w, "Too many requests", 429)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+	if err != nil {
+		http.Error(w, "Request too large", 413)
+		return
+	}
+	text := string(body)
+	var msg struct{ Text string }
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err = json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, "Bad JSON", 400)
+			return
+		}
+		text = msg.Text
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, _ := url.ParseQuery(text)
+		text = form.Get("text")
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 || len(lines) > maxHookLines {
+		http.Error(w, fmt.Sprintf("Send 1 to %d lines of text", maxHookLines), 400)
+		return
+	}
+	s, ok := servers.get(h.Room)
+	if !ok {
+		w.WriteHeader(202)
+		fmt.Fprintln(w, "Nobody is on "+h.Room)
+		return
+	}
+	for _, line := range lines {
+		if !s.send(roomMessage{Kind: "message", From: h.Name, Text: line, Bot: true, Origin: "webhook"}) {
+			w.WriteHeader(202)
+			fmt.Fprintln(w, "Nobody is on "+h.Room)
+			return
+		}
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// sendWebhooks queues m for the outgoing webhooks of its room that it
+// matches. It never blocks, a webhook with a full queue misses the message.
+func sendWebhooks(m roomMessage) {
+	if m.Kind != "message" {
+		return
+	}
+	webhooks.RLock()
+	defer webhooks.RUnlock()
+	for _, h := range webhooks.m {
+		if h.outgoing() && strings.EqualFold(h.Room, m.Room) && h.wants(m) {
+			h.send(hookPayload{Kind: m.Kind, Room: m.Room, From: m.From, Text: m.Text, Bot: m.Bot, Time: m.Time.UTC()})
+		}
+	}
+}
+
+// send queues p for delivery without blocking.
+func (h *webhook) send(p hookPayload) {
+	p.ID = randHex(8)
+	select {
+	case h.queue <- p:
+	default:
+		h.logDelivery(delivery{ID: p.ID, Time: time.Now(), Status: "dropped, queue full"})
+	}
+}
+
+// wants returns true if m passes the filters of h.
+func (h *webhook) wants(m roomMessage) bool {
+	if m.Bot && !h.Bots {
+		return false
+	}
+	if len(h.From) > 0 {
+		found := false
+		for _, name := range h.From {
+			found = found || strings.EqualFold(name, m.From)
+		}
+		if !found {
+			return false
+		}
+	}
+	return h.match == nil || h.match.MatchString(m.Text)
+}
+
+// deliver POSTs the queued payloads of h in order until it is removed.
+func (h *webhook) deliver() {
+	client := &http.Client{Timeout: hookHTTPTimeout}
+	for {
+		select {
+		case <-h.stop:
+			return
+		case p := <-h.queue:
+			b, err := json.Marshal(p)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			d := delivery{ID: p.ID, Time: time.Now()}
+			wait := hookBackoff
+			for d.Attempts < hookAttempts {
+				d.Attempts++
+				var retry bool
+				d.Status, retry = h.post(client, p.ID, b)
+				if d.OK = d.Status == ""; d.OK || !retry {
+					break
+				}
+				select {
+				case <-h.stop:
+					return
+				case <-time.After(wait):
+				}
+				wait *= 2
+			}
+			if d.OK {
+				d.Status = "delivered"
+			}
+			h.logDelivery(d)
+		}
+	}
+}
+
+// post makes one attempt at delivering body. It returns "" on success or
+// what went wrong and whether it is worth trying again.
+func (h *webhook) post(client *http.Client, id string, body []byte) (status string, retry bool) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err.Error(), false
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "soshell-webhook")
+	req.Header.Set("X-Soshell-Delivery", id)
+	req.Header.Set("X-Soshell-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	res, err := client.Do(req)
+	if err != nil {
+		return err.Error(), true
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return "", false
+	}
+	return res.Status, res.StatusCode >= 500 || res.StatusCode == 429
+}
+
+// logDelivery remembers d, forgetting the oldest deliveries beyond
+// hookLogSize.
+func (h *webhook) logDelivery(d delivery) {
+	h.Lock()
+	defer h.Unlock()
+	if h.log = append(h.log, d); len(h.log) > hookLogSize {
+		h.log = h.log[len(h.log)-hookLogSize:]
+	}
+}
+
+// deliveries returns the remembered deliveries of h, newest last.
+func (h *webhook) deliveries() []delivery {
+	h.Lock()
+	defer h.Unlock()
+	return append([]delivery(nil), h.log...)
+}
+
+// describe returns a line describing h for the webhook command.
+func (h *webhook) describe() string {
+	if !h.outgoing() {
+		return fmt.Sprintf("%d  %s  in, posts as %s", h.ID, h.Room, h.Name)
+	}
+	line := fmt.Sprintf("%d  %s  out to %s", h.ID, h.Room, h.URL)
+	if h.Match != "" {
+		line += ", matching " + h.Match
+	}
+	if len(h.From) > 0 {
+		line += ", from " + strings.Join(h.From, ",")
+	}
+	if h.Bots {
+		line += ", with bots"
+	}
+	return line
+}
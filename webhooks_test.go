@@ -0,0 +1,220 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+//
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// recorder is a chat server member that keeps what it is sent.
+type recorder struct {
+	sync.Mutex
+	id   string
+	msgs []roomMessage
+}
+
+func (r *recorder) sessionID() string { return r.id }
+
+func (r *recorder) nick() string { return r.id }
+
+func (r *recorder) deliver(m roomMessage) {
+	r.Lock()
+	r.msgs = append(r.msgs, m)
+	r.Unlock()
+}
+
+func (r *recorder) said() (texts []string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.msgs {
+		if m.Kind == "message" {
+			texts = append(texts, m.From+": "+m.Text)
+		}
+	}
+	return
+}
+
+// waitFor polls ok until it returns true or a few seconds have passed.
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if ok() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for " + what)
+}
+
+// received is a request seen by a test receiver.
+type received struct {
+	body      []byte
+	signature string
+	delivery  string
+}
+
+// receiver starts an HTTP server answering with the given statuses in turn,
+// then 200, and passing on what it receives.
+func receiver(t *testing.T, statuses ...int) (*httptest.Server, chan received) {
+	got := make(chan received, 10)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- received{body, r.Header.Get("X-Soshell-Signature"), r.Header.Get("X-Soshell-Delivery")}
+		mu.Lock()
+		status := 200
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func outgoingHook(t *testing.T, url string) *webhook {
+	h, err := startWebhook(1, webhookRecord{Room: "lobby", URL: url, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { close(h.stop) })
+	return h
+}
+
+func TestWebhookSignature(t *testing.T) {
+	srv, got := receiver(t)
+	h := outgoingHook(t, srv.URL)
+	h.send(hookPayload{Kind: "message", Room: "lobby", From: "Alice", Text: "hi"})
+	var r received
+	select {
+	case r = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered")
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(r.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.signature != want {
+		t.Errorf("signature %q, want %q", r.signature, want)
+	}
+	var p hookPayload
+	if err := json.Unmarshal(r.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.From != "Alice" || p.Text != "hi" || p.ID != r.delivery {
+		t.Errorf("payload %+v with delivery %q", p, r.delivery)
+	}
+	waitFor(t, "the delivery log", func() bool { return len(h.deliveries()) == 1 })
+	if d := h.deliveries()[0]; !d.OK || d.Attempts != 1 {
+		t.Errorf("logged %+v", d)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	defer func(d time.Duration) { hookBackoff = d }(hookBackoff)
+	hookBackoff = 10 * time.Millisecond
+	for _, c := range []struct {
+		name     string
+		statuses []int
+		attempts int
+		ok       bool
+		status   string
+	}{
+		{"recovers", []int{500, 503}, 3, true, "delivered"},
+		{"throttled", []int{429}, 2, true, "delivered"},
+		{"gives up", []int{500, 500, 500, 500}, hookAttempts, false, "500 Internal Server Error"},
+		{"client error", []int{404}, 1, false, "404 Not Found"},
+	} {
+		srv, got := receiver(t, c.statuses...)
+		h := outgoingHook(t, srv.URL)
+		start := time.Now()
+		h.send(hookPayload{Kind: "message", Room: "lobby", From: "Alice", Text: "hi"})
+		waitFor(t, c.name, func() bool { return len(h.deliveries()) == 1 })
+		d := h.deliveries()[0]
+		if d.Attempts != c.attempts || d.OK != c.ok || d.Status != c.status {
+			t.Errorf("%s: logged %+v", c.name, d)
+		}
+		if len(got) != c.attempts {
+			t.Errorf("%s: %d requests, want %d", c.name, len(got), c.attempts)
+		}
+		// the waits double: 10ms, 20ms, 40ms
+		if min := hookBackoff * time.Duration(1<<uint(c.attempts-1)-1); time.Since(start) < min {
+			t.Errorf("%s: retried after %v, want at least %v", c.name, time.Since(start), min)
+		}
+	}
+}
+
+func TestServeHook(t *testing.T) {
+	webhooks.Lock()
+	saved := webhooks.m
+	webhooks.m = map[int]*webhook{
+		1: {ID: 1, webhookRecord: webhookRecord{Room: "hooktest", Name: "Builder", Hash: hashToken("good")}},
+	}
+	webhooks.Unlock()
+	defer func() {
+		webhooks.Lock()
+		webhooks.m = saved
+		webhooks.Unlock()
+	}()
+	r := mux.NewRouter()
+	r.HandleFunc("/hook/{token}", serveHook)
+	srv := httptest.NewTLSServer(r)
+	defer srv.Close()
+	post := func(client *http.Client, url, kind, body string) (int, string) {
+		t.Helper()
+		res, err := client.Post(url, kind, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	plain := httptest.NewServer(r)
+	defer plain.Close()
+	if code, _ := post(plain.Client(), plain.URL+"/hook/good", "text/plain", "hi"); code != 403 {
+		t.Errorf("plain HTTP got %d, want 403", code)
+	}
+	for _, token := range []string{"bad", "goo", "good2"} {
+		if code, _ := post(srv.Client(), srv.URL+"/hook/"+token, "text/plain", "hi"); code != 404 {
+			t.Errorf("token %q got %d, want 404", token, code)
+		}
+	}
+	if res, err := srv.Client().Get(srv.URL + "/hook/good"); err != nil || res.StatusCode != 405 {
+		t.Errorf("GET got %v %v, want 405", res, err)
+	}
+
+	if code, body := post(srv.Client(), srv.URL+"/hook/good", "text/plain", "hi"); code != 202 || body != "Nobody is on hooktest" {
+		t.Errorf("empty server got %d %q", code, body)
+	}
+	if code, _ := post(srv.Client(), srv.URL+"/hook/good", "text/plain", "again"); code != 429 {
+		t.Errorf("second request got %d, want 429", code)
+	}
+
+	m := &recorder{id: "watcher"}
+	join("hooktest", m)
+	defer part("hooktest", m)
+	time.Sleep(minHookGap)
+	if code, body := post(srv.Client(), srv.URL+"/hook/good", "application/json", `{"text": "build passed\nall green"}`); code != 200 || body != "OK" {
+		t.Errorf("JSON got %d %q", code, body)
+	}
+	waitFor(t, "the hook messages", func() bool { return len(m.said()) == 2 })
+	if said := m.said(); said[0] != "Builder: build passed" || said[1] != "Builder: all green" {
+		t.Errorf("said %q", said)
+	}
+}